@@ -0,0 +1,446 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/danieledapo/gork/gork"
+)
+
+const usage = `Addresses and values are hexadecimal, object numbers are decimal.
+  break ADDR            stop before the instruction at ADDR
+  rbreak ADDR           stop when the routine at byte address ADDR is called
+  watch ADDR [N]        stop when one of the N bytes at ADDR changes (2 by default)
+  delete ADDR           remove the breakpoint or the watch at ADDR
+  info                  list the breakpoints and the watches
+  step [N], s           run N instructions (1 by default)
+  next, n               run an instruction, calls included
+  finish                run until the current routine returns
+  continue, c           run until a breakpoint, ctrl-c stops the story
+  stack, bt             show the routines on the stack with their locals
+  global N [VALUE]      show or set the global N, G00-GEF
+  object N              show the object N
+  x ADDR [N]            show N bytes of memory at ADDR (16 by default)
+  list [N]              disassemble N instructions around the PC (5 by default)
+  restart               restart the story
+  quit, q               leave the debugger
+An empty line repeats the last command.
+`
+
+// debugger runs a machine an instruction at a time stopping at the
+// breakpoints
+type debugger struct {
+	zm   *gork.ZMachine
+	term *gork.ZTerminal
+	out  io.Writer
+
+	breaks   map[uint32]bool
+	routines map[uint32]bool
+	// the bytes at the watched addresses when they were last checked
+	watches map[uint32][]byte
+
+	// set by ctrl-c, the story stops at the next instruction
+	interrupted atomic.Bool
+}
+
+func newDebugger(zm *gork.ZMachine, term *gork.ZTerminal, out io.Writer) *debugger {
+	return &debugger{
+		zm:       zm,
+		term:     term,
+		out:      out,
+		breaks:   make(map[uint32]bool),
+		routines: make(map[uint32]bool),
+		watches:  make(map[uint32][]byte),
+	}
+}
+
+// loop reads the commands until the player quits or stdin is over
+func (d *debugger) loop() {
+	fmt.Fprintln(d.out, `Type "help" for the commands.`)
+	d.where()
+
+	last := ""
+	for {
+		fmt.Fprint(d.out, "(gork) ")
+		line, err := d.term.ReadLine()
+		if err != nil {
+			fmt.Fprintln(d.out)
+			return
+		}
+
+		line = strings.TrimSpace(line)
+		if line == "" {
+			line = last
+		}
+		last = line
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] == "quit" || fields[0] == "q" {
+			return
+		}
+		if err := d.command(fields[0], fields[1:]); err != nil {
+			fmt.Fprintln(d.out, err)
+		}
+	}
+}
+
+func (d *debugger) command(name string, args []string) error {
+	switch name {
+	case "help", "h":
+		fmt.Fprint(d.out, usage)
+	case "break", "b":
+		addr, err := hexArg(args, 0)
+		if err != nil {
+			return err
+		}
+		d.breaks[addr] = true
+	case "rbreak":
+		addr, err := hexArg(args, 0)
+		if err != nil {
+			return err
+		}
+		d.routines[addr] = true
+	case "watch":
+		return d.watch(args)
+	case "delete":
+		addr, err := hexArg(args, 0)
+		if err != nil {
+			return err
+		}
+		if !d.breaks[addr] && !d.routines[addr] && d.watches[addr] == nil {
+			return fmt.Errorf("nothing at %X", addr)
+		}
+		delete(d.breaks, addr)
+		delete(d.routines, addr)
+		delete(d.watches, addr)
+	case "info":
+		d.info()
+	case "step", "s":
+		n, err := optionalArg(args, 0, 1, 10)
+		if err != nil {
+			return err
+		}
+		return d.run(func() bool {
+			n--
+			return n == 0
+		})
+	case "next", "n":
+		depth := d.zm.Depth()
+		return d.run(func() bool {
+			return d.zm.Depth() <= depth
+		})
+	case "finish":
+		depth := d.zm.Depth()
+		if depth == 1 {
+			return errors.New("the main routine never returns")
+		}
+		return d.run(func() bool {
+			return d.zm.Depth() < depth
+		})
+	case "continue", "c":
+		return d.run(func() bool {
+			return false
+		})
+	case "stack", "bt":
+		d.stack()
+	case "global", "g":
+		return d.global(args)
+	case "object", "o":
+		return d.object(args)
+	case "x":
+		return d.examine(args)
+	case "list", "l":
+		n, err := optionalArg(args, 0, 5, 10)
+		if err != nil {
+			return err
+		}
+		d.list(int(n))
+	case "restart":
+		if err := d.zm.Reset(); err != nil {
+			return err
+		}
+		d.where()
+	default:
+		return fmt.Errorf("unknown command %q, try help", name)
+	}
+	return nil
+}
+
+// run executes instructions until stop returns true after one of them or
+// the story reaches a breakpoint, changes a watched address or quits
+func (d *debugger) run(stop func() bool) error {
+	if d.zm.Quitted() {
+		return errors.New("the story is over, restart it")
+	}
+	d.interrupted.Store(false)
+
+	for first := true; ; first = false {
+		pc := d.zm.PC()
+		// the breakpoint the story is stopped at is not hit again
+		if !first && d.breaks[pc] {
+			fmt.Fprintf(d.out, "Breakpoint at %X\n", pc)
+			break
+		}
+
+		depth := d.zm.Depth()
+		if err := d.zm.Interpret(); err != nil {
+			d.report(err)
+			break
+		}
+
+		if d.zm.Depth() > depth {
+			if routine := d.zm.Frames()[0].Routine; d.routines[routine] {
+				fmt.Fprintf(d.out, "Routine %X called at %X\n", routine, pc)
+				break
+			}
+		}
+		if d.checkWatches(pc) || d.zm.Quitted() || stop() {
+			break
+		}
+		if d.interrupted.Swap(false) {
+			fmt.Fprintln(d.out, "Interrupted")
+			break
+		}
+	}
+
+	d.where()
+	return nil
+}
+
+// report describes why the story stopped, with the call stack of the
+// story if it crashed
+func (d *debugger) report(err error) {
+	var zerr *gork.ZRuntimeError
+	if errors.As(err, &zerr) {
+		fmt.Fprintf(d.out, "\nThe story crashed: %s\n%s", zerr, zerr.Backtrace)
+		return
+	}
+	fmt.Fprintf(d.out, "\nThe story stopped: %s\n", err)
+}
+
+// where shows the next instruction
+func (d *debugger) where() {
+	if d.zm.Quitted() {
+		fmt.Fprintln(d.out, "The story is over")
+		return
+	}
+
+	op, err := d.zm.Disassemble(d.zm.PC())
+	if err != nil {
+		fmt.Fprintf(d.out, "%X: %s\n", d.zm.PC(), err)
+		return
+	}
+	fmt.Fprintf(d.out, "%X: %s\n", op.PC(), op.Disassembly())
+}
+
+func (d *debugger) watch(args []string) error {
+	addr, err := hexArg(args, 0)
+	if err != nil {
+		return err
+	}
+	n, err := optionalArg(args, 1, 2, 16)
+	if err != nil {
+		return err
+	}
+
+	b, err := d.zm.ReadMemory(addr, int(n))
+	if err != nil {
+		return err
+	}
+	d.watches[addr] = b
+	return nil
+}
+
+// checkWatches reports the watched addresses changed by the instruction at
+// pc, it returns true if there are some
+func (d *debugger) checkWatches(pc uint32) bool {
+	changed := false
+	for addr, old := range d.watches {
+		b, err := d.zm.ReadMemory(addr, len(old))
+		if err != nil || bytes.Equal(b, old) {
+			continue
+		}
+		fmt.Fprintf(d.out, "Watch %X changed by %X: % X -> % X\n", addr, pc, old, b)
+		d.watches[addr] = b
+		changed = true
+	}
+	return changed
+}
+
+func (d *debugger) info() {
+	for _, addr := range sortedKeys(d.breaks) {
+		fmt.Fprintf(d.out, "break %X\n", addr)
+	}
+	for _, addr := range sortedKeys(d.routines) {
+		fmt.Fprintf(d.out, "rbreak %X\n", addr)
+	}
+	for _, addr := range sortedKeys(d.watches) {
+		fmt.Fprintf(d.out, "watch %X % X\n", addr, d.watches[addr])
+	}
+}
+
+func (d *debugger) stack() {
+	for i, frame := range d.zm.Frames() {
+		fmt.Fprintf(d.out, "#%d routine %X", i, frame.Routine)
+		if frame.ReturnPC != 0 {
+			fmt.Fprintf(d.out, " returning to %X", frame.ReturnPC)
+		}
+		if frame.Interrupt {
+			fmt.Fprint(d.out, " (interrupt)")
+		}
+		fmt.Fprintln(d.out)
+
+		if len(frame.Locals) > 0 {
+			fmt.Fprint(d.out, "   ")
+			for n, v := range frame.Locals {
+				fmt.Fprintf(d.out, " L%02X=%04X", n+1, v)
+			}
+			fmt.Fprintln(d.out)
+		}
+		if len(frame.Stack) > 0 {
+			fmt.Fprintf(d.out, "    stack %04X\n", frame.Stack)
+		}
+	}
+}
+
+func (d *debugger) global(args []string) error {
+	n, err := hexArg(args, 0)
+	if err != nil {
+		return err
+	}
+
+	if len(args) > 1 {
+		v, err := strconv.ParseUint(strings.TrimPrefix(args[1], "0x"), 16, 16)
+		if err != nil {
+			return err
+		}
+		return d.zm.SetGlobal(int(n), uint16(v))
+	}
+
+	v, err := d.zm.Global(int(n))
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(d.out, "G%02X = %04X (%d)\n", n, v, int16(v))
+	return nil
+}
+
+func (d *debugger) object(args []string) error {
+	if len(args) < 1 {
+		return errors.New("missing object number")
+	}
+	id, err := strconv.ParseUint(args[0], 10, 16)
+	if err != nil {
+		return err
+	}
+
+	obj, err := d.zm.Object(uint16(id))
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(d.out, "%3d. %s", id, obj)
+	return nil
+}
+
+// examine shows memory as a hex dump
+func (d *debugger) examine(args []string) error {
+	addr, err := hexArg(args, 0)
+	if err != nil {
+		return err
+	}
+	n, err := optionalArg(args, 1, 16, 16)
+	if err != nil {
+		return err
+	}
+
+	b, err := d.zm.ReadMemory(addr, int(n))
+	if err != nil {
+		return err
+	}
+	for len(b) > 0 {
+		line := b[:min(16, len(b))]
+		fmt.Fprintf(d.out, "%06X  % X\n", addr, line)
+		addr += uint32(len(line))
+		b = b[len(line):]
+	}
+	return nil
+}
+
+// list disassembles the current routine from its start to find the n
+// instructions before the PC, then it goes on with n after it
+func (d *debugger) list(n int) {
+	pc := d.zm.PC()
+
+	before := []*gork.ZOp{}
+	for addr, i := d.zm.Frames()[0].Code, 0; addr < pc && i < 10000; i++ {
+		op, err := d.zm.Disassemble(addr)
+		if err != nil {
+			break
+		}
+		before = append(before, op)
+		addr = op.Next()
+	}
+	// the routine has data in its code, the PC is not after an instruction
+	if len(before) == 0 || before[len(before)-1].Next() != pc {
+		before = nil
+	}
+	if len(before) > n {
+		before = before[len(before)-n:]
+	}
+
+	for _, op := range before {
+		fmt.Fprintf(d.out, "   %X: %s\n", op.PC(), op.Disassembly())
+	}
+	for i, addr := 0, pc; i <= n; i++ {
+		op, err := d.zm.Disassemble(addr)
+		if err != nil {
+			fmt.Fprintf(d.out, "   %X: %s\n", addr, err)
+			return
+		}
+		marker := "   "
+		if addr == pc {
+			marker = "=> "
+		}
+		fmt.Fprintf(d.out, "%s%X: %s\n", marker, addr, op.Disassembly())
+		addr = op.Next()
+	}
+}
+
+// hexArg parses the argument i as an address
+func hexArg(args []string, i int) (uint32, error) {
+	if i >= len(args) {
+		return 0, errors.New("missing address")
+	}
+	v, err := strconv.ParseUint(strings.TrimPrefix(args[i], "0x"), 16, 32)
+	return uint32(v), err
+}
+
+// optionalArg parses the argument i, def if it's missing
+func optionalArg(args []string, i int, def uint64, base int) (uint64, error) {
+	if i >= len(args) {
+		return def, nil
+	}
+	v, err := strconv.ParseUint(args[i], base, 32)
+	if err == nil && v == 0 {
+		err = errors.New("the count must be positive")
+	}
+	return v, err
+}
+
+func sortedKeys[V any](m map[uint32]V) []uint32 {
+	keys := make([]uint32, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys
+}
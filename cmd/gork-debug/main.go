@@ -0,0 +1,55 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+
+	"github.com/danieledapo/gork/gork"
+)
+
+func main() {
+	saves := flag.String("saves", ".", "directory where save games are stored")
+	flag.Parse()
+
+	if len(flag.Args()) < 1 {
+		fmt.Println("Please provide a game")
+		return
+	}
+
+	buf, err := ioutil.ReadFile(flag.Args()[0])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	story, err := gork.NewZStory(buf)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	// the commands of the debugger and of the story are read from the
+	// same terminal, the output of the story goes in between
+	term := &gork.ZTerminal{}
+	zm, err := gork.NewZMachine(story, term, gork.NewZFileSaveStore(*saves), nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	d := newDebugger(zm, term, os.Stdout)
+
+	// ctrl-c stops the story instead of the debugger
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	go func() {
+		for range interrupts {
+			d.interrupted.Store(true)
+		}
+	}()
+
+	d.loop()
+}
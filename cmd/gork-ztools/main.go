@@ -4,6 +4,8 @@ import (
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"strings"
+	"unicode"
 
 	"github.com/danieledapo/gork/gork"
 )
@@ -14,6 +16,10 @@ type config struct {
 	showObjectTree    bool
 	showAbbreviations bool
 	showDictionary    bool
+	// optimise the abbreviations for the story strings or for the lines
+	// of corpus when set
+	optimiseAbbreviations bool
+	corpus                string
 }
 
 func main() {
@@ -22,6 +28,8 @@ func main() {
 	t := flag.Bool("t", false, "show object tree")
 	a := flag.Bool("a", false, "show abbreviations")
 	d := flag.Bool("d", false, "show dictionary")
+	O := flag.Bool("O", false, "compute optimised abbreviations and compare them to the story ones")
+	corpus := flag.String("corpus", "", "optimise the abbreviations for the lines of this file instead of the story strings")
 	flag.Parse()
 
 	conf := &config{
@@ -30,6 +38,9 @@ func main() {
 		showObjectTree:    *t,
 		showAbbreviations: *a,
 		showDictionary:    *d,
+
+		optimiseAbbreviations: *O,
+		corpus:                *corpus,
 	}
 
 	for _, story := range flag.Args() {
@@ -73,6 +84,12 @@ func dumpStoryInfo(story string, conf *config) {
 		fmt.Println(gork.NewZDictionary(mem, header))
 	}
 
+	if conf.optimiseAbbreviations {
+		if err := DumpOptimisedAbbreviations(mem, header, conf.corpus); err != nil {
+			fmt.Println("\nUnable to read corpus", conf.corpus, "Error:", err)
+		}
+	}
+
 	fmt.Println("")
 }
 
@@ -91,17 +108,121 @@ func DumpAbbreviations(mem *gork.ZMemory, header *gork.ZHeader) {
 	}
 }
 
+// DumpOptimisedAbbreviations computes the abbreviations for the story
+// strings, or for the lines of corpusPath if not empty, and reports how
+// many bytes they save compared to the abbreviations of the story
+func DumpOptimisedAbbreviations(mem *gork.ZMemory, header *gork.ZHeader, corpusPath string) error {
+	fmt.Print("\n    **** Optimised abbreviations ****\n\n")
+
+	corpus := storyStrings(mem, header)
+	if corpusPath != "" {
+		buf, err := ioutil.ReadFile(corpusPath)
+		if err != nil {
+			return err
+		}
+		corpus = strings.Split(strings.TrimRight(string(buf), "\n"), "\n")
+	}
+
+	chars := 0
+	for _, s := range corpus {
+		chars += len([]rune(s))
+	}
+	fmt.Printf("  Strings = %d, characters = %d\n\n", len(corpus), chars)
+
+	abbrs := gork.OptimiseAbbreviations(corpus, header)
+
+	plain := gork.ZStringsSize(corpus, header, nil)
+	current := gork.ZStringsSize(corpus, header, gork.GetAbbreviations(mem, header))
+	optimised := gork.ZStringsSize(corpus, header, abbrs)
+
+	fmt.Printf("  Without abbreviations   = %6d bytes\n", plain)
+	fmt.Printf("  Story abbreviations     = %6d bytes, %6d saved\n", current, plain-current)
+	fmt.Printf("  Optimised abbreviations = %6d bytes, %6d saved, %6d more than the story ones\n\n",
+		optimised, plain-optimised, current-optimised)
+
+	for i, abbr := range abbrs {
+		fmt.Printf("  [%2d] %q\n", i, abbr)
+	}
+
+	return nil
+}
+
+// storyStrings returns the names of the objects and the strings in high
+// memory. Nothing says where the strings are, so high memory is scanned for
+// words that decode to plausible text: a few pieces of code may slip in,
+// which doesn't matter much for statistics.
+func storyStrings(mem *gork.ZMemory, header *gork.ZHeader) []string {
+	ret := []string{}
+
+	if objects, err := gork.NewZObjectTable(mem, header); err == nil {
+		for i := uint16(1); i <= objects.Count(); i++ {
+			if obj, err := objects.Object(i); err == nil && obj.Name() != "" {
+				ret = append(ret, obj.Name())
+			}
+		}
+	}
+
+	// strings are at packed addresses, from v4 they are multiples of 4
+	align := gork.PackedAddress(1, header)
+	addr := (header.HighStart() + align - 1) / align * align
+
+	for addr+2 <= mem.Size() {
+		end, ok := zstringEnd(mem, addr)
+		if ok {
+			if s := mem.DecodeZStringAt(addr, header); plausibleText(s) {
+				ret = append(ret, s)
+				addr = (end + align - 1) / align * align
+				continue
+			}
+		}
+		addr += align
+	}
+
+	return ret
+}
+
+// zstringEnd returns the address after the Z-string at addr, which must
+// end within the memory and be shorter than a screen
+func zstringEnd(mem *gork.ZMemory, addr uint32) (uint32, bool) {
+	const maxWords = 1000
+
+	for i := uint32(0); i < maxWords && addr+2 <= mem.Size(); i++ {
+		w := mem.WordAt(addr)
+		addr += 2
+		if w&0x8000 != 0 {
+			return addr, true
+		}
+	}
+	return 0, false
+}
+
+// plausibleText tells whether s looks like text written by a person: it's
+// made mostly of letters and spaces and it has no control characters
+func plausibleText(s string) bool {
+	letters, total := 0, 0
+	for _, r := range s {
+		total++
+		if unicode.IsLetter(r) || r == ' ' {
+			letters++
+		} else if r != '\n' && !unicode.IsPrint(r) {
+			return false
+		}
+	}
+
+	return total >= 3 && letters*10 >= total*8
+}
+
 func DumpAllZObjects(mem *gork.ZMemory, header *gork.ZHeader) {
-	total, err := gork.ZObjectsCount(mem, header)
+	objects, err := gork.NewZObjectTable(mem, header)
 	if err != nil {
 		panic(err)
 	}
 
 	fmt.Print("\n    **** Objects ****\n\n")
-	fmt.Printf("  Object count = %d\n\n", total)
+	fmt.Printf("  Object count = %d\n\n", objects.Count())
 
-	for i := uint8(1); i <= total; i++ {
-		obj, err := gork.NewZObject(mem, i, header)
+	for i := uint16(1); i <= objects.Count(); i++ {
+		obj, err := objects.Object(i)
 		if err != nil {
 			panic(err)
 		}
@@ -113,49 +234,31 @@ func DumpZObjectsTree(mem *gork.ZMemory, header *gork.ZHeader) {
 
 	fmt.Print("\n    **** Object tree ****\n\n")
 
-	total, err := gork.ZObjectsCount(mem, header)
+	objects, err := gork.NewZObjectTable(mem, header)
 	if err != nil {
 		panic(err)
 	}
 
 	var printObject func(obj *gork.ZObject, depth int)
 	printObject = func(obj *gork.ZObject, depth int) {
-		for {
-
-			for j := 0; j < depth; j++ {
-				fmt.Print(" . ")
-			}
-			fmt.Printf("[%3d] ", obj.Id())
-			fmt.Printf("\"%s\"\n", obj.Name())
-
-			if obj.ChildId() != 0 {
-				childobj, err := gork.NewZObject(mem, obj.ChildId(), header)
-				if err != nil {
-					panic(err)
-				}
-				printObject(childobj, depth+1)
-			}
+		for j := 0; j < depth; j++ {
+			fmt.Print(" . ")
+		}
+		fmt.Printf("[%3d] ", obj.Id())
+		fmt.Printf("\"%s\"\n", obj.Name())
 
-			if obj.SiblingId() == 0 {
-				break
-			}
-			obj, err = gork.NewZObject(mem, obj.SiblingId(), header)
+		for id := obj.ChildId(); id != 0; {
+			child, err := objects.Object(id)
 			if err != nil {
 				panic(err)
 			}
+			printObject(child, depth+1)
+			id = child.SiblingId()
 		}
 	}
 
-	for i := uint8(1); i <= total; i++ {
-		zobj, err := gork.NewZObject(mem, i, header)
-		if err != nil {
-			panic(err)
-		}
-
-		// root
-		if zobj.ParentId() == 0 {
-			printObject(zobj, 0)
-			break
-		}
+	// every object without a parent is the root of a tree
+	for _, root := range objects.Roots() {
+		printObject(root, 0)
 	}
 }
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// lazyFile opens the file for appending at the first write, so that
+// stories that never write to it don't leave empty files around
+type lazyFile struct {
+	path string
+	f    *os.File
+}
+
+func (lf *lazyFile) Write(p []byte) (int, error) {
+	if lf.f == nil {
+		// the directory of an SSH user exists only after the first
+		// save or transcript
+		if err := os.MkdirAll(filepath.Dir(lf.path), 0755); err != nil {
+			return 0, err
+		}
+		f, err := os.OpenFile(lf.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return 0, err
+		}
+		lf.f = f
+	}
+
+	return lf.f.Write(p)
+}
+
+func (lf *lazyFile) Close() error {
+	if lf.f == nil {
+		return nil
+	}
+	return lf.f.Close()
+}
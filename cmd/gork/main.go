@@ -1,10 +1,11 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
 	"os"
 	"path"
 	"strings"
@@ -16,6 +17,18 @@ func main() {
 	identity := flag.String("identity", "", "ssh key to use to start server")
 	addr := flag.String("address", "0.0.0.0:4273", "address to listen on for ssh connections")
 	ws := flag.Bool("ws", false, "start the web socket server on addr")
+	saves := flag.String("saves", ".", "directory where save games are stored, ssh users get their own subdirectory")
+	transcript := flag.String("transcript", "", "file the transcript is appended to when the story turns it on (default story name + .txt)")
+	record := flag.String("record", "", "file the commands typed by the player are appended to")
+	replay := flag.String("replay", "", "file of commands played before the player takes control")
+	script := flag.String("script", "", "run the commands in the file without a terminal and print the transcript")
+	golden := flag.String("golden", "", "compare the transcript of -script with the file, exit non-zero on differences")
+	seed := flag.Int64("seed", 1, "seed of the random numbers of -script")
+	logPath := flag.String("log", "", "file the events of the story are appended to, - is stderr (default nothing is logged)")
+	logFormat := flag.String("log-format", "text", "format of -log, text or json (a JSON object per line)")
+	logLevel := flag.String("log-level", "warn", "least important events logged: debug, info, warn or error")
+	logCategories := flag.String("log-categories", "all", "comma separated events logged: instructions, calls, branches, io, objects or all")
+	compile := flag.Bool("compile", false, "run the story with the compiler engine instead of the interpreter")
 	flag.Parse()
 
 	if len(flag.Args()) < 1 {
@@ -23,63 +36,112 @@ func main() {
 		return
 	}
 
-	story := flag.Args()[0]
+	storyPath := flag.Args()[0]
 
-	buf, err := ioutil.ReadFile(story)
+	buf, err := ioutil.ReadFile(storyPath)
 	if err != nil {
 		panic(err)
 	}
-	mem := gork.NewZMemory(buf)
 
-	header, err := gork.NewZHeader(mem)
+	// the story is shared by all the players, each one gets its own
+	// copy of dynamic memory
+	story, err := gork.NewZStory(buf)
 	if err != nil {
 		panic(err)
 	}
 
-	if *identity != "" {
+	traces, err := newTraceConfig(*logPath, *logFormat, *logLevel, *logCategories)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	engine := gork.ZInterpreter
+	if *compile {
+		engine = gork.ZCompiler
+	}
+
+	if *script != "" {
+		os.Exit(scriptRun(story, engine, traces, *script, *golden, *seed))
+	} else if *identity != "" {
 		server := &SshServer{
-			id_rsa: *identity,
-			story:  story,
-			mem:    mem,
-			header: header,
+			id_rsa:    *identity,
+			storyPath: storyPath,
+			story:     story,
+			saveDir:   *saves,
+			engine:    engine,
+			traces:    traces,
 		}
 		server.run(*addr)
 	} else if *ws {
 		server := &WSServer{
-			story:  story,
-			mem:    mem,
-			header: header,
+			storyPath: storyPath,
+			story:     story,
+			sessions:  make(map[string]*wsSession),
+			engine:    engine,
+			traces:    traces,
 		}
 		server.run(*addr)
 	} else {
-		terminalUI(story, mem, header)
+		if *transcript == "" {
+			*transcript = storyFilename(storyPath, ".txt")
+		}
+		terminalUI(story, engine, traces, gork.NewZFileSaveStore(*saves), *transcript, *record, *replay)
 	}
 }
 
-func terminalUI(story string, mem *gork.ZMemory, header *gork.ZHeader) {
-	logfile, err := os.Create(storyLogFilename(story))
+func terminalUI(story *gork.ZStory, engine gork.ZEngine, traces *traceConfig, saves gork.ZSaveStore, transcript string, record string, replay string) {
+	zm, err := gork.NewZMachine(story, &gork.ZTerminal{}, saves, traces.tracer(""))
 	if err != nil {
 		panic(err)
 	}
-	defer logfile.Close()
+	zm.SetEngine(engine)
+	traces.setup(zm)
 
-	logger := log.New(logfile, "", log.LstdFlags)
+	transcriptFile := &lazyFile{path: transcript}
+	defer transcriptFile.Close()
+	zm.SetTranscript(transcriptFile)
 
-	zm, err := gork.NewZMachine(mem, header, gork.ZTerminal{}, logger)
-	if err != nil {
-		panic(err)
+	if record != "" {
+		recordFile := &lazyFile{path: record}
+		defer recordFile.Close()
+		zm.SetCommandRecord(recordFile)
+		zm.SelectOutputStream(gork.CommandStream, true, 0)
 	}
 
-	if err := zm.InterpretAll(); err != nil {
-		panic(err)
+	if replay != "" {
+		replayFile, err := os.Open(replay)
+		if err != nil {
+			panic(err)
+		}
+		defer replayFile.Close()
+		zm.SetCommandFile(replayFile)
+		zm.SelectInputStream(gork.CommandFileStream)
+	}
+
+	// stdin is over when the player quits with ctrl-d
+	if err := zm.InterpretAll(); err != nil && !errors.Is(err, io.EOF) {
+		fmt.Fprint(os.Stderr, "\n", errorReport(err))
+	}
+}
+
+// errorReport describes why the story stopped, with the call stack of the
+// story if it crashed
+func errorReport(err error) string {
+	var zerr *gork.ZRuntimeError
+	if errors.As(err, &zerr) {
+		return fmt.Sprintf("The story crashed: %s\n%s", zerr, zerr.Backtrace)
 	}
+	return fmt.Sprintf("The story stopped: %s\n", err)
 }
 
-func storyLogFilename(story string) string {
+// storyFilename returns the name of the story without extension followed
+// by ext
+func storyFilename(story string, ext string) string {
 	name := path.Base(story)
 	tmp := strings.Split(name, ".")
 	if len(tmp) > 1 {
 		name = tmp[0]
 	}
-	return name + ".log"
+	return name + ext
 }
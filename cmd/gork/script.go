@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/danieledapo/gork/gork"
+)
+
+// scriptRun plays the commands in script without a terminal. Without a
+// golden file the transcript goes to stdout, otherwise it is compared with
+// the golden one and the first divergent line is reported.
+func scriptRun(story *gork.ZStory, engine gork.ZEngine, traces *traceConfig, script string, golden string, seed int64) int {
+	scriptFile, err := os.Open(script)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	defer scriptFile.Close()
+
+	dev := gork.NewZScriptDev(scriptFile)
+
+	zm, err := gork.NewZMachine(story, dev, gork.NewZMemorySaveStore(), traces.tracer(""))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	zm.SeedRandom(seed)
+	zm.SetEngine(engine)
+	traces.setup(zm)
+
+	if err := gork.RunScript(zm, dev); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	if golden == "" {
+		os.Stdout.Write(dev.Output.Bytes())
+		return 0
+	}
+
+	want, err := ioutil.ReadFile(golden)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	if line, w, g := firstDiff(string(want), dev.Output.String()); line > 0 {
+		fmt.Printf("%s diverges from %s at line %d\n", script, golden, line)
+		fmt.Printf("want: %q\n", w)
+		fmt.Printf(" got: %q\n", g)
+		return 1
+	}
+
+	return 0
+}
+
+// firstDiff compares two transcripts line by line and returns the 1-based
+// number of the first line that differs with both versions of it, or 0 if
+// they are equal
+func firstDiff(want, got string) (int, string, string) {
+	wantLines := strings.Split(want, "\n")
+	gotLines := strings.Split(got, "\n")
+
+	for i := 0; i < len(wantLines) || i < len(gotLines); i++ {
+		if i >= len(wantLines) {
+			return i + 1, "", gotLines[i]
+		}
+		if i >= len(gotLines) {
+			return i + 1, wantLines[i], ""
+		}
+		if wantLines[i] != gotLines[i] {
+			return i + 1, wantLines[i], gotLines[i]
+		}
+	}
+
+	return 0, "", ""
+}
@@ -4,10 +4,10 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
 	"net"
-	"os"
+	"path/filepath"
 
 	"github.com/danieledapo/gork/gork"
 	"golang.org/x/crypto/ssh"
@@ -15,10 +15,12 @@ import (
 )
 
 type SshServer struct {
-	id_rsa string
-	story  string
-	mem    *gork.ZMemory
-	header *gork.ZHeader
+	id_rsa    string
+	storyPath string
+	story     *gork.ZStory
+	saveDir   string
+	engine    gork.ZEngine
+	traces    *traceConfig
 }
 
 func (server *SshServer) run(addr string) {
@@ -86,6 +88,12 @@ func (server *SshServer) handleChannel(user string, newChannel ssh.NewChannel) {
 		return
 	}
 
+	// user names become directory names
+	if err := gork.ValidSaveName(user); err != nil {
+		newChannel.Reject(ssh.Prohibited, fmt.Sprintf("invalid user name: %s", err))
+		return
+	}
+
 	connection, requests, err := newChannel.Accept()
 	if err != nil {
 		fmt.Printf("Could not accept channel (%s)", err)
@@ -93,22 +101,24 @@ func (server *SshServer) handleChannel(user string, newChannel ssh.NewChannel) {
 	}
 	defer connection.Close()
 
-	logfile, err := os.Create(fmt.Sprintf("%s_%s", user, storyLogFilename(server.story)))
-	if err != nil {
-		panic(err)
-	}
-	defer logfile.Close()
-
-	logger := log.New(logfile, "", log.LstdFlags)
-
 	terminal := terminal.NewTerminal(connection, "")
 	zsshterm := &gork.ZSshTerminal{Term: terminal}
 
-	zm, err := gork.NewZMachine(server.mem, server.header, zsshterm, logger)
+	userDir := filepath.Join(server.saveDir, user)
+	saves := gork.NewZFileSaveStore(userDir)
+
+	zm, err := gork.NewZMachine(server.story, zsshterm, saves, server.traces.tracer(user))
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
+	zm.SetEngine(server.engine)
+	server.traces.setup(zm)
+
+	// the files in userDir create it when they are first written
+	transcript := &lazyFile{path: filepath.Join(userDir, storyFilename(server.storyPath, ".txt"))}
+	defer transcript.Close()
+	zm.SetTranscript(transcript)
 
 	go func() {
 		for req := range requests {
@@ -120,20 +130,19 @@ func (server *SshServer) handleChannel(user string, newChannel ssh.NewChannel) {
 			case "pty-req":
 				termLen := req.Payload[3]
 				w, h := parseDims(req.Payload[termLen+4:])
-				terminal.SetSize(w, h)
+				zsshterm.SetSize(w, h)
 			case "window-change":
 				w, h := parseDims(req.Payload)
-				terminal.SetSize(w, h)
+				zsshterm.SetSize(w, h)
 			}
 		}
 	}()
 
-	defer func() {
-		recover()
-	}()
-
-	zm.InterpretAll()
-
+	// the player closing the connection is not an error
+	if err := zm.InterpretAll(); err != nil && !errors.Is(err, io.EOF) {
+		fmt.Printf("%s: %s", user, errorReport(err))
+		zsshterm.Print("\n" + errorReport(err))
+	}
 }
 
 func parseDims(b []byte) (int, int) {
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/danieledapo/gork/gork"
+)
+
+// traceConfig is where the machines send their events, it's built from
+// the -log flags and shared by all the players
+type traceConfig struct {
+	// nil when nothing is logged, it's shared by the tracers of all the
+	// players
+	w          io.Writer
+	json       bool
+	level      gork.ZTraceLevel
+	categories gork.ZTraceCategory
+}
+
+// newTraceConfig opens the log file, path "-" is stderr and "" logs
+// nothing
+func newTraceConfig(path string, format string, level string, categories string) (*traceConfig, error) {
+	config := &traceConfig{}
+
+	var err error
+	if config.level, err = gork.ParseZTraceLevel(level); err != nil {
+		return nil, err
+	}
+	if config.categories, err = gork.ParseZTraceCategories(categories); err != nil {
+		return nil, err
+	}
+
+	switch format {
+	case "text":
+	case "json":
+		config.json = true
+	default:
+		return nil, fmt.Errorf("unknown log format %q", format)
+	}
+
+	switch path {
+	case "":
+	case "-":
+		config.w = &syncWriter{w: os.Stderr}
+	default:
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, err
+		}
+		config.w = &syncWriter{w: f}
+	}
+
+	return config, nil
+}
+
+// tracer returns the tracer of a player, session tells the players apart
+// in the log
+func (config *traceConfig) tracer(session string) gork.ZTracer {
+	switch {
+	case config.w == nil:
+		return nil
+	case config.json:
+		return gork.NewZJSONTracer(config.w, session)
+	case session != "":
+		return gork.NewZTextTracer(config.w, session+" ")
+	default:
+		return gork.NewZTextTracer(config.w, "")
+	}
+}
+
+// syncWriter serialises the writes of the tracers of the players, a
+// tracer writes a whole line at a time so lines are never mixed
+type syncWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (sw *syncWriter) Write(b []byte) (int, error) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	return sw.w.Write(b)
+}
+
+// setup selects the events logged for a machine
+func (config *traceConfig) setup(zm *gork.ZMachine) {
+	zm.SetTracing(config.level, config.categories)
+}
@@ -1,19 +1,99 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
-	"log"
 	"net/http"
-	"os"
+	"sync"
+	"time"
 
 	"github.com/danieledapo/gork/gork"
 	"github.com/gorilla/websocket"
 )
 
+// sessions are dropped after this long without a connection, and the
+// least recently used one when there are too many
+const (
+	sessionTTL  = 24 * time.Hour
+	maxSessions = 1000
+)
+
 type WSServer struct {
-	story  string
-	mem    *gork.ZMemory
-	header *gork.ZHeader
+	storyPath string
+	story     *gork.ZStory
+	engine    gork.ZEngine
+	traces    *traceConfig
+
+	// save slots of every session by the token the server gave to the
+	// client, the client reconnects with the session query parameter
+	sessionsMu sync.Mutex
+	sessions   map[string]*wsSession
+}
+
+type wsSession struct {
+	saves    *gork.ZMemorySaveStore
+	lastUsed time.Time
+}
+
+// session returns the session of token, a new one with a fresh token if the
+// server didn't give it or it expired, so that a client can't pick the
+// saves of another one
+func (server *WSServer) session(token string) (string, *wsSession, error) {
+	server.sessionsMu.Lock()
+	defer server.sessionsMu.Unlock()
+
+	now := time.Now()
+	server.expireSessions(now)
+
+	session, ok := server.sessions[token]
+	if !ok {
+		var err error
+		if token, err = newSessionToken(); err != nil {
+			return "", nil, err
+		}
+		session = &wsSession{saves: gork.NewZMemorySaveStore()}
+		server.sessions[token] = session
+	}
+	session.lastUsed = now
+	return token, session, nil
+}
+
+// release marks the end of a connection, the session expires from now
+func (server *WSServer) release(session *wsSession) {
+	server.sessionsMu.Lock()
+	defer server.sessionsMu.Unlock()
+
+	session.lastUsed = time.Now()
+}
+
+// expireSessions drops the old sessions and makes room for a new one,
+// sessionsMu must be held
+func (server *WSServer) expireSessions(now time.Time) {
+	for token, session := range server.sessions {
+		if now.Sub(session.lastUsed) > sessionTTL {
+			delete(server.sessions, token)
+		}
+	}
+
+	for len(server.sessions) >= maxSessions {
+		oldest := ""
+		for token, session := range server.sessions {
+			if oldest == "" || session.lastUsed.Before(server.sessions[oldest].lastUsed) {
+				oldest = token
+			}
+		}
+		delete(server.sessions, oldest)
+	}
+}
+
+func newSessionToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
 }
 
 func (server *WSServer) run(addr string) {
@@ -29,21 +109,30 @@ func (server *WSServer) run(addr string) {
 		}
 
 		remoteAddr := conn.RemoteAddr().String()
-		logFilename := storyLogFilename(server.story)
-		logfile, err := os.Create(fmt.Sprintf("wsserver_%s_%s", remoteAddr, logFilename))
-		if err != nil {
-			panic(err)
-		}
-		defer logfile.Close()
-		logger := log.New(logfile, "", log.LstdFlags)
 
 		wsdev := &gork.ZWSDev{Conn: conn}
 
-		zm, err := gork.NewZMachine(server.mem, server.header, wsdev, logger)
+		token, session, err := server.session(r.URL.Query().Get("session"))
+		if err != nil {
+			fmt.Printf("%s: %s\n", remoteAddr, err)
+			conn.Close()
+			return
+		}
+		defer server.release(session)
+		wsdev.SendSession(token)
+
+		zm, err := gork.NewZMachine(server.story, wsdev, session.saves, server.traces.tracer(remoteAddr))
 		if err != nil {
 			panic(err)
 		}
-		zm.InterpretAll()
+		zm.SetEngine(server.engine)
+		server.traces.setup(zm)
+		// the client closing the socket is not an error
+		var closed *websocket.CloseError
+		if err := zm.InterpretAll(); err != nil && !errors.As(err, &closed) {
+			fmt.Printf("%s: %s", remoteAddr, errorReport(err))
+			wsdev.Print("\n" + errorReport(err))
+		}
 	}
 
 	http.HandleFunc("/play", wsHandler)
@@ -0,0 +1,364 @@
+package gork
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Quetzal is the standard portable save file format shared by most
+// interpreters, it's an IFF file of type IFZS.
+// http://inform-fiction.org/zmachine/standards/quetzal/index.html
+
+const (
+	iffForm       = "FORM"
+	quetzalType   = "IFZS"
+	ifhdChunk     = "IFhd"
+	cmemChunk     = "CMem"
+	umemChunk     = "UMem"
+	stksChunk     = "Stks"
+	ifhdChunkSize = 13
+
+	// gork's own chunk, the other interpreters skip it: the address of the
+	// routine of every frame of Stks, which Stks doesn't have, followed by
+	// flags
+	framesChunk     = "GkFr"
+	framesEntrySize = 4
+	framesInterrupt = byte(0x01)
+
+	// bit of the locals byte of the frames whose result is discarded
+	stksDiscardFlag = byte(0x10)
+)
+
+// the state of a ZMachine extracted from a save file
+type zquetzalState struct {
+	release  uint16
+	serial   [SerialSize]byte
+	checksum uint16
+	pc       uint32
+	dynMem   []byte
+	stack    ZStack
+}
+
+// SaveQuetzal writes the current state of the machine in Quetzal format,
+// pc is the address execution resumes from after a restore, for v3 it's
+// the address of the branch data of the save instruction.
+func (zm *ZMachine) SaveQuetzal(w io.Writer, pc uint32) error {
+	ifhd := make([]byte, ifhdChunkSize)
+	binary.BigEndian.PutUint16(ifhd[0:], zm.header.release)
+	copy(ifhd[2:], zm.header.serial[:])
+	binary.BigEndian.PutUint16(ifhd[8:], zm.header.fileChecksum)
+	putUint24(ifhd[10:], pc)
+
+	stks, err := zm.encodeStks()
+	if err != nil {
+		return err
+	}
+
+	body := &bytes.Buffer{}
+	body.WriteString(quetzalType)
+	writeIffChunk(body, ifhdChunk, ifhd)
+	writeIffChunk(body, cmemChunk, compressDynMem(zm.dynMem(), zm.story.dynMem()))
+	writeIffChunk(body, stksChunk, stks)
+	writeIffChunk(body, framesChunk, zm.encodeFrames())
+
+	form := &bytes.Buffer{}
+	form.WriteString(iffForm)
+	binary.Write(form, binary.BigEndian, uint32(body.Len()))
+	body.WriteTo(form)
+
+	_, err = form.WriteTo(w)
+	return err
+}
+
+// RestoreQuetzal replaces the state of the machine with the one stored in
+// the given Quetzal file. The machine is left untouched if the file is
+// invalid or it has been saved by a different story.
+func (zm *ZMachine) RestoreQuetzal(r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	state, err := zm.decodeQuetzal(data)
+	if err != nil {
+		return err
+	}
+
+	if state.release != zm.header.release ||
+		state.serial != zm.header.serial ||
+		state.checksum != zm.header.fileChecksum {
+		return errors.New("save file belongs to a different story")
+	}
+
+	zm.stack = state.stack
+	zm.seq.pos = state.pc
+
+	return zm.replaceDynMem(state.dynMem)
+}
+
+func (zm *ZMachine) decodeQuetzal(data []byte) (*zquetzalState, error) {
+	if len(data) < 12 || string(data[0:4]) != iffForm || string(data[8:12]) != quetzalType {
+		return nil, errors.New("not a Quetzal save file")
+	}
+
+	formLen := int(binary.BigEndian.Uint32(data[4:]))
+	if formLen+8 > len(data) || formLen < 4 {
+		return nil, errors.New("truncated Quetzal save file")
+	}
+	data = data[12 : formLen+8]
+
+	state := &zquetzalState{}
+	seenIfhd := false
+	var frames []byte
+
+	for len(data) >= 8 {
+		id := string(data[0:4])
+		size := int(binary.BigEndian.Uint32(data[4:]))
+		data = data[8:]
+
+		if size > len(data) {
+			return nil, fmt.Errorf("truncated %s chunk", id)
+		}
+		chunk := data[:size]
+
+		// chunks are padded to an even length
+		if size%2 == 1 && size < len(data) {
+			size++
+		}
+		data = data[size:]
+
+		var err error
+		switch id {
+		case ifhdChunk:
+			if len(chunk) < ifhdChunkSize {
+				return nil, errors.New("IFhd chunk is too short")
+			}
+			seenIfhd = true
+			state.release = binary.BigEndian.Uint16(chunk[0:])
+			copy(state.serial[:], chunk[2:8])
+			state.checksum = binary.BigEndian.Uint16(chunk[8:])
+			state.pc = uint24(chunk[10:])
+		case cmemChunk:
+			state.dynMem, err = decompressDynMem(chunk, zm.story.dynMem())
+		case umemChunk:
+			if len(chunk) != len(zm.story.dynMem()) {
+				return nil, errors.New("UMem chunk size does not match dynamic memory size")
+			}
+			state.dynMem = append([]byte{}, chunk...)
+		case stksChunk:
+			state.stack, err = zm.decodeStks(chunk)
+		case framesChunk:
+			frames = chunk
+		}
+		// other chunks (e.g. ANNO, AUTH) are not interesting
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if !seenIfhd || state.dynMem == nil || state.stack == nil {
+		return nil, errors.New("Quetzal save file misses a mandatory chunk")
+	}
+
+	// the save of another interpreter leaves the routines unknown
+	if len(frames) == len(state.stack)*framesEntrySize {
+		decodeFrames(frames, state.stack)
+	}
+
+	return state, nil
+}
+
+func (zm *ZMachine) encodeStks() ([]byte, error) {
+	buf := &bytes.Buffer{}
+
+	for i, routine := range zm.stack {
+		if len(routine.stack) > 0xFFFF {
+			return nil, errors.New("evaluation stack too big to be saved")
+		}
+
+		frame := make([]byte, 8)
+
+		// v3 the first frame is a dummy one that only holds the evaluation
+		// stack of the main routine
+		if i > 0 {
+			putUint24(frame[0:], routine.retAddr)
+			frame[3] = byte(len(routine.locals))
+			if routine.discard {
+				// calls discarding the result have no store variable
+				frame[3] |= stksDiscardFlag
+			} else {
+				frame[4] = routine.store
+			}
+			frame[5] = byte(1<<routine.nargs - 1)
+		}
+		binary.BigEndian.PutUint16(frame[6:], uint16(len(routine.stack)))
+		buf.Write(frame)
+
+		for _, v := range routine.locals {
+			binary.Write(buf, binary.BigEndian, v)
+		}
+		for _, v := range routine.stack {
+			binary.Write(buf, binary.BigEndian, v)
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+// encodeFrames writes what the Stks chunk misses about the frames
+func (zm *ZMachine) encodeFrames() []byte {
+	frames := make([]byte, len(zm.stack)*framesEntrySize)
+	for i, routine := range zm.stack {
+		entry := frames[i*framesEntrySize:]
+		putUint24(entry, routine.addr)
+		if routine.interrupt {
+			entry[3] |= framesInterrupt
+		}
+	}
+	return frames
+}
+
+func decodeFrames(frames []byte, stack ZStack) {
+	for i, routine := range stack {
+		entry := frames[i*framesEntrySize:]
+		routine.addr = uint24(entry)
+		routine.interrupt = entry[3]&framesInterrupt != 0
+	}
+}
+
+func (zm *ZMachine) decodeStks(data []byte) (ZStack, error) {
+	stack := ZStack{}
+
+	for len(data) > 0 {
+		if len(data) < 8 {
+			return nil, errors.New("truncated stack frame")
+		}
+
+		nlocals := int(data[3] & 0x0F)
+		nwords := nlocals + int(binary.BigEndian.Uint16(data[6:]))
+
+		routine := &ZRoutine{
+			locals: make([]uint16, nlocals),
+			stack:  make([]uint16, nwords-nlocals),
+		}
+
+		if len(stack) == 0 {
+			// dummy frame of the main routine
+			routine.addr = uint32(zm.header.pc)
+		} else {
+			routine.retAddr = uint24(data[0:])
+			if data[3]&stksDiscardFlag != 0 {
+				routine.discard = true
+			} else {
+				routine.store = data[4]
+			}
+
+			args := data[5]
+			for args&0x01 != 0 {
+				routine.nargs++
+				args >>= 1
+			}
+		}
+		data = data[8:]
+
+		if len(data) < nwords*2 {
+			return nil, errors.New("truncated stack frame")
+		}
+		for i := range routine.locals {
+			routine.locals[i] = binary.BigEndian.Uint16(data[i*2:])
+		}
+		for i := range routine.stack {
+			routine.stack[i] = binary.BigEndian.Uint16(data[(nlocals+i)*2:])
+		}
+		data = data[nwords*2:]
+
+		stack.Push(routine)
+	}
+
+	if len(stack) == 0 {
+		return nil, errors.New("empty stack in save file")
+	}
+
+	return stack, nil
+}
+
+// compressDynMem encodes the xor between the current dynamic memory and the
+// original one: zero bytes are written as a 0 followed by the length of
+// the run minus 1, trailing zeros are omitted.
+func compressDynMem(cur []byte, orig []byte) []byte {
+	ret := []byte{}
+
+	end := len(cur)
+	for end > 0 && cur[end-1] == orig[end-1] {
+		end--
+	}
+
+	for i := 0; i < end; {
+		if b := cur[i] ^ orig[i]; b != 0 {
+			ret = append(ret, b)
+			i++
+			continue
+		}
+
+		run := 0
+		for run < 0x100 && cur[i+run] == orig[i+run] {
+			run++
+		}
+
+		ret = append(ret, 0, byte(run-1))
+		i += run
+	}
+
+	return ret
+}
+
+func decompressDynMem(data []byte, orig []byte) ([]byte, error) {
+	ret := append([]byte{}, orig...)
+
+	i := 0
+	for j := 0; j < len(data); j++ {
+		if data[j] != 0 {
+			if i >= len(ret) {
+				return nil, errors.New("CMem chunk exceeds dynamic memory size")
+			}
+			ret[i] ^= data[j]
+			i++
+			continue
+		}
+
+		j++
+		if j >= len(data) {
+			return nil, errors.New("truncated CMem chunk")
+		}
+		i += int(data[j]) + 1
+	}
+
+	if i > len(ret) {
+		return nil, errors.New("CMem chunk exceeds dynamic memory size")
+	}
+
+	return ret, nil
+}
+
+func writeIffChunk(w *bytes.Buffer, id string, data []byte) {
+	w.WriteString(id)
+	binary.Write(w, binary.BigEndian, uint32(len(data)))
+	w.Write(data)
+	if len(data)%2 == 1 {
+		w.WriteByte(0)
+	}
+}
+
+func putUint24(b []byte, v uint32) {
+	b[0] = byte(v >> 16)
+	b[1] = byte(v >> 8)
+	b[2] = byte(v)
+}
+
+func uint24(b []byte) uint32 {
+	return uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2])
+}
@@ -0,0 +1,198 @@
+package gork
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestCompressDynMem(t *testing.T) {
+	orig := make([]byte, 1000)
+	for i := range orig {
+		orig[i] = byte(i)
+	}
+
+	cur := append([]byte{}, orig...)
+	cur[0] = 42
+	cur[600] = 73
+	cur[601] = 0
+
+	compressed := compressDynMem(cur, orig)
+
+	// 1 changed byte, 599 unchanged ones split in runs of at most 256,
+	// 2 changed bytes and the trailing unchanged ones are omitted
+	expected := []byte{42, 0, 0xFF, 0, 0xFF, 0, 0x56, 73 ^ 88, 601 % 256}
+	if !bytes.Equal(compressed, expected) {
+		t.Errorf("compressed %v, expected %v", compressed, expected)
+	}
+
+	decompressed, err := decompressDynMem(compressed, orig)
+	if err != nil || !bytes.Equal(decompressed, cur) {
+		t.Fail()
+	}
+
+	if _, err := decompressDynMem([]byte{0, 0xFF, 0, 0xFF, 0, 0xFF, 0, 0xFF, 1}, orig); err == nil {
+		t.Error("overflowing CMem must fail")
+	}
+}
+
+func TestQuetzalRoundTrip(t *testing.T) {
+	// @call 0x184 -> sp, the caller goes on from testPC+5
+	zm, _ := newTestMachine(t, newTestStory(0xE0, 0x3F, 0x01, 0x84, 0x00))
+
+	zm.StoreVarAt(0x10, 0x1234)
+	zm.StoreVarAt(0, 42)
+	zm.stack.Push(&ZRoutine{
+		addr:    0x308,
+		retAddr: testPC + 5,
+		locals:  []uint16{1, 2, 3},
+		stack:   []uint16{7, 8},
+		store:   0x12,
+		nargs:   2,
+	})
+	// the result of call_vn has no store variable
+	zm.stack.Push(&ZRoutine{
+		addr:    0x308,
+		retAddr: 0x30C,
+		locals:  []uint16{},
+		discard: true,
+	})
+	// an interrupt routine has neither
+	zm.stack.Push(&ZRoutine{
+		addr:      0x320,
+		retAddr:   0x30C,
+		locals:    []uint16{},
+		interrupt: true,
+	})
+
+	saved := &bytes.Buffer{}
+	if err := zm.SaveQuetzal(saved, 0x30A); err != nil {
+		t.Fatal(err)
+	}
+	expectedStack := zm.stack
+	expectedFrames := fmt.Sprint(zm.Frames())
+
+	zm.StoreVarAt(0x10, 0)
+	zm.StoreVarAt(0x11, 0xFFFF)
+	zm.stack = ZStack{MainRoutine(zm.seq.mem, zm.header)}
+	zm.seq.pos = testPC
+
+	if err := zm.RestoreQuetzal(bytes.NewReader(saved.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+
+	if zm.seq.pos != 0x30A || zm.GetVarAt(0x10) != 0x1234 || zm.GetVarAt(0x11) != 0 {
+		t.Fail()
+	}
+
+	if len(zm.stack) != len(expectedStack) {
+		t.Fatalf("restored %d frames, expected %d", len(zm.stack), len(expectedStack))
+	}
+	for i, routine := range zm.stack {
+		expected := expectedStack[i]
+		if routine.retAddr != expected.retAddr ||
+			routine.store != expected.store ||
+			routine.nargs != expected.nargs ||
+			routine.discard != expected.discard ||
+			routine.addr != expected.addr ||
+			routine.interrupt != expected.interrupt ||
+			fmt.Sprint(routine.locals, routine.stack) != fmt.Sprint(expected.locals, expected.stack) {
+			t.Errorf("frame %d restored as %v, expected %v", i, routine, expected)
+		}
+	}
+
+	if frames := fmt.Sprint(zm.Frames()); frames != expectedFrames {
+		t.Errorf("restored frames %s, expected %s", frames, expectedFrames)
+	}
+	if zm.Frames()[1].Routine != 0x308 {
+		t.Errorf("unexpected routine %X", zm.Frames()[1].Routine)
+	}
+}
+
+func TestQuetzalRestoreDifferentStory(t *testing.T) {
+	zm, _ := newTestMachine(t, newTestStory())
+
+	saved := &bytes.Buffer{}
+	if err := zm.SaveQuetzal(saved, testPC); err != nil {
+		t.Fatal(err)
+	}
+
+	story := newTestStory()
+	story[0x03] = 2 // different release
+	other, _ := newTestMachine(t, story)
+	other.StoreVarAt(0x10, 42)
+
+	if err := other.RestoreQuetzal(saved); err == nil {
+		t.Error("restoring a save of a different story must fail")
+	}
+
+	if other.GetVarAt(0x10) != 42 {
+		t.Error("failed restore must not change the machine")
+	}
+
+	if err := other.RestoreQuetzal(bytes.NewReader([]byte("FORM\x00\x00\x00\x04IFRS"))); err == nil {
+		t.Error("restoring a non Quetzal file must fail")
+	}
+}
+
+func TestZSaveRestore(t *testing.T) {
+	// @save ?label, @restore ?label with a long branch offset
+	zm, dev := newTestMachine(t, newTestStory(0xB5, 0x80, 0x10, 0xB6, 0x80, 0x10))
+
+	dev.input = []string{"test", "test"}
+
+	zm.StoreVarAt(0x10, 73)
+	if err := zm.Interpret(); err != nil {
+		t.Fatal(err)
+	}
+
+	// branch taken on success
+	if zm.seq.pos != testPC+3+0x10-2 {
+		t.Errorf("save did not branch, PC %X", zm.seq.pos)
+	}
+
+	zm.StoreVarAt(0x10, 0)
+	zm.seq.pos = testPC + 3
+	if err := zm.Interpret(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the restored game continues from the branch of the save
+	if zm.seq.pos != testPC+3+0x10-2 || zm.GetVarAt(0x10) != 73 {
+		t.Errorf("restore did not resume from save, PC %X", zm.seq.pos)
+	}
+
+	if names, _ := zm.saves.List(); len(names) != 1 || names[0] != "test" {
+		t.Errorf("unexpected saves %v", names)
+	}
+
+	// restoring a missing save continues with the next instruction
+	dev.input = []string{"missing"}
+	zm.seq.pos = testPC + 3
+	if err := zm.Interpret(); err != nil {
+		t.Fatal(err)
+	}
+	if zm.seq.pos != testPC+6 {
+		t.Errorf("failed restore branched, PC %X", zm.seq.pos)
+	}
+
+	if !strings.Contains(dev.output, "Saved games: test (delete NAME removes one)\n") {
+		t.Errorf("existing saves not shown to the player: %q", dev.output)
+	}
+
+	// the player can delete saves before choosing the name
+	dev.input = []string{"delete test", "delete missing", "other"}
+	dev.output = ""
+	zm.seq.pos = testPC
+	if err := zm.Interpret(); err != nil {
+		t.Fatal(err)
+	}
+	if names, _ := zm.saves.List(); len(names) != 1 || names[0] != "other" {
+		t.Errorf("unexpected saves %v", names)
+	}
+	if !strings.Contains(dev.output, "Deleted test\n") ||
+		!strings.Contains(dev.output, "Cannot delete missing: save not found\n") {
+		t.Errorf("deletions not reported to the player: %q", dev.output)
+	}
+}
@@ -1,5 +1,10 @@
 package gork
 
+import (
+	"bytes"
+	"container/heap"
+)
+
 // v3 3 tables * 32 entries each
 const abbrCount = 32 * 3
 
@@ -16,3 +21,136 @@ func GetAbbreviations(mem *ZMemory, header *ZHeader) []string {
 
 	return ret
 }
+
+// the longest abbreviation OptimiseAbbreviations looks for, longer ones
+// rarely repeat
+const maxAbbrLen = 20
+
+// ZStringsSize returns how many bytes the Z-strings of corpus take when
+// encoded with abbreviations, counting the abbreviation strings too but
+// not the table pointing to them
+func ZStringsSize(corpus []string, header *ZHeader, abbreviations []string) int {
+	size := 0
+
+	enc := NewZStringEncoder(header, abbreviations)
+	for _, s := range corpus {
+		size += len(enc.Encode(s)) * 2
+	}
+
+	// abbreviations can't use other abbreviations, the ones with the
+	// same text can share the string
+	plain := NewZStringEncoder(header, nil)
+	seen := map[string]bool{}
+	for _, abbr := range abbreviations {
+		if !seen[abbr] {
+			seen[abbr] = true
+			size += len(plain.Encode(abbr)) * 2
+		}
+	}
+
+	return size
+}
+
+// zabbrCandidate is a string that may become an abbreviation, savings is
+// how many Z-characters it saved the last time it was counted
+type zabbrCandidate struct {
+	text    []byte
+	savings int
+}
+
+type zabbrHeap []*zabbrCandidate
+
+func (h zabbrHeap) Len() int { return len(h) }
+func (h zabbrHeap) Less(i, j int) bool {
+	// ties are broken by the text so that the result doesn't depend on
+	// the order of the candidates
+	if h[i].savings != h[j].savings {
+		return h[i].savings > h[j].savings
+	}
+	return bytes.Compare(h[i].text, h[j].text) < 0
+}
+func (h zabbrHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *zabbrHeap) Push(x interface{}) { *h = append(*h, x.(*zabbrCandidate)) }
+func (h *zabbrHeap) Pop() interface{} {
+	old := *h
+	ret := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return ret
+}
+
+// OptimiseAbbreviations picks the abbreviations that make the Z-strings of
+// corpus shortest, at most abbrCount of them. It's greedy: the abbreviation
+// saving the most Z-characters is picked, its occurrences are removed
+// from the corpus and the savings of the others are counted again. The
+// result is near-optimal, not optimal.
+func OptimiseAbbreviations(corpus []string, header *ZHeader) []string {
+	enc := NewZStringEncoder(header, nil)
+
+	text := make([][]byte, len(corpus))
+	for i, s := range corpus {
+		text[i] = header.zsciiText(s)
+	}
+
+	// savings returns the Z-characters saved by abbr minus the ones of its
+	// own string, occurrences are counted without overlapping
+	savings := func(abbr []byte) int {
+		count := 0
+		for _, s := range text {
+			count += bytes.Count(s, abbr)
+		}
+
+		zchars := enc.zchars(abbr, false)
+		return count*(len(zchars)-2) - len(packZchars(zchars, 0))*3
+	}
+
+	// every substring that appears at least twice is a candidate, the
+	// first count may include overlapping occurrences
+	counts := map[string]int{}
+	for _, s := range text {
+		for i := range s {
+			for j := i + 2; j <= len(s) && j-i <= maxAbbrLen; j++ {
+				counts[string(s[i:j])]++
+			}
+		}
+	}
+
+	candidates := &zabbrHeap{}
+	for abbr, count := range counts {
+		if count < 2 {
+			continue
+		}
+
+		zchars := enc.zchars([]byte(abbr), false)
+		if s := count*(len(zchars)-2) - len(packZchars(zchars, 0))*3; s > 0 {
+			*candidates = append(*candidates, &zabbrCandidate{text: []byte(abbr), savings: s})
+		}
+	}
+	heap.Init(candidates)
+
+	ret := []string{}
+	for len(ret) < abbrCount && candidates.Len() > 0 {
+		best := heap.Pop(candidates).(*zabbrCandidate)
+
+		// savings only decrease as abbreviations are picked, so the
+		// candidate is the best one if it still beats the next one
+		best.savings = savings(best.text)
+		if best.savings <= 0 {
+			continue
+		}
+		if candidates.Len() > 0 && best.savings < (*candidates)[0].savings {
+			heap.Push(candidates, best)
+			continue
+		}
+
+		ret = append(ret, header.zsciiString(best.text))
+
+		// the occurrences are gone, 0 is never in the text so nothing
+		// can match across them
+		hole := make([]byte, len(best.text))
+		for i, s := range text {
+			text[i] = bytes.ReplaceAll(s, best.text, hole)
+		}
+	}
+
+	return ret
+}
@@ -1,6 +1,9 @@
 package gork
 
-import "testing"
+import (
+	"reflect"
+	"testing"
+)
 
 var abbrsBuffer [][]byte = [][]byte{
 	[]byte{0x7E, 0x97, 0xC0, 0xA5},
@@ -38,8 +41,7 @@ func createMemory() *ZMemory {
 		ret = append(ret, abbr...)
 	}
 
-	tmp := ZMemory(ret)
-	return &tmp
+	return NewZMemory(ret)
 }
 
 func TestGetAbbreviations(t *testing.T) {
@@ -52,3 +54,35 @@ func TestGetAbbreviations(t *testing.T) {
 		}
 	}
 }
+
+func TestOptimiseAbbreviations(t *testing.T) {
+	header := &ZHeader{version: 3}
+	corpus := []string{
+		"You are standing in an open field west of a white house.",
+		"You are in the kitchen of the white house.",
+		"You are in the living room. There is a doorway to the east.",
+		"The door is closed.",
+		"The window is slightly ajar.",
+		"Zork",
+	}
+
+	abbrs := OptimiseAbbreviations(corpus, header)
+	if len(abbrs) == 0 || len(abbrs) > abbrCount {
+		t.Fatalf("unexpected abbreviations %q", abbrs)
+	}
+
+	plain := ZStringsSize(corpus, header, nil)
+	optimised := ZStringsSize(corpus, header, abbrs)
+	if optimised >= plain {
+		t.Errorf("abbreviations %q take %d bytes, %d without them", abbrs, optimised, plain)
+	}
+
+	// the abbreviations that don't save anything are worse
+	if worse := ZStringsSize(corpus, header, []string{"Zork", "closed"}); worse <= plain {
+		t.Errorf("useless abbreviations saved %d bytes", plain-worse)
+	}
+
+	if again := OptimiseAbbreviations(corpus, header); !reflect.DeepEqual(again, abbrs) {
+		t.Errorf("optimisation not deterministic %q %q", abbrs, again)
+	}
+}
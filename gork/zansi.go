@@ -0,0 +1,224 @@
+package gork
+
+import "fmt"
+
+// ansiScreen keeps track of the layout of a VT100 screen and produces the
+// escape sequences to draw on it. From top to bottom the screen has:
+// the status line, the upper window and the lower window. Only the lower
+// window scrolls, the cursor position of the lower window is kept in the
+// terminal saved cursor while the upper window is selected.
+type ansiScreen struct {
+	width  int
+	height int
+
+	started    bool
+	status     bool
+	upperLines int
+	window     int
+
+	// cursor of the upper window, 0-based and relative to the window
+	upperRow int
+	upperCol int
+}
+
+func (screen *ansiScreen) upperTop() int {
+	if screen.status {
+		return 2
+	}
+	return 1
+}
+
+func (screen *ansiScreen) lowerTop() int {
+	return screen.upperTop() + screen.upperLines
+}
+
+func (screen *ansiScreen) scrollRegion() string {
+	return fmt.Sprintf("\x1b[%d;%dr", screen.lowerTop(), screen.height)
+}
+
+func (screen *ansiScreen) upperCursor() string {
+	return fmt.Sprintf("\x1b[%d;%dH", screen.upperTop()+screen.upperRow, screen.upperCol+1)
+}
+
+// draw wraps the escape sequences that change the layout of the screen,
+// setting the scrolling region moves the cursor so it must be put back
+func (screen *ansiScreen) draw(seq string) string {
+	seq = screen.scrollRegion() + seq
+
+	if !screen.started {
+		// the first time the lower window starts from the bottom line
+		screen.started = true
+		if screen.window == 1 {
+			return seq + fmt.Sprintf("\x1b[%d;1H\x1b7", screen.height) + screen.upperCursor()
+		}
+		return seq + fmt.Sprintf("\x1b[%d;1H", screen.height)
+	}
+
+	if screen.window == 1 {
+		return seq + screen.upperCursor()
+	}
+	return "\x1b7" + seq + "\x1b8"
+}
+
+func (screen *ansiScreen) SetSize(width, height int) string {
+	screen.width, screen.height = width, height
+
+	if !screen.started {
+		return ""
+	}
+	return screen.draw("")
+}
+
+func (screen *ansiScreen) ShowStatus(status *ZStatus) string {
+	if !screen.status {
+		// the windows move down to make room for the status line
+		screen.status = true
+		screen.clampUpper()
+	}
+
+	return screen.draw(fmt.Sprintf("\x1b[1;1H\x1b[7m%s\x1b[0m", status.Line(screen.width)))
+}
+
+// clampUpper makes sure the lower window has at least a line
+func (screen *ansiScreen) clampUpper() {
+	if max := screen.height - screen.upperTop(); screen.upperLines > max {
+		screen.upperLines = max
+	}
+	if screen.upperLines < 0 {
+		screen.upperLines = 0
+	}
+}
+
+func (screen *ansiScreen) SplitWindow(lines int) string {
+	screen.upperLines = lines
+	screen.clampUpper()
+
+	// the cursor must stay inside the upper window
+	if screen.upperRow >= screen.upperLines {
+		screen.upperRow, screen.upperCol = 0, 0
+	}
+
+	return screen.draw("")
+}
+
+func (screen *ansiScreen) clearLines(from, to int) string {
+	clear := ""
+	for line := from; line <= to; line++ {
+		clear += fmt.Sprintf("\x1b[%d;1H\x1b[2K", line)
+	}
+	return clear
+}
+
+// lowerHome moves the cursor of the lower window to its bottom left corner
+func (screen *ansiScreen) lowerHome() string {
+	home := fmt.Sprintf("\x1b[%d;1H", screen.height)
+	if screen.window == 1 {
+		// the cursor of the lower window is the saved one
+		return home + "\x1b7" + screen.upperCursor()
+	}
+	return home
+}
+
+func (screen *ansiScreen) EraseWindow(window int) string {
+	clear := ""
+
+	if window != 0 {
+		clear += screen.clearLines(screen.upperTop(), screen.lowerTop()-1)
+		screen.upperRow, screen.upperCol = 0, 0
+	}
+	if window != 1 {
+		clear += screen.clearLines(screen.lowerTop(), screen.height)
+	}
+
+	seq := screen.draw(clear)
+	if window != 1 {
+		seq += screen.lowerHome()
+	}
+	return seq
+}
+
+func (screen *ansiScreen) SetCursor(line, column int) string {
+	if screen.window != 1 {
+		return ""
+	}
+
+	screen.upperRow, screen.upperCol = line-1, column-1
+	return screen.upperCursor()
+}
+
+// TextStyle returns the SGR sequence of style, italic is underlined as
+// many terminals can't display it
+func (screen *ansiScreen) TextStyle(style int) string {
+	seq := "\x1b[0"
+	if style&StyleReverse != 0 {
+		seq += ";7"
+	}
+	if style&StyleBold != 0 {
+		seq += ";1"
+	}
+	if style&StyleItalic != 0 {
+		seq += ";4"
+	}
+	return seq + "m"
+}
+
+// Colour returns the SGR sequence of the Colour constants foreground and
+// background, ColourCurrent leaves the colour as it is
+func (screen *ansiScreen) Colour(foreground, background int) string {
+	seq := ""
+	if c := ansiColour(foreground); c >= 0 {
+		seq += fmt.Sprintf(";%d", 30+c)
+	}
+	if c := ansiColour(background); c >= 0 {
+		seq += fmt.Sprintf(";%d", 40+c)
+	}
+	if seq == "" {
+		return ""
+	}
+	return "\x1b[" + seq[1:] + "m"
+}
+
+// ansiColour maps a Colour constant to the offset of its SGR parameter, 9
+// selects the default colour, -1 means no change
+func ansiColour(colour int) int {
+	switch {
+	case colour == ColourDefault:
+		return 9
+	case colour >= ColourBlack && colour <= ColourWhite:
+		return colour - ColourBlack
+	}
+	return -1
+}
+
+func (screen *ansiScreen) SetWindow(window int) string {
+	if window == screen.window || window < 0 || window > 1 {
+		return ""
+	}
+
+	screen.window = window
+	if window == 0 {
+		return "\x1b8"
+	}
+
+	// the cursor goes to the top left corner of the upper window
+	screen.upperRow, screen.upperCol = 0, 0
+	return "\x1b7" + screen.upperCursor()
+}
+
+// Print keeps track of the cursor while text is written
+func (screen *ansiScreen) Print(text string) {
+	if screen.window == 1 {
+		// the upper window has a fixed pitch font, so the cursor position
+		// can be tracked by counting characters
+		for _, c := range text {
+			if c != '\n' {
+				screen.upperCol++
+			}
+			if c == '\n' || screen.upperCol >= screen.width {
+				screen.upperRow++
+				screen.upperCol = 0
+			}
+		}
+	}
+
+}
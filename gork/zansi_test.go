@@ -0,0 +1,74 @@
+package gork
+
+import "testing"
+
+func TestAnsiScreenWindows(t *testing.T) {
+	screen := &ansiScreen{}
+	screen.SetSize(30, 10)
+	status := &ZStatus{Location: "Hall"}
+	line := status.Line(30)
+
+	// the first drawing moves the cursor to the bottom of the lower window
+	if seq := screen.ShowStatus(status); seq != "\x1b[2;10r\x1b[1;1H\x1b[7m"+line+"\x1b[0m\x1b[10;1H" {
+		t.Errorf("unexpected status %q", seq)
+	}
+
+	// the upper window is below the status line
+	if seq := screen.SplitWindow(2); seq != "\x1b7\x1b[4;10r\x1b8" {
+		t.Errorf("unexpected split %q", seq)
+	}
+
+	if seq := screen.EraseWindow(1); seq != "\x1b7\x1b[4;10r\x1b[2;1H\x1b[2K\x1b[3;1H\x1b[2K\x1b8" {
+		t.Errorf("unexpected erase %q", seq)
+	}
+
+	if seq := screen.SetWindow(1); seq != "\x1b7\x1b[2;1H" {
+		t.Errorf("unexpected set window %q", seq)
+	}
+
+	screen.Print("Seastalker\nSonar")
+	if screen.upperRow != 1 || screen.upperCol != 5 {
+		t.Errorf("upper cursor at %d,%d", screen.upperRow, screen.upperCol)
+	}
+
+	// drawing the status line in the upper window puts back its cursor
+	// without touching the saved cursor of the lower window
+	if seq := screen.ShowStatus(status); seq != "\x1b[4;10r\x1b[1;1H\x1b[7m"+line+"\x1b[0m\x1b[3;6H" {
+		t.Errorf("unexpected status %q", seq)
+	}
+
+	if seq := screen.SetWindow(0); seq != "\x1b8" {
+		t.Errorf("unexpected set window %q", seq)
+	}
+
+	// erasing the lower window puts its cursor at the bottom
+	if seq := screen.EraseWindow(0); seq != "\x1b7\x1b[4;10r"+screen.clearLines(4, 10)+"\x1b8\x1b[10;1H" {
+		t.Errorf("unexpected erase %q", seq)
+	}
+
+	if seq := screen.TextStyle(StyleBold | StyleReverse); seq != "\x1b[0;7;1m" {
+		t.Errorf("unexpected style %q", seq)
+	}
+
+	// the lower window keeps at least a line
+	screen.SplitWindow(42)
+	if screen.upperLines != 8 || screen.lowerTop() != 10 {
+		t.Errorf("upper window has %d lines", screen.upperLines)
+	}
+}
+
+func TestAnsiScreenColour(t *testing.T) {
+	screen := &ansiScreen{}
+
+	if seq := screen.Colour(ColourRed, ColourDefault); seq != "\x1b[31;49m" {
+		t.Errorf("unexpected colour %q", seq)
+	}
+
+	// the current colour is left alone
+	if seq := screen.Colour(ColourCurrent, ColourWhite); seq != "\x1b[47m" {
+		t.Errorf("unexpected colour %q", seq)
+	}
+	if seq := screen.Colour(ColourCurrent, ColourCurrent); seq != "" {
+		t.Errorf("unexpected colour %q", seq)
+	}
+}
@@ -0,0 +1,261 @@
+package gork
+
+import "fmt"
+
+// ZEngine is the way a machine runs the story
+type ZEngine int
+
+const (
+	// ZInterpreter decodes and runs an instruction at a time
+	ZInterpreter ZEngine = iota
+	// ZCompiler translates the basic blocks of the story into closures
+	// and runs a block at a time
+	ZCompiler
+)
+
+// blocks are cut after this many instructions even without a jump
+const maxBlockLen = 64
+
+// zstep runs a single instruction of a block
+type zstep func(zm *ZMachine)
+
+// zoperand fetches an operand of an instruction
+type zoperand func(zm *ZMachine) uint16
+
+// zblock is a basic block compiled to a chain of closures, the instructions
+// from start up to one which may jump, call, return or wait for input
+type zblock struct {
+	start uint32
+	ops   []*ZOp
+	steps []zstep
+	// false once the story has written into the block
+	valid bool
+}
+
+// zcompiler holds the blocks of a machine by their start PC
+type zcompiler struct {
+	mem    *ZMemory
+	blocks map[uint32]*zblock
+	// the blocks in dynamic memory, the story can write them
+	dynamic []*zblock
+}
+
+// SetEngine selects how the machine runs the story from the next Step,
+// the engines produce the same output
+func (zm *ZMachine) SetEngine(engine ZEngine) {
+	switch engine {
+	case ZCompiler:
+		if zm.compiler == nil {
+			zm.compiler = &zcompiler{mem: zm.seq.mem, blocks: make(map[uint32]*zblock)}
+		}
+	default:
+		if zm.compiler != nil {
+			zm.compiler.invalidate()
+			zm.compiler = nil
+			zm.seq.mem.code, zm.seq.mem.codeWritten = nil, nil
+		}
+	}
+}
+
+// Step runs the story with the selected engine: an instruction with the
+// interpreter, a basic block with the compiler
+func (zm *ZMachine) Step() error {
+	if zm.compiler == nil {
+		return zm.Interpret()
+	}
+	_, err := zm.runBlock()
+	return err
+}
+
+// runBlock runs the block at PC compiling it if needed, it returns the
+// number of instructions run so that it can be compared with Interpret
+func (zm *ZMachine) runBlock() (n int, err error) {
+	block := zm.compiler.blocks[zm.seq.pos]
+	if block == nil {
+		block = zm.compileBlock(zm.seq.pos)
+		if block == nil {
+			// Interpret returns the same error the decoding did
+			return 1, zm.Interpret()
+		}
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = zm.runtimeError(zm.op.pc, zm.op, r)
+		}
+	}()
+
+	for i, step := range block.steps {
+		op := block.ops[i]
+		n++
+		if zm.traces(TraceDebug, TraceInstructions) {
+			zm.op = op
+			zm.trace(TraceDebug, TraceInstructions, 0, "compiled")
+		}
+		step(zm)
+		// a branch taken, the game quitted or changed the code of the block
+		if zm.seq.pos != op.next || zm.quitted || !block.valid {
+			break
+		}
+	}
+	return n, nil
+}
+
+// compileBlock decodes the instructions at pc as NewZOp does up to the end
+// of the block, it returns nil if the first one can't be decoded
+func (zm *ZMachine) compileBlock(pc uint32) *zblock {
+	pos := zm.seq.pos
+	defer func() {
+		zm.seq.pos = pos
+	}()
+
+	block := &zblock{start: pc, valid: true}
+	zm.seq.pos = pc
+	for len(block.ops) < maxBlockLen {
+		op, err := NewZOp(zm)
+		if err != nil {
+			// the block ends before it, it fails when it's reached
+			break
+		}
+		block.ops = append(block.ops, op)
+		block.steps = append(block.steps, compileOp(op))
+		if op.shape&opEnd != 0 {
+			break
+		}
+		zm.seq.pos = op.next
+	}
+	if len(block.ops) == 0 {
+		return nil
+	}
+
+	zm.compiler.blocks[pc] = block
+	if pc < uint32(zm.header.dynMemSize) {
+		zm.markCode(block)
+	}
+	if zm.traces(TraceDebug, TraceInstructions) {
+		zm.tracer.Trace(&ZTraceEvent{
+			Level:    TraceDebug,
+			Category: TraceInstructions,
+			PC:       pc,
+			Routine:  zm.stack.Top().addr,
+			Message:  fmt.Sprintf("compiled block of %d instructions", len(block.ops)),
+		})
+	}
+	return block
+}
+
+// markCode watches the bytes of a block in dynamic memory so that it's
+// invalidated when the story writes them
+func (zm *ZMachine) markCode(block *zblock) {
+	mem := zm.compiler.mem
+	if mem.code == nil {
+		mem.code = make([]bool, len(mem.dyn))
+		mem.codeWritten = func(uint32) {
+			zm.compiler.invalidate()
+		}
+	}
+
+	end := block.ops[len(block.ops)-1].next
+	for addr := block.start; addr < end && addr < uint32(len(mem.code)); addr++ {
+		mem.code[addr] = true
+	}
+	zm.compiler.dynamic = append(zm.compiler.dynamic, block)
+}
+
+// invalidate drops all the blocks in dynamic memory, the story rarely
+// writes its code so it's not worth finding the blocks it changed
+func (c *zcompiler) invalidate() {
+	for _, block := range c.dynamic {
+		block.valid = false
+		if c.blocks[block.start] == block {
+			delete(c.blocks, block.start)
+		}
+	}
+	c.dynamic = nil
+	clear(c.mem.code)
+}
+
+// compileOp binds an instruction to its operands, the step does what
+// ZOp.exec does without looking at the operand types
+func compileOp(op *ZOp) zstep {
+	n := len(op.operands)
+	fetch := make([]zoperand, n)
+	for i := range fetch {
+		fetch[i] = compileOperand(op, i)
+	}
+
+	switch {
+	case op.zeroOp != nil:
+		fn := op.zeroOp
+		return func(zm *ZMachine) {
+			zm.op = op
+			zm.seq.pos = op.next
+			fn(zm)
+		}
+	case op.oneOp != nil && n >= 1:
+		fn, a := op.oneOp, fetch[0]
+		// the remaining operands are read anyway, they may pop the stack
+		rest := fetch[1:]
+		return func(zm *ZMachine) {
+			zm.op = op
+			zm.seq.pos = op.next
+			x := a(zm)
+			for _, f := range rest {
+				f(zm)
+			}
+			fn(zm, x)
+		}
+	case op.twoOp != nil && n >= 2:
+		fn, a, b := op.twoOp, fetch[0], fetch[1]
+		rest := fetch[2:]
+		return func(zm *ZMachine) {
+			zm.op = op
+			zm.seq.pos = op.next
+			x := a(zm)
+			y := b(zm)
+			for _, f := range rest {
+				f(zm)
+			}
+			fn(zm, x, y)
+		}
+	case op.varOp != nil:
+		fn := op.varOp
+		return func(zm *ZMachine) {
+			zm.op = op
+			zm.seq.pos = op.next
+			args := zm.args[:n]
+			for i, f := range fetch {
+				args[i] = f(zm)
+			}
+			fn(zm, args)
+		}
+	}
+
+	// it fails as the interpreter does, once the operands have been read
+	return func(zm *ZMachine) {
+		zm.op = op
+		zm.seq.pos = op.next
+		op.exec(zm)
+	}
+}
+
+// compileOperand returns a constant or reads a variable, the variable 0
+// pops the stack
+func compileOperand(op *ZOp, i int) zoperand {
+	v := op.operands[i]
+	if op.optypes[i] != VARIABLE_CONSTANT {
+		return func(*ZMachine) uint16 {
+			return v
+		}
+	}
+
+	varnum := byte(v)
+	if varnum == 0 {
+		return func(zm *ZMachine) uint16 {
+			return zm.pop()
+		}
+	}
+	return func(zm *ZMachine) uint16 {
+		return zm.GetVarAt(varnum)
+	}
+}
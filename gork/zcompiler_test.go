@@ -0,0 +1,150 @@
+package gork
+
+import (
+	"bytes"
+	"testing"
+)
+
+// newCompilerTestStory loops 4 times calling a routine in high memory,
+// the loop is in dynamic memory and it rewrites one of its constants at
+// every iteration
+func newCompilerTestStory() []byte {
+	code := []byte{
+		// @call 0x193 7 -> sp, @print_num sp, @new_line
+		0xE0, 0x1F, 0x01, 0x93, 0x07, 0x00, 0xE6, 0xBF, 0x00, 0xBB,
+		// @add g2 5 -> g2, @print_num g2, @new_line
+		0x54, 0x12, 0x05, 0x12, 0xE6, 0xBF, 0x12, 0xBB,
+		// @storeb 0x310 0 g3, the constant added to g2
+		0xE2, 0x1B, 0x03, 0x10, 0x00, 0x13,
+		// @inc_chk g3 3 ?~0x304
+		0x05, 0x13, 0x03, 0x3F, 0xE5,
+		// @print "ok", @quit
+		0xB2, 0xD2, 0x05, 0xBA,
+	}
+	// doubles L01 and adds 3 until it's at least 100:
+	// @mul L01 2 -> sp, @add sp 3 -> L01, @jl L01 100 ?-11, @ret L01
+	routine := []byte{
+		0x01, 0x00, 0x00,
+		0x56, 0x01, 0x02, 0x00, 0x54, 0x00, 0x03, 0x01,
+		0x42, 0x01, 0x64, 0xBF, 0xF5, 0xAB, 0x01,
+	}
+	buf := newTestStoryRoutines(3, code, routine)
+
+	// dynamic memory and high memory meet at the routine
+	buf[0x04], buf[0x05] = 0x03, 0x26
+	buf[0x0E], buf[0x0F] = 0x03, 0x26
+	return buf
+}
+
+// sameState compares what the story can see of two machines
+func sameState(t *testing.T, interpreted, compiled *ZMachine) {
+	t.Helper()
+
+	if interpreted.seq.pos != compiled.seq.pos || interpreted.quitted != compiled.quitted {
+		t.Fatalf("PC %X quitted %t, compiled PC %X quitted %t",
+			interpreted.seq.pos, interpreted.quitted, compiled.seq.pos, compiled.quitted)
+	}
+	if interpreted.stack.Backtrace() != compiled.stack.Backtrace() {
+		t.Fatalf("stack\n%s\ncompiled stack\n%s", interpreted.stack.Backtrace(), compiled.stack.Backtrace())
+	}
+	if !bytes.Equal(interpreted.dynMem(), compiled.dynMem()) {
+		t.Fatalf("dynamic memory differs at PC %X", compiled.seq.pos)
+	}
+}
+
+func TestZCompilerLockstep(t *testing.T) {
+	buf := newCompilerTestStory()
+	interpreted, interpretedDev := newTestMachine(t, buf)
+	compiled, compiledDev := newTestMachine(t, buf)
+	compiled.SetEngine(ZCompiler)
+
+	for steps := 0; !compiled.quitted; steps++ {
+		if steps > 1000 {
+			t.Fatal("the story did not quit")
+		}
+
+		n, err := compiled.runBlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+		runTestMachine(t, interpreted, n)
+
+		sameState(t, interpreted, compiled)
+		if interpretedDev.output != compiledDev.output {
+			t.Fatalf("output %q, compiled output %q", interpretedDev.output, compiledDev.output)
+		}
+	}
+
+	// the add uses the constant the loop stored into it
+	expected := "157\n5\n157\n5\n157\n6\n157\n8\nok"
+	if compiledDev.output != expected {
+		t.Errorf("unexpected output %q", compiledDev.output)
+	}
+}
+
+func TestZCompilerInvalidate(t *testing.T) {
+	zm, _ := newTestMachine(t, newCompilerTestStory())
+	zm.SetEngine(ZCompiler)
+
+	// the call, its block is in dynamic memory
+	if err := zm.Step(); err != nil {
+		t.Fatal(err)
+	}
+	block := zm.compiler.blocks[testPC]
+	if block == nil || !block.valid {
+		t.Fatal("the loop in dynamic memory was not compiled")
+	}
+
+	// writing data next to it doesn't matter
+	zm.seq.mem.WriteByteAt(0x290, 1)
+	if !block.valid {
+		t.Error("block invalidated by a write out of it")
+	}
+
+	// up to the return from the routine, then the block which runs
+	// until the storeb changes the add before it
+	for zm.seq.pos != testPC+6 {
+		if err := zm.Step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zm.Step(); err != nil {
+		t.Fatal(err)
+	}
+	if zm.seq.pos != testPC+24 {
+		t.Errorf("block not stopped by the write into it, PC %X", zm.seq.pos)
+	}
+	if block.valid || zm.compiler.blocks[testPC] != nil || zm.compiler.blocks[testPC+6] != nil {
+		t.Error("blocks not invalidated by a write into them")
+	}
+}
+
+func TestZCompilerRuntimeError(t *testing.T) {
+	// @add 1 2 -> sp, @div 7 0 -> sp
+	buf := newTestStory(0x14, 0x01, 0x02, 0x00, 0x17, 0x07, 0x00, 0x00)
+	interpreted, _ := newTestMachine(t, buf)
+	compiled, _ := newTestMachine(t, buf)
+	compiled.SetEngine(ZCompiler)
+
+	expected := interpretError(t, interpreted, 2)
+	err := compiled.InterpretAll()
+	if err == nil || err.Error() != expected.Error() {
+		t.Errorf("compiled error %v, expected %s", err, expected)
+	}
+}
+
+func BenchmarkCompiled(b *testing.B) {
+	zm := newBenchmarkMachine(b, false)
+	zm.SetEngine(ZCompiler)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; {
+		n, err := zm.runBlock()
+		if err != nil {
+			b.Fatal(err)
+		}
+		i += n
+	}
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "instr/s")
+}
@@ -0,0 +1,174 @@
+package gork
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// globals are the variables from 0x10
+const maxGlobals = 240
+
+var errInvalidGlobal = errors.New("there are only 240 globals")
+
+// ZFrame is a routine on the call stack as a debugger shows it
+type ZFrame struct {
+	// the byte address of the routine and of its first instruction
+	Routine uint32
+	Code    uint32
+	// where the caller goes on, 0 for the main routine
+	ReturnPC  uint32
+	Locals    []uint16
+	Stack     []uint16
+	Interrupt bool
+}
+
+// PC is the address of the next instruction
+func (zm *ZMachine) PC() uint32 {
+	return zm.seq.pos
+}
+
+// Quitted tells whether the story is over
+func (zm *ZMachine) Quitted() bool {
+	return zm.quitted
+}
+
+// Depth is the number of routines on the call stack, the main one
+// included
+func (zm *ZMachine) Depth() int {
+	return len(zm.stack)
+}
+
+// Frames returns a copy of the call stack from the current routine
+func (zm *ZMachine) Frames() []ZFrame {
+	frames := make([]ZFrame, len(zm.stack))
+	for i, routine := range zm.stack {
+		frame := ZFrame{
+			Routine:   routine.addr,
+			Code:      routine.addr,
+			ReturnPC:  routine.retAddr,
+			Locals:    append([]uint16{}, routine.locals...),
+			Stack:     append([]uint16{}, routine.stack...),
+			Interrupt: routine.interrupt,
+		}
+		// the main routine has no header
+		if i > 0 {
+			frame.Code++
+			if zm.header.version < 5 {
+				frame.Code += 2 * uint32(len(routine.locals))
+			}
+		}
+		frames[len(frames)-1-i] = frame
+	}
+	return frames
+}
+
+// Global returns the value of global n, the variable 0x10 + n
+func (zm *ZMachine) Global(n int) (v uint16, err error) {
+	defer recoverFault(&err)
+
+	if n < 0 || n >= maxGlobals {
+		return 0, errInvalidGlobal
+	}
+	return zm.GetVarAt(byte(0x10 + n)), nil
+}
+
+// SetGlobal changes the value of global n
+func (zm *ZMachine) SetGlobal(n int, v uint16) (err error) {
+	defer recoverFault(&err)
+
+	if n < 0 || n >= maxGlobals {
+		return errInvalidGlobal
+	}
+	zm.StoreVarAt(byte(0x10+n), v)
+	return nil
+}
+
+// Object returns the object id of the story
+func (zm *ZMachine) Object(id uint16) (obj *ZObject, err error) {
+	defer recoverFault(&err)
+
+	return zm.objects.Object(id)
+}
+
+// ReadMemory returns n bytes of memory from addr as the story sees them
+func (zm *ZMachine) ReadMemory(addr uint32, n int) (b []byte, err error) {
+	defer recoverFault(&err)
+
+	b = make([]byte, 0, n)
+	for i := 0; i < n; i++ {
+		b = append(b, zm.seq.mem.ByteAt(addr+uint32(i)))
+	}
+	return b, nil
+}
+
+// Disassemble decodes the instruction at pc without running it
+func (zm *ZMachine) Disassemble(pc uint32) (*ZOp, error) {
+	pos := zm.seq.pos
+	defer func() {
+		zm.seq.pos = pos
+	}()
+
+	zm.seq.pos = pc
+	return NewZOp(zm)
+}
+
+// PC is the address of the instruction
+func (zop *ZOp) PC() uint32 {
+	return zop.pc
+}
+
+// Next is the address of the instruction following this one
+func (zop *ZOp) Next() uint32 {
+	return zop.next
+}
+
+// Disassembly returns the instruction as the ztools print it: the
+// variables are sp, L01-L0F and G00-GEF, the constants are hexadecimal
+// and the branch is followed by its target
+func (zop *ZOp) Disassembly() string {
+	var b strings.Builder
+	b.WriteString(zop.name)
+
+	for i, operand := range zop.operands {
+		if zop.optypes[i] == VARIABLE_CONSTANT {
+			fmt.Fprintf(&b, " %s", variableName(byte(operand)))
+		} else {
+			fmt.Fprintf(&b, " #%X", operand)
+		}
+	}
+
+	if zop.shape&opText != 0 {
+		fmt.Fprintf(&b, " %q", zop.text)
+	}
+	if zop.shape&opStore != 0 {
+		fmt.Fprintf(&b, " -> %s", variableName(zop.store))
+	}
+	if zop.shape&opBranch != 0 {
+		b.WriteString(" ?")
+		if !zop.branch.onTrue {
+			b.WriteString("~")
+		}
+		switch zop.branch.offset {
+		case 0:
+			b.WriteString("rfalse")
+		case 1:
+			b.WriteString("rtrue")
+		default:
+			fmt.Fprintf(&b, "%X", uint32(int64(zop.next)+int64(zop.branch.offset)-2))
+		}
+	}
+
+	return b.String()
+}
+
+func variableName(varnum byte) string {
+	switch {
+	case varnum == 0:
+		return "sp"
+	case varnum < 0x10:
+		return fmt.Sprintf("L%02X", varnum)
+	default:
+		return fmt.Sprintf("G%02X", varnum-0x10)
+	}
+}
@@ -0,0 +1,85 @@
+package gork
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestZDebugFrames(t *testing.T) {
+	// @call 0x190 7 -> sp, the routine has 2 locals and pushes L02
+	zm, _ := newTestMachine(t, newTestStoryRoutines(3, []byte{0xE0, 0x1F, 0x01, 0x90, 0x07, 0x00},
+		[]byte{0x02, 0x00, 0x00, 0x00, 0x2A, 0xE8, 0xBF, 0x02, 0xB8},
+	))
+	runTestMachine(t, zm, 2)
+
+	frames := zm.Frames()
+	expected := fmt.Sprint([]ZFrame{
+		{Routine: 0x320, Code: 0x325, ReturnPC: testPC + 6, Locals: []uint16{7, 0x2A}, Stack: []uint16{0x2A}},
+		{Routine: testPC, Code: testPC, Locals: []uint16{}, Stack: []uint16{}},
+	})
+	if fmt.Sprint(frames) != expected {
+		t.Errorf("unexpected frames %v", frames)
+	}
+	if zm.PC() != 0x328 {
+		t.Errorf("unexpected PC %X", zm.PC())
+	}
+
+	// the frames are a copy
+	frames[0].Stack[0] = 0
+	if zm.stack.Top().stack[0] != 0x2A {
+		t.Error("frames share the stack of the machine")
+	}
+}
+
+func TestZDebugGlobals(t *testing.T) {
+	zm, _ := newTestMachine(t, newTestStory(0xBA))
+
+	if err := zm.SetGlobal(0x0A, 42); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := zm.Global(0x0A); err != nil || v != 42 || zm.GetVarAt(0x1A) != 42 {
+		t.Errorf("unexpected global %d %v", v, err)
+	}
+	if _, err := zm.Global(maxGlobals); err == nil {
+		t.Error("read a global out of range")
+	}
+
+	if _, err := zm.ReadMemory(uint32(len(zm.story.buf))-1, 2); err == nil {
+		t.Error("read out of memory")
+	}
+	if _, err := zm.Object(200); err == nil {
+		t.Error("read an invalid object")
+	}
+}
+
+func TestZDebugDisassembly(t *testing.T) {
+	// @je g0 sp #2A ?~rfalse, @store sp 1, @print "i", @inc_chk L01 3 ?306
+	zm, _ := newTestMachine(t, newTestStory(
+		0xC1, 0xA7, 0x10, 0x00, 0x2A, 0x40,
+		0x0D, 0x00, 0x01,
+		0xB2, 0xB8, 0xA5,
+		0x05, 0x01, 0x03, 0xBF, 0xF3,
+	))
+
+	expected := []string{
+		"ZJe G00 sp #2A ?~rfalse",
+		"ZStore #0 #1",
+		`ZPrint "i"`,
+		"ZIncChk #1 #3 ?306",
+	}
+	pc := uint32(testPC)
+	for _, e := range expected {
+		op, err := zm.Disassemble(pc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if op.Disassembly() != e {
+			t.Errorf("disassembled %q, expected %q", op.Disassembly(), e)
+		}
+		pc = op.Next()
+	}
+
+	if zm.PC() != testPC {
+		t.Error("disassembling moved the PC")
+	}
+}
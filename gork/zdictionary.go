@@ -1,37 +1,62 @@
 package gork
 
 import (
+	"bytes"
 	"fmt"
 	"sort"
 )
 
 type ZDictionary struct {
+	header         *ZHeader
 	wordSeparators []byte
 	entrySize      uint8
-	words          []string
-	entriesPos     uint32
+	// the encoded words, they are what the dictionary is sorted by
+	keys [][]byte
+	// the decoded words, only for humans
+	words      []string
+	entriesPos uint32
+	// user dictionaries may not be sorted
+	unsorted bool
 	// ignore words data, it looks like they are useless to interpreters
 }
 
 func NewZDictionary(mem *ZMemory, header *ZHeader) *ZDictionary {
-	zdict := new(ZDictionary)
+	return NewZDictionaryAt(mem, uint32(header.dictPos), header)
+}
+
+// NewZDictionaryAt reads the dictionary at addr, like the ones given to
+// tokenise
+func NewZDictionaryAt(mem *ZMemory, addr uint32, header *ZHeader) *ZDictionary {
+	zdict := &ZDictionary{header: header}
 
-	seq := mem.GetSequential(uint32(header.dictPos))
+	seq := mem.GetSequential(addr)
 
-	n := seq.ReadByte()
+	n := seq.ReadUint8()
 
 	for i := uint8(0); i < n; i++ {
-		wordSep := seq.ReadByte()
+		wordSep := seq.ReadUint8()
 		zdict.wordSeparators = append(zdict.wordSeparators, wordSep)
 	}
 
-	zdict.entrySize = seq.ReadByte()
+	zdict.entrySize = seq.ReadUint8()
 
-	entryCount := seq.ReadWord()
+	// a negative count means that the entries are not sorted
+	entryCount := int(int16(seq.ReadWord()))
+	if entryCount < 0 {
+		entryCount = -entryCount
+		zdict.unsorted = true
+	}
 
 	zdict.entriesPos = seq.pos
+	keyLen := uint32(encodedZstringLen(header.version) * 2)
+
+	for i := 0; i < entryCount; i++ {
+		key := make([]byte, keyLen)
+		for j := range key {
+			key[j] = mem.ByteAt(seq.pos + uint32(j))
+		}
+		zdict.keys = append(zdict.keys, key)
 
-	for i := uint16(0); i < entryCount; i++ {
 		word := mem.DecodeZStringAt(seq.pos, header)
 		zdict.words = append(zdict.words, word)
 		seq.pos += uint32(zdict.entrySize)
@@ -40,10 +65,36 @@ func NewZDictionary(mem *ZMemory, header *ZHeader) *ZDictionary {
 	return zdict
 }
 
+// key encodes the ZSCII word s as the dictionary does, words longer than
+// the entries are truncated
+func (dict *ZDictionary) key(s string) []byte {
+	encoded := ZStringEncode(s, dict.header)
+
+	key := make([]byte, len(encoded)*2)
+	for i, w := range encoded {
+		key[i*2], key[i*2+1] = byte(w>>8), byte(w)
+	}
+	return key
+}
+
+// Search returns the address of the entry of the ZSCII word s, 0 if it's
+// not in the dictionary
 func (dict *ZDictionary) Search(s string) uint16 {
-	i := sort.SearchStrings(dict.words, s)
+	key := dict.key(s)
+
+	i := 0
+	if dict.unsorted {
+		for i < len(dict.keys) && !bytes.Equal(dict.keys[i], key) {
+			i++
+		}
+	} else {
+		// the entries are sorted by their encoded value
+		i = sort.Search(len(dict.keys), func(i int) bool {
+			return bytes.Compare(dict.keys[i], key) >= 0
+		})
+	}
 
-	if i < len(dict.words) && dict.words[i] == s {
+	if i < len(dict.keys) && bytes.Equal(dict.keys[i], key) {
 		return uint16(dict.entriesPos + uint32(i)*uint32(dict.entrySize))
 	}
 
@@ -53,7 +104,7 @@ func (dict *ZDictionary) Search(s string) uint16 {
 
 func (zdict *ZDictionary) String() string {
 	ret := "\n    **** Dictionary ****\n\n"
-	ret += fmt.Sprintf("  Word separators = \"%s\"\n", zdict.wordSeparators)
+	ret += fmt.Sprintf("  Word separators = \"%s\"\n", zdict.header.zsciiString(zdict.wordSeparators))
 	ret += fmt.Sprintf("  Word count = %d, word size = %d\n\n", len(zdict.words), zdict.entrySize)
 
 	for i, word := range zdict.words {
@@ -26,9 +26,9 @@ var dictExpected ZDictionary = ZDictionary{
 }
 
 func TestZDictionary(t *testing.T) {
-	mem := ZMemory(dictBuf)
+	mem := NewZMemory(dictBuf)
 
-	res := NewZDictionary(&mem, &ZHeader{dictPos: 0})
+	res := NewZDictionary(mem, &ZHeader{dictPos: 0})
 
 	for i, sep := range dictExpected.wordSeparators {
 		if res.wordSeparators[i] != sep {
@@ -50,9 +50,9 @@ func TestZDictionary(t *testing.T) {
 }
 
 func TestZDictionarySearch(t *testing.T) {
-	mem := ZMemory(dictBuf)
+	mem := NewZMemory(dictBuf)
 
-	dict := NewZDictionary(&mem, &ZHeader{dictPos: 0})
+	dict := NewZDictionary(mem, &ZHeader{dictPos: 0})
 
 	randomData := []string{
 		"42 is the answer",
@@ -0,0 +1,160 @@
+package gork
+
+import (
+	"bytes"
+	"strings"
+)
+
+const (
+	zcharSpace  = byte(0)
+	zcharShift1 = byte(4)
+	zcharShift2 = byte(5)
+	zcharEscape = byte(6)
+	// Z-characters are padded with shifts, which print nothing
+	zcharPadding = zcharShift2
+)
+
+// ZStringEncoder encodes text to Z-strings for the version and the
+// alphabets of header, abbreviations are used where they make the string
+// shorter. Only single shifts are used, the shift locks of v1 and v2 are
+// not supported.
+type ZStringEncoder struct {
+	header *ZHeader
+	// the abbreviations in ZSCII, the index is the abbreviation number
+	abbreviations [][]byte
+}
+
+// NewZStringEncoder returns an encoder for the stories with header, the
+// target version is the one of the header. abbreviations can be nil, at
+// most abbrCount of them are used.
+func NewZStringEncoder(header *ZHeader, abbreviations []string) *ZStringEncoder {
+	enc := &ZStringEncoder{header: header}
+
+	if len(abbreviations) > abbrCount {
+		abbreviations = abbreviations[:abbrCount]
+	}
+	for _, abbr := range abbreviations {
+		enc.abbreviations = append(enc.abbreviations, header.zsciiText(abbr))
+	}
+
+	return enc
+}
+
+// Encode encodes text, which can be of any length, as a Z-string
+func (enc *ZStringEncoder) Encode(text string) []uint16 {
+	return packZchars(enc.zchars(enc.header.zsciiText(text), true), 0)
+}
+
+// EncodeWord encodes text as a dictionary word, it's lower case, without
+// abbreviations and truncated or padded to the length of the dictionary
+// entries
+func (enc *ZStringEncoder) EncodeWord(text string) []uint16 {
+	return enc.encodeWord(enc.header.zsciiText(strings.ToLower(text)))
+}
+
+func (enc *ZStringEncoder) encodeWord(zscii []byte) []uint16 {
+	// only the ASCII letters have a case in ZSCII
+	lower := make([]byte, len(zscii))
+	for i, c := range zscii {
+		if c >= 'A' && c <= 'Z' {
+			c = c - 'A' + 'a'
+		}
+		lower[i] = c
+	}
+
+	return packZchars(enc.zchars(lower, false), encodedZstringLen(enc.header.version))
+}
+
+// charZchars returns the shortest Z-characters that print the ZSCII
+// character c
+func (enc *ZStringEncoder) charZchars(c byte) []byte {
+	if c == ' ' {
+		return []byte{zcharSpace}
+	}
+	if c == byte(zsciiNewline) || c == '\n' {
+		// A2 #1 is always the newline, Alphabets has it as '\n'
+		return []byte{zcharShift2, 7}
+	}
+
+	if i := strings.IndexByte(enc.header.alphabet(0), c); i >= 0 {
+		return []byte{byte(i) + 6}
+	}
+	if i := strings.IndexByte(enc.header.alphabet(1), c); i >= 0 {
+		return []byte{zcharShift1, byte(i) + 6}
+	}
+	// A2 #0 is the escape to 10 bit ZSCII
+	if i := strings.IndexByte(enc.header.alphabet(2)[2:], c); i >= 0 {
+		return []byte{zcharShift2, byte(i) + 8}
+	}
+
+	return []byte{zcharShift2, zcharEscape, c >> 5, c & 0x1F}
+}
+
+// zchars returns the shortest Z-characters that print zscii, every
+// abbreviation takes 2 of them so the best ones are found by going
+// backwards from the end of the text
+func (enc *ZStringEncoder) zchars(zscii []byte, useAbbreviations bool) []byte {
+	n := len(zscii)
+
+	// cost[i] is the number of Z-characters of zscii[i:] and choice[i]
+	// the abbreviation it starts with, -1 for none
+	cost := make([]int, n+1)
+	choice := make([]int, n+1)
+
+	for i := n - 1; i >= 0; i-- {
+		cost[i] = cost[i+1] + len(enc.charZchars(zscii[i]))
+		choice[i] = -1
+
+		if !useAbbreviations {
+			continue
+		}
+		for j, abbr := range enc.abbreviations {
+			if len(abbr) > 0 && bytes.HasPrefix(zscii[i:], abbr) && cost[i+len(abbr)]+2 < cost[i] {
+				cost[i] = cost[i+len(abbr)] + 2
+				choice[i] = j
+			}
+		}
+	}
+
+	zchars := make([]byte, 0, cost[0])
+	for i := 0; i < n; {
+		if j := choice[i]; j >= 0 {
+			zchars = append(zchars, byte(j/32+1), byte(j%32))
+			i += len(enc.abbreviations[j])
+		} else {
+			zchars = append(zchars, enc.charZchars(zscii[i])...)
+			i++
+		}
+	}
+
+	return zchars
+}
+
+// packZchars packs 3 Z-characters per word and marks the last word. When
+// words is not 0 the Z-characters are truncated or padded to fill exactly
+// words words.
+func packZchars(zchars []byte, words int) []uint16 {
+	if words > 0 {
+		if len(zchars) > words*3 {
+			zchars = zchars[:words*3]
+		}
+	} else {
+		// even an empty string needs a word for the end bit
+		words = (len(zchars) + 2) / 3
+		if words == 0 {
+			words = 1
+		}
+	}
+
+	for len(zchars) < words*3 {
+		zchars = append(zchars, zcharPadding)
+	}
+
+	ret := make([]uint16, words)
+	for i := range ret {
+		ret[i] = uint16(zchars[i*3])<<10 | uint16(zchars[i*3+1])<<5 | uint16(zchars[i*3+2])
+	}
+	ret[words-1] |= 1 << 15
+
+	return ret
+}
@@ -0,0 +1,118 @@
+package gork
+
+import (
+	"reflect"
+	"testing"
+)
+
+// zstringBytes lays out the words of a Z-string in memory
+func zstringBytes(words []uint16) []byte {
+	buf := make([]byte, len(words)*2)
+	for i, w := range words {
+		buf[i*2], buf[i*2+1] = byte(w>>8), byte(w)
+	}
+	return buf
+}
+
+func TestZStringEncoderRoundTrip(t *testing.T) {
+	texts := []string{
+		"",
+		"West of House\nYou are standing in an open field west of a white house.",
+		"$100 (approx.) & 50% off!",
+		"Café über déjà vu",
+		"  spaces  ",
+	}
+
+	for _, version := range []byte{3, 5, 8} {
+		header := &ZHeader{version: version}
+		enc := NewZStringEncoder(header, nil)
+
+		for _, text := range texts {
+			encoded := enc.Encode(text)
+			if decoded := NewZMemory(zstringBytes(encoded)).DecodeZStringAt(0, header); decoded != text {
+				t.Errorf("v%d %q decoded as %q", version, text, decoded)
+			}
+		}
+	}
+}
+
+func TestZStringEncoderEscape(t *testing.T) {
+	enc := NewZStringEncoder(&ZHeader{version: 3}, nil)
+
+	// '$' is not in any alphabet, nothing follows the escape
+	if zchars := enc.zchars([]byte("$a"), false); !reflect.DeepEqual(zchars, []byte{5, 6, 1, 4, 6}) {
+		t.Errorf("unexpected Z-characters %v", zchars)
+	}
+
+	// upper case letters are shifted to A1
+	if zchars := enc.zchars([]byte("A."), false); !reflect.DeepEqual(zchars, []byte{4, 6, 5, 18}) {
+		t.Errorf("unexpected Z-characters %v", zchars)
+	}
+}
+
+func TestZStringEncoderWord(t *testing.T) {
+	enc := NewZStringEncoder(&ZHeader{version: 5}, []string{"ing"})
+
+	// dictionary words never use abbreviations and are always 3 words
+	// long from v4
+	word := enc.EncodeWord("Standing")
+	if len(word) != 3 || NewZMemory(zstringBytes(word)).DecodeZStringAt(0, nil) != "standing" {
+		t.Errorf("unexpected word %X", word)
+	}
+
+	word = enc.EncodeWord("Encyclopedia")
+	if len(word) != 3 || NewZMemory(zstringBytes(word)).DecodeZStringAt(0, nil) != "encyclope" {
+		t.Errorf("unexpected word %X", word)
+	}
+}
+
+func TestZStringEncoderAbbreviations(t *testing.T) {
+	const tblPos, stringsPos = 0x40, 0x200
+	header := &ZHeader{version: 3, abbrTblPos: tblPos}
+
+	abbreviations := make([]string, abbrCount)
+	abbreviations[0] = "the "
+	abbreviations[33] = "ouse"
+	// it takes as many Z-characters as the letter itself
+	abbreviations[2] = "a"
+
+	buf := make([]byte, 0x400)
+	addr := stringsPos
+	plain := NewZStringEncoder(header, nil)
+	for i, abbr := range abbreviations {
+		buf[tblPos+i*2], buf[tblPos+i*2+1] = byte(addr/2>>8), byte(addr/2)
+		addr += copy(buf[addr:], zstringBytes(plain.Encode(abbr)))
+	}
+
+	enc := NewZStringEncoder(header, abbreviations)
+	text := "the house of a mouse"
+
+	zchars := enc.zchars(header.zsciiText(text), true)
+	expected := []byte{1, 0, 13, 2, 1, 0, 20, 11, 0, 6, 0, 18, 2, 1}
+	if !reflect.DeepEqual(zchars, expected) {
+		t.Errorf("unexpected Z-characters %v", zchars)
+	}
+
+	encoded := enc.Encode(text)
+	copy(buf, zstringBytes(encoded))
+	if decoded := NewZMemory(buf).DecodeZStringAt(0, header); decoded != text {
+		t.Errorf("decoded %q", decoded)
+	}
+}
+
+func TestZStringEncoderAlphabet(t *testing.T) {
+	alphabets := [3]string{
+		"ABCDEFGHIJKLMNOPQRSTUVWXYZ",
+		"abcdefghijklmnopqrstuvwxyz",
+		"  0123456789.,!?_#'\"/\\-:()",
+	}
+	header := &ZHeader{version: 5, alphabets: &alphabets}
+
+	encoded := NewZStringEncoder(header, nil).Encode("ZORK zork")
+	if len(encoded) != 5 || encoded[0] != 0x7E97 {
+		t.Errorf("upper case letters are not in A0 %X", encoded)
+	}
+	if decoded := NewZMemory(zstringBytes(encoded)).DecodeZStringAt(0, header); decoded != "ZORK zork" {
+		t.Errorf("decoded %q", decoded)
+	}
+}
@@ -0,0 +1,129 @@
+package gork
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	errUnknownOpcode   = errors.New("unknown opcode")
+	errMissingOperands = errors.New("missing operands")
+)
+
+// ZRuntimeError is returned by Interpret when the story can't go on, it
+// tells where the machine was when it happened
+type ZRuntimeError struct {
+	// PC is the address of the instruction which failed
+	PC uint32
+	// Opcode is the name of the opcode, empty if it couldn't be decoded
+	Opcode string
+	// Operands are as encoded, the variables are their numbers
+	Operands []uint16
+	// Backtrace is the call stack, the current routine first
+	Backtrace string
+	Err       error
+}
+
+func (e *ZRuntimeError) Error() string {
+	if e.Opcode == "" {
+		return fmt.Sprintf("PC %X: %s", e.PC, e.Err)
+	}
+	return fmt.Sprintf("PC %X: %s %X: %s", e.PC, e.Opcode, e.Operands, e.Err)
+}
+
+func (e *ZRuntimeError) Unwrap() error {
+	return e.Err
+}
+
+// zfault carries an error out of the opcode which failed, Interpret turns
+// it into a ZRuntimeError
+type zfault struct {
+	err error
+}
+
+// fail stops the current instruction, the opcodes have no other way to
+// report an error
+func (zm *ZMachine) fail(err error) {
+	panic(zfault{err})
+}
+
+// recoverFault returns in err the fault of a story read outside Interpret,
+// like when the story is loaded. It must be deferred.
+func recoverFault(err *error) {
+	if r := recover(); r != nil {
+		fault, ok := r.(zfault)
+		if !ok {
+			panic(r)
+		}
+		*err = fault.err
+	}
+}
+
+// runtimeError builds the error for a failure of the instruction at pc,
+// op is nil when the instruction couldn't be decoded. r is what has been
+// recovered.
+func (zm *ZMachine) runtimeError(pc uint32, op *ZOp, r interface{}) *ZRuntimeError {
+	if fault, ok := r.(zfault); ok {
+		r = fault.err
+	}
+
+	var err error
+	switch r := r.(type) {
+	case *ZRuntimeError:
+		// from an interrupt routine run by the instruction
+		return r
+	case error:
+		err = r
+	default:
+		err = fmt.Errorf("%v", r)
+	}
+
+	zerr := &ZRuntimeError{
+		PC:        pc,
+		Backtrace: zm.stack.Backtrace(),
+		Err:       err,
+	}
+	if op != nil {
+		zerr.Opcode = op.name
+		zerr.Operands = op.operands
+	}
+
+	if zm.traces(TraceError, TraceInstructions) {
+		event := &ZTraceEvent{
+			Level:    TraceError,
+			Category: TraceInstructions,
+			PC:       pc,
+			Opcode:   zerr.Opcode,
+			Operands: zerr.Operands,
+			Message:  err.Error(),
+		}
+		if len(zm.stack) > 0 {
+			event.Routine = zm.stack.Top().addr
+		}
+		zm.tracer.Trace(event)
+	}
+
+	return zerr
+}
+
+// Backtrace lists the frames of the stack with their locals and evaluation
+// stack, from the top one
+func (zstack ZStack) Backtrace() string {
+	var b strings.Builder
+
+	for i := len(zstack) - 1; i >= 0; i-- {
+		routine := zstack[i]
+		fmt.Fprintf(&b, "#%d routine %X", len(zstack)-1-i, routine.addr)
+		if i > 0 {
+			fmt.Fprintf(&b, " returning to %X", routine.retAddr)
+		}
+		if routine.interrupt {
+			b.WriteString(" (interrupt)")
+		}
+
+		fmt.Fprintf(&b, " locals %X stack %X\n", routine.locals, routine.stack)
+	}
+
+	return b.String()
+}
@@ -0,0 +1,105 @@
+package gork
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func interpretError(t *testing.T, zm *ZMachine, n int) *ZRuntimeError {
+	runTestMachine(t, zm, n-1)
+
+	err := zm.Interpret()
+	var zerr *ZRuntimeError
+	if !errors.As(err, &zerr) {
+		t.Fatalf("expected a runtime error, got %v", err)
+	}
+	return zerr
+}
+
+func TestZRuntimeErrorUnknownOpcode(t *testing.T) {
+	// 0OP:14 is extended only from v5
+	zm, _ := newTestMachine(t, newTestStory(0xBE))
+
+	zerr := interpretError(t, zm, 1)
+	if zerr.PC != testPC || !errors.Is(zerr, errUnknownOpcode) {
+		t.Errorf("unexpected error %s", zerr)
+	}
+}
+
+func TestZRuntimeErrorBacktrace(t *testing.T) {
+	// @call_1s 0xC8 -> sp, the routine does @div 7 0 -> sp
+	zm, _ := newTestMachine(t, newTestStoryRoutines(5, []byte{0x98, 0xC8, 0x00},
+		[]byte{0x01, 0x17, 0x07, 0x00, 0x00},
+	))
+
+	zerr := interpretError(t, zm, 2)
+	if zerr.PC != 0x321 || zerr.Opcode != "ZDiv" ||
+		len(zerr.Operands) != 2 || zerr.Operands[0] != 7 || zerr.Operands[1] != 0 {
+		t.Errorf("unexpected error %s", zerr)
+	}
+
+	expected := fmt.Sprintf("#0 routine 320 returning to %X locals [0] stack []\n", testPC+3) +
+		fmt.Sprintf("#1 routine %X locals [] stack []\n", testPC)
+	if zerr.Backtrace != expected {
+		t.Errorf("unexpected backtrace\n%s", zerr.Backtrace)
+	}
+}
+
+func TestZRuntimeErrorInvalidProperty(t *testing.T) {
+	// @get_prop 1 40 -> sp
+	zm, _ := newTestMachine(t, newTestStory(0x11, 0x01, 0x28, 0x00))
+
+	zerr := interpretError(t, zm, 1)
+	if zerr.Opcode != "ZGetProp" || !strings.Contains(zerr.Error(), "ZGetProp") {
+		t.Errorf("unexpected error %s", zerr)
+	}
+}
+
+func TestZRuntimeErrorObjects(t *testing.T) {
+	// @put_prop 1 5 7, object 1 has no properties
+	zm, _ := newTestMachine(t, newTestStory(0xE3, 0x57, 0x01, 0x05, 0x07))
+
+	zerr := interpretError(t, zm, 1)
+	if zerr.Opcode != "ZPutProp" || !strings.Contains(zerr.Error(), "Property 5 not found") {
+		t.Errorf("unexpected error %s", zerr)
+	}
+
+	// @insert_obj 1 1
+	zm, _ = newTestMachine(t, newTestStory(0x0E, 0x01, 0x01))
+
+	zerr = interpretError(t, zm, 1)
+	if zerr.Opcode != "ZInsertObj" {
+		t.Errorf("unexpected error %s", zerr)
+	}
+
+	// @insert_obj 1 2, there is only object 1
+	zm, _ = newTestMachine(t, newTestStory(0x0E, 0x01, 0x02))
+
+	zerr = interpretError(t, zm, 1)
+	if zerr.Opcode != "ZInsertObj" || !strings.Contains(zerr.Error(), "invalid object 2") {
+		t.Errorf("unexpected error %s", zerr)
+	}
+}
+
+type testFailingDev struct {
+	testIODev
+	err error
+}
+
+func (dev *testFailingDev) ReadLine() (string, error) {
+	return "", dev.err
+}
+
+func TestZRuntimeErrorDevice(t *testing.T) {
+	// @sread 0x100 0x120
+	zm, _ := newTestMachine(t, newTestStory(0xE4, 0x0F, 0x01, 0x00, 0x01, 0x20))
+	dev := &testFailingDev{err: errors.New("connection lost")}
+	zm.iodev = dev
+
+	zerr := interpretError(t, zm, 1)
+	if zerr.Opcode != "ZRead" || !errors.Is(zerr, dev.err) {
+		t.Errorf("unexpected error %s", zerr)
+	}
+}
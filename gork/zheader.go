@@ -26,6 +26,16 @@ type ZHeader struct {
 	abbrTblPos   uint16
 	fileLength   uint64
 	fileChecksum uint16
+
+	// v5
+	termCharsPos uint16
+	alphabetPos  uint16
+	extensionPos uint16
+	// alphabets is nil unless the story has its own alphabet table
+	alphabets *[3]string
+	// unicodeTable is nil unless the story has its own translation table
+	// of the ZSCII characters from 155
+	unicodeTable []rune
 }
 
 func NewZHeader(mem *ZMemory) (*ZHeader, error) {
@@ -39,13 +49,13 @@ func NewZHeader(mem *ZMemory) (*ZHeader, error) {
 func (header *ZHeader) configure(mem *ZMemory) error {
 	seq := mem.GetSequential(0)
 
-	header.version = seq.ReadByte()
+	header.version = seq.ReadUint8()
 
-	if header.version > 3 {
-		return errors.New("versions > 3 are not supported!")
+	if header.version == 6 || header.version == 7 || header.version > 8 {
+		return fmt.Errorf("version %d is not supported!", header.version)
 	}
 
-	header.config = seq.ReadByte()
+	header.config = seq.ReadUint8()
 	header.release = seq.ReadWord()
 
 	header.highStart = seq.ReadWord()
@@ -70,30 +80,97 @@ func (header *ZHeader) configure(mem *ZMemory) error {
 
 	seq.pos = 0x12
 	for i := 0; i < SerialSize; i++ {
-		header.serial[i] = seq.ReadByte()
+		header.serial[i] = seq.ReadUint8()
 	}
 
 	header.abbrTblPos = seq.ReadWord()
 
-	// v3
-	header.fileLength = uint64(seq.ReadWord()) * 2
-
-	// v3 max file length 128K
-	if header.fileLength > 128*1024 {
-		return errors.New("mem file too big!")
-	}
+	// the file length is stored divided by the same factor of packed
+	// addresses: 128K max in v3, 256K in v4 and v5, 512K in v8
+	header.fileLength = uint64(seq.ReadWord()) * uint64(header.packedScale())
 
 	header.fileChecksum = seq.ReadWord()
 
+	if header.version >= 5 {
+		header.configureV5(mem)
+	}
+
 	return nil
 }
 
+func (header *ZHeader) configureV5(mem *ZMemory) {
+	header.termCharsPos = mem.WordAt(0x2E)
+	header.alphabetPos = mem.WordAt(0x34)
+	header.extensionPos = mem.WordAt(0x36)
+
+	if header.alphabetPos != 0 {
+		alphabets := [3]string{}
+		for i := range alphabets {
+			chars := make([]byte, 26)
+			for j := range chars {
+				chars[j] = mem.ByteAt(uint32(header.alphabetPos) + uint32(i*26+j))
+			}
+			alphabets[i] = string(chars)
+		}
+		header.alphabets = &alphabets
+	}
+
+	// word #3 of the header extension table is the address of the unicode
+	// translation table, word #0 is the number of words that follow it
+	if header.extensionPos != 0 && mem.WordAt(uint32(header.extensionPos)) >= 3 {
+		if tablePos := uint32(mem.WordAt(uint32(header.extensionPos) + 3*2)); tablePos != 0 {
+			n := mem.ByteAt(tablePos)
+			header.unicodeTable = make([]rune, n)
+			for i := range header.unicodeTable {
+				header.unicodeTable[i] = rune(mem.WordAt(tablePos + 1 + uint32(i)*2))
+			}
+		}
+	}
+}
+
+// alphabet returns the alphabet i of the story, in A2 the first two
+// characters are always the 10 bit ZSCII escape and the newline
+func (header *ZHeader) alphabet(i int) string {
+	if header == nil || header.alphabets == nil {
+		return Alphabets[i]
+	}
+	if i == 2 {
+		return Alphabets[2][:2] + header.alphabets[2][2:]
+	}
+	return header.alphabets[i]
+}
+
+// packedScale is what packed addresses are multiplied by, 2 up to v3, 4
+// in v4 and v5 and 8 in v8
+func (header *ZHeader) packedScale() uint32 {
+	switch {
+	case header.version >= 8:
+		return 8
+	case header.version >= 4:
+		return 4
+	default:
+		return 2
+	}
+}
+
+// StatusLineTime tells whether the v3 status line shows hours:minutes
+// instead of score/turns, it's bit #1 of Flags 1
+func (header *ZHeader) StatusLineTime() bool {
+	return header.config&0x02 == 0x02
+}
+
+// HighStart is the address where high memory, the code and the strings,
+// begins
+func (header *ZHeader) HighStart() uint32 {
+	return uint32(header.highStart)
+}
+
 func (header *ZHeader) String() string {
 	ret := "\n    **** Story file header ****\n\n"
 	ret += fmt.Sprintf("  Z-code version:           %d\n", header.version)
 
 	ret += fmt.Sprint("  Interpreter flags:        ")
-	if header.config&0x01 == 0x01 {
+	if header.StatusLineTime() {
 		ret += fmt.Sprintln("Display hours:min")
 	} else {
 		ret += fmt.Sprintln("Display score/turns")
@@ -111,5 +188,14 @@ func (header *ZHeader) String() string {
 	ret += fmt.Sprintf("  File size:                %05x\n", header.fileLength)
 	ret += fmt.Sprintf("  Checksum:                 %04x\n", header.fileChecksum)
 
+	if header.version >= 5 {
+		ret += fmt.Sprintf("  Terminating keys address: %04x\n", header.termCharsPos)
+		ret += fmt.Sprintf("  Alphabet address:         %04x\n", header.alphabetPos)
+		ret += fmt.Sprintf("  Header extension address: %04x\n", header.extensionPos)
+		if header.unicodeTable != nil {
+			ret += fmt.Sprintf("  Unicode table entries:    %d\n", len(header.unicodeTable))
+		}
+	}
+
 	return ret
 }
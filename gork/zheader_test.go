@@ -1,6 +1,9 @@
 package gork
 
-import "testing"
+import (
+	"reflect"
+	"testing"
+)
 
 var headerBuf []byte = []byte{
 	3,    // version
@@ -36,10 +39,34 @@ var expectedHeader ZHeader = ZHeader{
 }
 
 func TestZHeaderConfigure(t *testing.T) {
-	mem := ZMemory(headerBuf)
-	header, err := NewZHeader(&mem)
+	mem := NewZMemory(headerBuf)
+	header, err := NewZHeader(mem)
 
-	if err != nil || *header != expectedHeader {
+	if err != nil || !reflect.DeepEqual(*header, expectedHeader) {
 		t.Fail()
 	}
 }
+
+func TestZHeaderAlphabet(t *testing.T) {
+	buf := newTestStoryVersion(5)
+
+	// the custom alphabet table is at 0x100, A0 is upper case
+	buf[0x34], buf[0x35] = 0x01, 0x00
+	copy(buf[0x100:], "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz  0123456789.,!?_#'\"/\\-:()")
+
+	header, err := NewZHeader(NewZMemory(buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A2 keeps the escape and the newline whatever the table says
+	if header.alphabet(0)[0] != 'A' || header.alphabet(2)[:3] != Alphabets[2][:2]+"0" {
+		t.Errorf("unexpected alphabets %q %q", header.alphabet(0), header.alphabet(2))
+	}
+
+	// "Zork" encoded with the default alphabets would be lower case
+	mem := NewZMemory([]byte{0x7E, 0x97, 0xC0, 0xA5})
+	if s := mem.DecodeZStringAt(0, header); s != "ZORK" {
+		t.Errorf("decoded %q", s)
+	}
+}
@@ -0,0 +1,126 @@
+package gork
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+const (
+	KeyboardStream    = 0
+	CommandFileStream = 1
+)
+
+// zinput sits between the reading opcodes and the device, it reads the
+// lines either from the keyboard or from a file of commands like the one
+// written by output stream 4
+type zinput struct {
+	stream   int
+	commands *bufio.Reader
+}
+
+// SetCommandFile sets where stream 1 reads the commands from, nil
+// disables it
+func (zm *ZMachine) SetCommandFile(r io.Reader) {
+	if r == nil {
+		zm.input.commands = nil
+		zm.input.stream = KeyboardStream
+		return
+	}
+	zm.input.commands = bufio.NewReader(r)
+}
+
+// SelectInputStream selects where the commands are read from
+func (zm *ZMachine) SelectInputStream(stream int) error {
+	switch stream {
+	case KeyboardStream:
+	case CommandFileStream:
+		if zm.input.commands == nil {
+			return fmt.Errorf("no command file to read from")
+		}
+	default:
+		return fmt.Errorf("invalid input stream %d", stream)
+	}
+
+	zm.input.stream = stream
+	return nil
+}
+
+// ReadLine reads a line from the selected input stream, when the command
+// file ends the keyboard takes over. The line is recorded by stream 4.
+func (zm *ZMachine) ReadLine() (string, error) {
+	s, _, err := zm.readLine(0, 0)
+	return s, err
+}
+
+// readLine is ReadLine with timed input: when both tenths and routine are
+// not 0 the interrupt routine is called every tenths of seconds spent
+// waiting, the read is aborted as soon as it returns true
+func (zm *ZMachine) readLine(tenths uint16, routine uint16) (string, bool, error) {
+	s, ok := zm.readCommand()
+	if !ok {
+		var err error
+		s, ok, err = zm.readDevice(tenths, routine)
+		if err != nil || !ok {
+			return "", false, err
+		}
+	}
+
+	zm.trace(TraceInfo, TraceIO, 0, "read %q", strings.TrimRight(s, "\r\n"))
+	zm.recordCommand(strings.TrimRight(s, "\r\n"))
+
+	return s, true, nil
+}
+
+func (zm *ZMachine) readDevice(tenths uint16, routine uint16) (string, bool, error) {
+	timed, ok := zm.iodev.(ZTimedReader)
+	if !ok || tenths == 0 || routine == 0 {
+		s, err := zm.iodev.ReadLine()
+		return s, err == nil, err
+	}
+
+	timeout := time.Duration(tenths) * 100 * time.Millisecond
+	for {
+		s, ok, err := timed.ReadLineTimeout(timeout)
+		if err != nil {
+			return "", false, err
+		}
+		if ok {
+			return s, true, nil
+		}
+
+		result, err := zm.callInterrupt(routine)
+		if err != nil {
+			return "", false, err
+		}
+		if result != 0 || zm.quitted {
+			return "", false, nil
+		}
+	}
+}
+
+func (zm *ZMachine) readCommand() (string, bool) {
+	if zm.input.stream != CommandFileStream {
+		return "", false
+	}
+
+	line, err := zm.input.commands.ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		if err != io.EOF {
+			zm.trace(TraceWarn, TraceIO, 0, "reading command file failed: %s", err)
+		}
+		zm.input.stream = KeyboardStream
+		return "", false
+	}
+
+	// the device echoes what is typed on the keyboard, do the same for
+	// the commands from the file
+	line = strings.TrimRight(line, "\r\n")
+	if zm.output.screen {
+		zm.iodev.Print(line + "\n")
+	}
+
+	return line, true
+}
@@ -0,0 +1,74 @@
+package gork
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestZInputStream(t *testing.T) {
+	// @input_stream 1, @input_stream 0
+	zm, dev := newTestMachine(t, newTestStory(
+		0xF4, 0x7F, 0x01,
+		0xF4, 0x7F, 0x00,
+	))
+	dev.input = []string{"keyboard"}
+
+	zm.SetCommandFile(strings.NewReader("open mailbox\r\nread leaflet"))
+	record := &bytes.Buffer{}
+	zm.SetCommandRecord(record)
+	zm.SelectOutputStream(CommandStream, true, 0)
+
+	if l, _ := zm.ReadLine(); l != "keyboard" {
+		t.Errorf("expected keyboard input before input_stream, got %q", l)
+	}
+
+	if err := zm.Interpret(); err != nil {
+		t.Fatal(err)
+	}
+	if l, _ := zm.ReadLine(); l != "open mailbox" {
+		t.Errorf("unexpected command %q", l)
+	}
+
+	// the file commands are echoed since no one typed them
+	if dev.output != "open mailbox\n" {
+		t.Errorf("unexpected echo %q", dev.output)
+	}
+
+	if err := zm.Interpret(); err != nil {
+		t.Fatal(err)
+	}
+	if l, _ := zm.ReadLine(); l != "" {
+		t.Errorf("expected keyboard input after input_stream 0, got %q", l)
+	}
+
+	if record.String() != "keyboard\nopen mailbox\n\n" {
+		t.Errorf("unexpected command record %q", record.String())
+	}
+}
+
+func TestZInputCommandFileEnd(t *testing.T) {
+	zm, dev := newTestMachine(t, newTestStory())
+	dev.input = []string{"keyboard"}
+
+	zm.SetCommandFile(strings.NewReader("north\n"))
+	if err := zm.SelectInputStream(CommandFileStream); err != nil {
+		t.Fatal(err)
+	}
+
+	if l, _ := zm.ReadLine(); l != "north" {
+		t.Errorf("unexpected command %q", l)
+	}
+
+	// the keyboard takes over when the file ends
+	if l, _ := zm.ReadLine(); l != "keyboard" {
+		t.Errorf("unexpected command %q", l)
+	}
+	if zm.input.stream != KeyboardStream {
+		t.Error("input stream not switched back to the keyboard")
+	}
+
+	if err := zm.SelectInputStream(2); err == nil {
+		t.Error("invalid input stream accepted")
+	}
+}
@@ -3,9 +3,10 @@ package gork
 import (
 	"bufio"
 	"fmt"
-	"io"
 	"os"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"golang.org/x/crypto/ssh/terminal"
@@ -13,67 +14,376 @@ import (
 
 type ZIODev interface {
 	Print(...interface{})
-	ReadLine() string
+	// ReadLine returns the next line typed by the player, an error ends
+	// the game
+	ReadLine() (string, error)
 }
 
-type ZTerminal struct{}
+// ZWindowed is implemented by the devices that support the upper window.
+// Window 0 is the lower window, window 1 is the upper one.
+type ZWindowed interface {
+	// SplitWindow resizes the upper window to lines lines, 0 removes it
+	SplitWindow(lines int)
+	// SetWindow selects the window the following output goes to
+	SetWindow(window int)
+	// EraseWindow clears window, -1 clears the whole screen. The cursor
+	// of the upper window goes to the top left corner, the one of the
+	// lower window to the bottom left corner.
+	EraseWindow(window int)
+	// SetCursor moves the cursor of the upper window, line and column
+	// are 1-based. It's ignored while the lower window is selected.
+	SetCursor(line, column int)
+}
+
+const (
+	StyleRoman   = 0
+	StyleReverse = 1
+	StyleBold    = 2
+	StyleItalic  = 4
+	StyleFixed   = 8
+)
+
+// ZStyled is implemented by the devices that can change the text style,
+// style is a combination of the Style constants, StyleRoman resets it
+type ZStyled interface {
+	SetTextStyle(style int)
+}
+
+const (
+	ColourCurrent = 0
+	ColourDefault = 1
+	ColourBlack   = 2
+	ColourRed     = 3
+	ColourGreen   = 4
+	ColourYellow  = 5
+	ColourBlue    = 6
+	ColourMagenta = 7
+	ColourCyan    = 8
+	ColourWhite   = 9
+)
 
-func (_ ZTerminal) Print(s ...interface{}) {
+// ZColoured is implemented by the devices that can change the colours of
+// the text, the values are the Colour constants and ColourCurrent leaves
+// the colour as it is
+type ZColoured interface {
+	SetColour(foreground, background int)
+}
+
+// ZSized is implemented by the devices that know the size of the screen in
+// characters, it's 0 when unknown
+type ZSized interface {
+	ScreenSize() (width, height int)
+}
+
+// ZTimedReader is implemented by the devices that can stop waiting for
+// input, as needed by the timed input of v4. It returns false if no line
+// was entered within timeout, the line being typed is returned by the
+// next read.
+type ZTimedReader interface {
+	ReadLineTimeout(timeout time.Duration) (string, bool, error)
+}
+
+// ZTerminal writes to stdout, it uses ANSI escape sequences for the status
+// line and the windows when stdout is a terminal
+type ZTerminal struct {
+	screen ansiScreen
+	stdin  *bufio.Reader
+	input  zlineReader
+}
+
+// updateSize returns false if stdout is not a terminal
+func (t *ZTerminal) updateSize() bool {
+	width, height, err := terminal.GetSize(int(os.Stdout.Fd()))
+	if err != nil {
+		return false
+	}
+
+	if width != t.screen.width || height != t.screen.height {
+		fmt.Print(t.screen.SetSize(width, height))
+	}
+	return true
+}
+
+func (t *ZTerminal) Print(s ...interface{}) {
 	for _, si := range s {
-		fmt.Print(si)
+		sis := fmt.Sprint(si)
+		t.screen.Print(sis)
+		fmt.Print(sis)
+	}
+}
+
+func (t *ZTerminal) ShowStatus(status *ZStatus) {
+	if t.updateSize() {
+		fmt.Print(t.screen.ShowStatus(status))
+	}
+}
+
+func (t *ZTerminal) SplitWindow(lines int) {
+	if t.updateSize() {
+		fmt.Print(t.screen.SplitWindow(lines))
+	}
+}
+
+func (t *ZTerminal) SetWindow(window int) {
+	if t.updateSize() {
+		fmt.Print(t.screen.SetWindow(window))
+	}
+}
+
+func (t *ZTerminal) EraseWindow(window int) {
+	if t.updateSize() {
+		fmt.Print(t.screen.EraseWindow(window))
 	}
 }
 
-func (_ ZTerminal) ReadLine() string {
-	r := bufio.NewReader(os.Stdin)
+func (t *ZTerminal) SetCursor(line, column int) {
+	if t.updateSize() {
+		fmt.Print(t.screen.SetCursor(line, column))
+	}
+}
 
-	s, err := r.ReadString('\n')
-	if err != nil && err != io.EOF {
-		panic(err)
+func (t *ZTerminal) SetTextStyle(style int) {
+	if t.updateSize() {
+		fmt.Print(t.screen.TextStyle(style))
 	}
+}
 
-	return s
+func (t *ZTerminal) SetColour(foreground, background int) {
+	if t.updateSize() {
+		fmt.Print(t.screen.Colour(foreground, background))
+	}
+}
+
+func (t *ZTerminal) ScreenSize() (int, int) {
+	if !t.updateSize() {
+		return 0, 0
+	}
+	return t.screen.width, t.screen.height
+}
+
+func (t *ZTerminal) readStdin() (string, error) {
+	if t.stdin == nil {
+		t.stdin = bufio.NewReader(os.Stdin)
+	}
+	return t.stdin.ReadString('\n')
+}
+
+func (t *ZTerminal) ReadLine() (string, error) {
+	s, _, err := t.ReadLineTimeout(0)
+	return s, err
+}
+
+// ReadLineTimeout returns io.EOF once stdin is over
+func (t *ZTerminal) ReadLineTimeout(timeout time.Duration) (string, bool, error) {
+	l, ok := t.input.next(t.readStdin, timeout)
+	return l.text, ok, l.err
 }
 
 type ZSshTerminal struct {
 	Term *terminal.Terminal
+
+	// the size is updated by the goroutine handling ssh requests
+	mu     sync.Mutex
+	screen ansiScreen
+	input  zlineReader
 }
 
-func (sshTerm ZSshTerminal) Print(s ...interface{}) {
-	for _, si := range s {
-		sis := fmt.Sprint(si)
-		sis = strings.Replace(sis, "\n", "\r\n", -1)
-		sshTerm.Term.Write([]byte(sis))
+func (sshTerm *ZSshTerminal) write(f func(screen *ansiScreen) string) {
+	sshTerm.mu.Lock()
+	defer sshTerm.mu.Unlock()
+
+	sshTerm.Term.Write([]byte(f(&sshTerm.screen)))
+}
+
+func (sshTerm *ZSshTerminal) SetSize(width, height int) {
+	sshTerm.Term.SetSize(width, height)
+	sshTerm.write(func(screen *ansiScreen) string {
+		return screen.SetSize(width, height)
+	})
+}
+
+// hasScreen tells whether the client requested a pty, without one there is
+// no room for the status line and the windows
+func (sshTerm *ZSshTerminal) hasScreen() bool {
+	sshTerm.mu.Lock()
+	defer sshTerm.mu.Unlock()
+
+	return sshTerm.screen.width > 0 && sshTerm.screen.height > 0
+}
+
+func (sshTerm *ZSshTerminal) ShowStatus(status *ZStatus) {
+	if sshTerm.hasScreen() {
+		sshTerm.write(func(screen *ansiScreen) string {
+			return screen.ShowStatus(status)
+		})
+	}
+}
+
+func (sshTerm *ZSshTerminal) SplitWindow(lines int) {
+	if sshTerm.hasScreen() {
+		sshTerm.write(func(screen *ansiScreen) string {
+			return screen.SplitWindow(lines)
+		})
 	}
 }
 
-func (sshTerm ZSshTerminal) ReadLine() string {
-	l, err := sshTerm.Term.ReadLine()
+func (sshTerm *ZSshTerminal) SetWindow(window int) {
+	if sshTerm.hasScreen() {
+		sshTerm.write(func(screen *ansiScreen) string {
+			return screen.SetWindow(window)
+		})
+	}
+}
 
-	if err != nil {
-		panic(err)
+func (sshTerm *ZSshTerminal) EraseWindow(window int) {
+	if sshTerm.hasScreen() {
+		sshTerm.write(func(screen *ansiScreen) string {
+			return screen.EraseWindow(window)
+		})
+	}
+}
+
+func (sshTerm *ZSshTerminal) SetCursor(line, column int) {
+	if sshTerm.hasScreen() {
+		sshTerm.write(func(screen *ansiScreen) string {
+			return screen.SetCursor(line, column)
+		})
 	}
+}
+
+func (sshTerm *ZSshTerminal) SetTextStyle(style int) {
+	sshTerm.write(func(screen *ansiScreen) string {
+		return screen.TextStyle(style)
+	})
+}
+
+func (sshTerm *ZSshTerminal) SetColour(foreground, background int) {
+	sshTerm.write(func(screen *ansiScreen) string {
+		return screen.Colour(foreground, background)
+	})
+}
+
+func (sshTerm *ZSshTerminal) ScreenSize() (int, int) {
+	sshTerm.mu.Lock()
+	defer sshTerm.mu.Unlock()
+
+	return sshTerm.screen.width, sshTerm.screen.height
+}
+
+func (sshTerm *ZSshTerminal) Print(s ...interface{}) {
+	for _, si := range s {
+		sis := fmt.Sprint(si)
+		sshTerm.write(func(screen *ansiScreen) string {
+			screen.Print(sis)
+			// the terminal is in raw mode
+			return strings.Replace(sis, "\n", "\r\n", -1)
+		})
+	}
+}
 
-	return l
+func (sshTerm *ZSshTerminal) ReadLine() (string, error) {
+	s, _, err := sshTerm.ReadLineTimeout(0)
+	return s, err
 }
 
+func (sshTerm *ZSshTerminal) ReadLineTimeout(timeout time.Duration) (string, bool, error) {
+	l, ok := sshTerm.input.next(sshTerm.Term.ReadLine, timeout)
+	return l.text, ok, l.err
+}
+
+// ZWSDev sends every output as a JSON message, the type field tells
+// what the other fields are:
+//
+//	{"type": "print", "window": 0, "text": "..."}
+//	{"type": "status", "status": {"location": "...", "score": 0, ...}}
+//	{"type": "split", "lines": 3}
+//	{"type": "erase", "window": 1}
+//	{"type": "cursor", "line": 1, "column": 1}
+//	{"type": "style", "style": 2}
+//	{"type": "colour", "foreground": 3, "background": 2}
+//	{"type": "session", "session": "..."}
+//
+// window is 0 for the lower window and 1 for the upper one (-1 in erase
+// means the whole screen), split resizes the upper window, cursor moves
+// the cursor of the upper window and style is a combination of the Style
+// constants, colour uses the Colour constants. session is sent by the
+// server to tell the client the token of its save slots.
 type ZWSDev struct {
-	Conn *websocket.Conn
+	Conn   *websocket.Conn
+	window int
+	input  zlineReader
+}
+
+type zwsMessage struct {
+	Type       string   `json:"type"`
+	Window     *int     `json:"window,omitempty"`
+	Text       string   `json:"text,omitempty"`
+	Status     *ZStatus `json:"status,omitempty"`
+	Lines      *int     `json:"lines,omitempty"`
+	Line       *int     `json:"line,omitempty"`
+	Column     *int     `json:"column,omitempty"`
+	Style      *int     `json:"style,omitempty"`
+	Foreground *int     `json:"foreground,omitempty"`
+	Background *int     `json:"background,omitempty"`
+	Session    string   `json:"session,omitempty"`
 }
 
 func (ws *ZWSDev) Print(s ...interface{}) {
 	for _, si := range s {
-		sis := fmt.Sprint(si)
-		ws.Conn.WriteMessage(websocket.TextMessage, []byte(sis))
+		window := ws.window
+		ws.Conn.WriteJSON(&zwsMessage{Type: "print", Window: &window, Text: fmt.Sprint(si)})
 	}
 }
 
-func (ws *ZWSDev) ReadLine() string {
-	msg_type, l, err := ws.Conn.ReadMessage()
+func (ws *ZWSDev) SplitWindow(lines int) {
+	ws.Conn.WriteJSON(&zwsMessage{Type: "split", Lines: &lines})
+}
+
+func (ws *ZWSDev) SetWindow(window int) {
+	ws.window = window
+}
+
+func (ws *ZWSDev) EraseWindow(window int) {
+	ws.Conn.WriteJSON(&zwsMessage{Type: "erase", Window: &window})
+}
+
+func (ws *ZWSDev) SetCursor(line, column int) {
+	ws.Conn.WriteJSON(&zwsMessage{Type: "cursor", Line: &line, Column: &column})
+}
 
-	if msg_type != websocket.TextMessage || err != nil {
-		panic(err)
+func (ws *ZWSDev) SetTextStyle(style int) {
+	ws.Conn.WriteJSON(&zwsMessage{Type: "style", Style: &style})
+}
+
+func (ws *ZWSDev) SetColour(foreground, background int) {
+	ws.Conn.WriteJSON(&zwsMessage{Type: "colour", Foreground: &foreground, Background: &background})
+}
+
+// SendSession tells the client the token it can reconnect with to get its
+// saves back
+func (ws *ZWSDev) SendSession(session string) {
+	ws.Conn.WriteJSON(&zwsMessage{Type: "session", Session: session})
+}
+
+func (ws *ZWSDev) ShowStatus(status *ZStatus) {
+	ws.Conn.WriteJSON(&zwsMessage{Type: "status", Status: status})
+}
+
+func (ws *ZWSDev) readMessage() (string, error) {
+	msg_type, l, err := ws.Conn.ReadMessage()
+	if err == nil && msg_type != websocket.TextMessage {
+		err = fmt.Errorf("unexpected message type %d", msg_type)
 	}
 
-	return string(l)
+	return string(l), err
+}
+
+func (ws *ZWSDev) ReadLine() (string, error) {
+	s, _, err := ws.ReadLineTimeout(0)
+	return s, err
+}
+
+func (ws *ZWSDev) ReadLineTimeout(timeout time.Duration) (string, bool, error) {
+	l, ok := ws.input.next(ws.readMessage, timeout)
+	return l.text, ok, l.err
 }
@@ -0,0 +1,63 @@
+package gork
+
+import (
+	"sync"
+	"time"
+)
+
+type zline struct {
+	text string
+	err  error
+}
+
+// zlineReader reads the lines in a goroutine, so that a read can time out
+// without losing the line the player is typing: it's delivered by the
+// next read
+type zlineReader struct {
+	once  sync.Once
+	lines chan zline
+	// set before lines is closed
+	err error
+}
+
+func (r *zlineReader) loop(read func() (string, error)) {
+	for {
+		s, err := read()
+		if err != nil {
+			r.err = err
+			if s != "" {
+				r.lines <- zline{text: s}
+			}
+			close(r.lines)
+			return
+		}
+		r.lines <- zline{text: s}
+	}
+}
+
+// next returns the next line read by read, a timeout <= 0 waits forever.
+// It returns false if the timeout expires first.
+func (r *zlineReader) next(read func() (string, error), timeout time.Duration) (zline, bool) {
+	r.once.Do(func() {
+		r.lines = make(chan zline)
+		go r.loop(read)
+	})
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	select {
+	case l, ok := <-r.lines:
+		if !ok {
+			// the error is returned by every read after the last line
+			return zline{err: r.err}, true
+		}
+		return l, true
+	case <-expired:
+		return zline{}, false
+	}
+}
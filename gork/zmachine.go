@@ -1,6 +1,52 @@
 package gork
 
-import "fmt"
+import (
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+const (
+	flags1Pos = uint32(0x01)
+	// v3 bits of Flags 1 telling which features the interpreter has
+	flags1NoStatusLine = byte(0x10)
+	flags1SplitScreen  = byte(0x20)
+	// v4 bits of Flags 1 telling which features the interpreter has
+	flags1Styles    = byte(0x04 | 0x08 | 0x10)
+	flags1TimedRead = byte(0x80)
+	screenHeightPos = uint32(0x20)
+	screenWidthPos  = uint32(0x21)
+	// the screen size when the device doesn't know it, 255 lines means
+	// the screen is infinite
+	defaultScreenWidth  = 80
+	defaultScreenHeight = 255
+
+	// Flags 2 is the word at 0x10, the bits owned by the interpreter are
+	// in its low byte
+	flags2Pos = uint32(0x11)
+	// the transcript and fixed pitch bits of Flags 2 belong to the
+	// interpreter and they survive a restore or a restart
+	flags2Preserved = byte(0x03)
+	// the bits of Flags 2 the story can change: transcript, fixed pitch
+	// and status line redraw
+	flags2Story   = byte(0x07)
+	checksumStart = uint32(0x40)
+
+	// v5 header fields
+	flags1Colours        = byte(0x01)
+	screenWidthUnitsPos  = uint32(0x22)
+	screenHeightUnitsPos = uint32(0x24)
+	fontWidthPos         = uint32(0x26)
+	fontHeightPos        = uint32(0x27)
+	defaultBgPos         = uint32(0x2C)
+	defaultFgPos         = uint32(0x2D)
+	// pictures, mouse and sounds, which aren't supported
+	flags2Unsupported = byte(0x08 | 0x20 | 0x80)
+
+	// fonts of set_font, there are no picture or character graphics ones
+	normalFont = uint16(1)
+	fixedFont  = uint16(4)
+)
 
 // bottom is in #0
 // top is in #len(stack-1)
@@ -21,158 +67,472 @@ func (zstack *ZStack) Top() *ZRoutine {
 	return (*zstack)[len(*zstack)-1]
 }
 
-type ZLogger interface {
-	Print(...interface{})
-	Printf(string, ...interface{})
-	Panic(...interface{})
-}
-
 type ZMachine struct {
 	header *ZHeader
 	// pc is seq.pos
 	seq        *ZMemorySequential
-	objects    []*ZObject
+	objects    *ZObjectTable
 	dictionary *ZDictionary
 	iodev      ZIODev
+	saves      ZSaveStore
 	stack      ZStack
-	logger     ZLogger
+	tracer     ZTracer
 	quitted    bool
+	story      *ZStory
+	// window currently selected, 0 is the lower one
+	window int
+	output zoutput
+	input  zinput
+	// every machine has its own generator so that seeding one doesn't
+	// affect the others
+	rand   *rand.Rand
+	seed   int64
+	seeded bool
+	// value returned by the last interrupt routine
+	interruptResult uint16
+	// v5 font selected by set_font
+	font uint16
+	// state saved by save_undo in Quetzal format, nil if there is none
+	undo []byte
+
+	// the decoded instructions of static and high memory by PC, the ones
+	// in dynamic memory can change so they are always decoded
+	ops map[uint32]*ZOp
+	// the instruction being executed and its operands
+	op   *ZOp
+	args [8]uint16
+	// the events the tracer receives
+	traceLevel      ZTraceLevel
+	traceCategories ZTraceCategory
+	// the basic blocks compiled by the compiler engine, nil when the
+	// machine runs with the interpreter
+	compiler *zcompiler
 }
 
-func NewZMachine(mem *ZMemory, header *ZHeader, iodev ZIODev, logger ZLogger) (*ZMachine, error) {
-	// cache objects
-	count, err := ZObjectsCount(mem, header)
-	if err != nil {
-		return nil, err
-	}
-
-	objects := make([]*ZObject, count)
+// NewZMachine creates a machine playing story, the tracer receives the
+// warnings and errors until SetTracing selects other events, it may be nil
+func NewZMachine(story *ZStory, iodev ZIODev, saves ZSaveStore, tracer ZTracer) (_ *ZMachine, err error) {
+	// the dictionary and the object table may point out of the story
+	defer recoverFault(&err)
 
-	for i := uint8(1); i <= count; i++ {
-		// objects are 1-based
-		obj, err := NewZObject(mem, i, header)
-		if err != nil {
-			return nil, err
-		}
-		objects[i-1] = obj
-	}
+	mem := story.NewMemory()
+	header := story.header
 
 	stack := ZStack{}
 	stack.Push(MainRoutine(mem, header))
 
-	return &ZMachine{
+	zm := &ZMachine{
 		header:     header,
 		seq:        mem.GetSequential(uint32(header.pc)),
-		objects:    objects,
 		dictionary: NewZDictionary(mem, header),
 		iodev:      iodev,
-		logger:     logger,
+		saves:      saves,
+		tracer:     tracer,
 		quitted:    false,
 		stack:      stack,
-	}, nil
+		story:      story,
+		output:     zoutput{screen: true},
+		rand:       rand.New(rand.NewSource(time.Now().UnixNano())),
+		font:       normalFont,
+		ops:        make(map[uint32]*ZOp),
+
+		traceLevel:      TraceWarn,
+		traceCategories: TraceAll,
+	}
+
+	if err := zm.loadObjects(); err != nil {
+		return nil, err
+	}
+	zm.setInterpreterHeader()
+
+	return zm, nil
+}
+
+// setInterpreterHeader fills the fields of the header owned by the
+// interpreter, they must be set again whenever dynamic memory is replaced
+func (zm *ZMachine) setInterpreterHeader() {
+	mem := zm.seq.mem
+
+	if zm.header.version < 4 {
+		flags1 := mem.ByteAt(flags1Pos) &^ (flags1NoStatusLine | flags1SplitScreen)
+		if _, ok := zm.iodev.(ZStatusBar); !ok {
+			flags1 |= flags1NoStatusLine
+		}
+		if _, ok := zm.iodev.(ZWindowed); ok {
+			flags1 |= flags1SplitScreen
+		}
+		mem.writeByte(flags1Pos, flags1)
+		return
+	}
+
+	flags1 := mem.ByteAt(flags1Pos) &^ (flags1Styles | flags1TimedRead)
+	if _, ok := zm.iodev.(ZStyled); ok {
+		flags1 |= flags1Styles
+	}
+	if _, ok := zm.iodev.(ZTimedReader); ok {
+		flags1 |= flags1TimedRead
+	}
+	mem.writeByte(flags1Pos, flags1)
+
+	width, height := defaultScreenWidth, defaultScreenHeight
+	if sized, ok := zm.iodev.(ZSized); ok {
+		if w, h := sized.ScreenSize(); w > 0 && h > 0 {
+			width, height = w, h
+		}
+	}
+	if width > 255 {
+		width = 255
+	}
+	if height > 255 {
+		height = 255
+	}
+	mem.writeByte(screenHeightPos, byte(height))
+	mem.writeByte(screenWidthPos, byte(width))
+
+	if zm.header.version < 5 {
+		return
+	}
+
+	// the screen is measured in characters of 1x1 units
+	mem.writeHeaderWord(screenWidthUnitsPos, uint16(width))
+	mem.writeHeaderWord(screenHeightUnitsPos, uint16(height))
+	mem.writeByte(fontWidthPos, 1)
+	mem.writeByte(fontHeightPos, 1)
+
+	if _, ok := zm.iodev.(ZColoured); ok {
+		mem.writeByte(flags1Pos, mem.ByteAt(flags1Pos)|flags1Colours)
+		mem.writeByte(defaultBgPos, ColourBlack)
+		mem.writeByte(defaultFgPos, ColourWhite)
+	}
+
+	// tell the story not to use what the interpreter can't do
+	mem.writeByte(flags2Pos, mem.ByteAt(flags2Pos)&^flags2Unsupported)
+}
+
+// loadObjects (re)builds the object table, the object count depends on
+// the property tables so it must be called whenever dynamic memory is
+// replaced
+func (zm *ZMachine) loadObjects() error {
+	objects, err := NewZObjectTable(zm.seq.mem, zm.header)
+	if err != nil {
+		return err
+	}
+
+	zm.objects = objects
+	return nil
+}
+
+// object returns the object id of the story, a story using an invalid
+// object is broken
+func (zm *ZMachine) object(id uint16) *ZObject {
+	obj, err := zm.objects.Object(id)
+	if err != nil {
+		zm.fail(err)
+	}
+	return obj
+}
+
+// nullObject tells whether id is object 0, it doesn't exist but some
+// stories use it anyway and expect nothing to be there: reading it gives
+// 0 or false and changing it does nothing
+func (zm *ZMachine) nullObject(id uint16) bool {
+	if id != NULL_OBJECT_INDEX {
+		return false
+	}
+	zm.trace(TraceWarn, TraceObjects, 0, "using object 0")
+	return true
+}
+
+func (zm *ZMachine) dynMem() []byte {
+	return zm.seq.mem.dyn
+}
+
+// replaceDynMem overwrites dynamic memory with dyn preserving the bits of
+// Flags 2 owned by the interpreter, then it reloads the objects
+func (zm *ZMachine) replaceDynMem(dyn []byte) error {
+	flags2 := zm.seq.mem.ByteAt(flags2Pos)
+	copy(zm.dynMem(), dyn)
+	if zm.compiler != nil {
+		zm.compiler.invalidate()
+	}
+
+	newFlags2 := zm.seq.mem.ByteAt(flags2Pos)&^flags2Preserved | flags2&flags2Preserved
+	zm.seq.mem.writeByte(flags2Pos, newFlags2)
+	zm.setInterpreterHeader()
+
+	return zm.loadObjects()
+}
+
+// Reset brings the machine back to the state it had when the story
+// started, as required by restart
+func (zm *ZMachine) Reset() error {
+	zm.stack = ZStack{}
+	zm.stack.Push(MainRoutine(zm.seq.mem, zm.header))
+	zm.seq.pos = uint32(zm.header.pc)
+	zm.quitted = false
+	zm.font = normalFont
+	zm.undo = nil
+
+	// memory streams are closed without writing their tables
+	zm.output.tables = nil
+
+	// the story starts without the upper window
+	zm.SplitWindow(0)
+	zm.SetWindow(0)
+
+	return zm.replaceDynMem(zm.story.dynMem())
+}
+
+// SeedRandom makes the random numbers predictable, even when the story
+// asks for a random seed
+func (zm *ZMachine) SeedRandom(seed int64) {
+	zm.seed = seed
+	zm.seeded = true
+	zm.rand.Seed(seed)
+}
+
+func (zm *ZMachine) SplitWindow(lines int) {
+	if windowed, ok := zm.iodev.(ZWindowed); ok {
+		windowed.SplitWindow(lines)
+	}
+
+	if lines == 0 {
+		zm.SetWindow(0)
+	} else if zm.header.version < 4 {
+		// v3 the upper window is cleared when it's created
+		zm.EraseWindow(1)
+	}
+}
+
+// EraseWindow clears window, -1 also removes the upper window and -2 keeps
+// it clearing the whole screen
+func (zm *ZMachine) EraseWindow(window int) {
+	if window == -1 {
+		zm.SplitWindow(0)
+	}
+	if window == -2 {
+		window = -1
+	}
+
+	if window < -1 || window > 1 {
+		zm.trace(TraceWarn, TraceIO, 0, "ignoring erase of invalid window %d", window)
+		return
+	}
+
+	if windowed, ok := zm.iodev.(ZWindowed); ok {
+		windowed.EraseWindow(window)
+	}
+}
+
+// SetCursor moves the cursor of the upper window
+func (zm *ZMachine) SetCursor(line, column int) {
+	if windowed, ok := zm.iodev.(ZWindowed); ok {
+		windowed.SetCursor(line, column)
+	}
 }
 
+func (zm *ZMachine) SetTextStyle(style int) {
+	if styled, ok := zm.iodev.(ZStyled); ok {
+		styled.SetTextStyle(style)
+	}
+}
+
+// SetColour changes the colours of the following text, the values are the
+// Colour constants
+func (zm *ZMachine) SetColour(foreground, background int) {
+	if coloured, ok := zm.iodev.(ZColoured); ok {
+		coloured.SetColour(foreground, background)
+	}
+}
+
+// callInterrupt runs the routine at the packed address routine until it
+// returns and gives back its result, it's used for the interrupts of timed
+// input which are called by the interpreter rather than by the story
+func (zm *ZMachine) callInterrupt(routine uint16) (uint16, error) {
+	if routine == 0 {
+		return 0, nil
+	}
+
+	// the instruction waiting for the interrupt goes on afterwards
+	op, args := zm.op, zm.args
+	defer func() {
+		zm.op, zm.args = op, args
+	}()
+
+	depth := len(zm.stack)
+	zm.call([]uint16{routine}).interrupt = true
+
+	for len(zm.stack) > depth && !zm.quitted {
+		if err := zm.Interpret(); err != nil {
+			return 0, err
+		}
+	}
+
+	return zm.interruptResult, nil
+}
+
+// SetWindow selects the window the output goes to, there are only the lower
+// window (0) and the upper one (1) in v3
+func (zm *ZMachine) SetWindow(window int) {
+	if window != 0 && window != 1 {
+		zm.trace(TraceWarn, TraceIO, 0, "ignoring invalid window %d", window)
+		return
+	}
+
+	zm.window = window
+	if windowed, ok := zm.iodev.(ZWindowed); ok {
+		windowed.SetWindow(window)
+	}
+}
+
+// Checksum computes the checksum of the story file as it was loaded, that
+// is the sum of all the bytes after the header modulo 0x10000
+func (zm *ZMachine) Checksum() uint16 {
+	end := uint32(zm.header.fileLength)
+	if end > uint32(len(zm.story.buf)) {
+		end = uint32(len(zm.story.buf))
+	}
+	if end < checksumStart {
+		return 0
+	}
+
+	sum := uint16(0)
+	for _, b := range zm.story.buf[checksumStart:end] {
+		sum += uint16(b)
+	}
+
+	return sum
+}
+
+// GetVarAt reads a variable as an operand does, the variable 0 pops the
+// top of the evaluation stack
 func (zm *ZMachine) GetVarAt(varnum byte) uint16 {
 	if varnum == 0 {
-		// top of stack
-		return zm.stack.Top().locals[len(zm.stack.Top().locals)-1]
-	} else if varnum < 0x10 {
-		// local variable
-		return zm.stack.Top().locals[varnum-1]
-	} else {
-		// global variable
-		globalAddr := uint32(zm.header.globalsPos) + uint32(varnum-0x10)*2
-		return zm.seq.mem.WordAt(globalAddr)
+		return zm.pop()
 	}
+	return zm.IndirectVarAt(varnum)
 }
 
+// StoreVarAt writes a variable as a store does, the variable 0 pushes val
+// onto the evaluation stack
 func (zm *ZMachine) StoreVarAt(varnum byte, val uint16) {
 	if varnum == 0 {
-		// push to top of the stack
-		topRoutinelocals := &zm.stack.Top().locals
-		*topRoutinelocals = append(*topRoutinelocals, val)
+		zm.push(val)
+		return
+	}
+	zm.SetIndirectVarAt(varnum, val)
+}
+
+// IndirectVarAt reads a variable referenced by an operand, like load does:
+// the variable 0 is the top of the evaluation stack, which is not popped
+func (zm *ZMachine) IndirectVarAt(varnum byte) uint16 {
+	if varnum == 0 {
+		v, err := zm.stack.Top().peek()
+		if err != nil {
+			zm.fail(err)
+		}
+		return v
 	} else if varnum < 0x10 {
 		// local variable
-		// starting from 0
-		zm.stack.Top().locals[varnum-1] = val
+		return *zm.local(varnum)
 	} else {
 		// global variable
-		// globals table is a table of 240 words
 		globalAddr := uint32(zm.header.globalsPos) + uint32(varnum-0x10)*2
-		zm.seq.mem.WriteWordAt(globalAddr, val)
+		return zm.seq.mem.WordAt(globalAddr)
 	}
 }
 
-func (zm *ZMachine) UpdateVarAt(varnum byte, val int16) uint16 {
-	newValue := uint16(0)
+// SetIndirectVarAt writes a variable referenced by an operand, like store
+// does: the variable 0 replaces the top of the evaluation stack
+func (zm *ZMachine) SetIndirectVarAt(varnum byte, val uint16) {
 	if varnum == 0 {
-		// top of the stack
-		newValue = uint16(int16(zm.stack.Top().locals[len(zm.stack.Top().locals)-1]) + val)
-		zm.stack.Top().locals[len(zm.stack.Top().locals)-1] = newValue
+		zm.pop()
+		zm.push(val)
 	} else if varnum < 0x10 {
 		// local variable
-		// starting from 0
-		zm.stack.Top().locals[varnum-1] += uint16(val)
-		newValue = zm.stack.Top().locals[varnum-1]
+		*zm.local(varnum) = val
 	} else {
 		// global variable
 		// globals table is a table of 240 words
 		globalAddr := uint32(zm.header.globalsPos) + uint32(varnum-0x10)*2
-		newValue = zm.seq.mem.WordAt(globalAddr) + uint16(val)
-		zm.seq.mem.WriteWordAt(globalAddr, newValue)
+		zm.seq.mem.WriteWordAt(globalAddr, val)
 	}
-	return newValue
 }
 
-func (zm *ZMachine) StoreReturn(val uint16) {
-	varnum := zm.seq.ReadByte()
-	zm.StoreVarAt(varnum, val)
+// UpdateVarAt adds val to an indirect variable and returns its new value
+func (zm *ZMachine) UpdateVarAt(varnum byte, val int16) uint16 {
+	newValue := uint16(int16(zm.IndirectVarAt(varnum)) + val)
+	zm.SetIndirectVarAt(varnum, newValue)
+	return newValue
 }
 
-func (zm *ZMachine) Branch(conditionOk bool) {
-	info := zm.seq.ReadByte()
+func (zm *ZMachine) local(n byte) *uint16 {
+	local, err := zm.stack.Top().local(n)
+	if err != nil {
+		zm.fail(err)
+	}
+	return local
+}
 
-	// if bit #7 is set than branch on true
-	branchOnTrue := (info >> 7) != 0x00
+func (zm *ZMachine) push(val uint16) {
+	if err := zm.stack.Top().push(val); err != nil {
+		zm.fail(err)
+	}
+}
 
-	// offset is relative to current PC and it can be negative
-	var offset int32
+func (zm *ZMachine) pop() uint16 {
+	v, err := zm.stack.Top().pop()
+	if err != nil {
+		zm.fail(err)
+	}
+	return v
+}
 
-	// if bit #6 is set than the offset is stored in the bottom
-	// 6 bits
-	if info&0x40 != 0x00 {
-		offset = int32(info & 0x3F)
-	} else {
-		// if bit #6 is clear than the offset is store in a 14 bit signed
-		// integer composed by the bottom 5 bits of info and 8 bits of an
-		// additional byte
-		firstPart := uint16(info & 0x3F)
-
-		// if sign bit(#6) is set then it's a negative number
-		// in two complement form, so set the bits #6 and #7 too
-		if firstPart&0x20 != 0x00 {
-			firstPart |= 0x3 << 6
-		}
+// StoreReturn stores the result of the current instruction
+func (zm *ZMachine) StoreReturn(val uint16) {
+	zm.StoreVarAt(zm.op.store, val)
+}
 
-		offset = int32(int16(firstPart<<8) | int16(zm.seq.ReadByte()))
-	}
+// Branch follows the branch of the current instruction if conditionOk
+// matches its condition
+func (zm *ZMachine) Branch(conditionOk bool) {
+	branch := zm.op.branch
 
 	// jump if conditionOk and branchOnTrue are both true or false
-	if conditionOk == branchOnTrue {
-		if offset == 0 {
+	if conditionOk == branch.onTrue {
+		if branch.offset == 0 {
 			// offset of 0 means return false from current routine
 			ZReturnFalse(zm)
-		} else if offset == 1 {
+		} else if branch.offset == 1 {
 			// offset of 1 means return false from current routine
 			ZReturnTrue(zm)
 		} else {
 			// otherwise we move to instruction to the given offset
-			zm.seq.pos = zm.CalcJumpAddress(offset)
-			zm.logger.Printf("Jumping to address: %X offset: %X\n", zm.seq.pos, offset)
+			zm.seq.pos = zm.CalcJumpAddress(branch.offset)
+			if zm.traces(TraceDebug, TraceBranches) {
+				zm.trace(TraceDebug, TraceBranches, zm.seq.pos, "branch offset %d", branch.offset)
+			}
 		}
 	}
 }
 
+// resumeSave makes the save instruction at which a game has been restored
+// the current one, the PC points to its trailers
+func (zm *ZMachine) resumeSave() {
+	op := &ZOp{zm: zm, name: "ZSave", pc: zm.seq.pos, trailers: zm.seq.pos}
+	// it branches up to v3 and stores from v4
+	if zm.header.version < 4 {
+		op.shape = opBranch
+		op.branch = zm.seq.readBranch()
+	} else {
+		op.shape = opStore
+		op.store = zm.seq.ReadUint8()
+	}
+	op.next = zm.seq.pos
+
+	zm.op = op
+}
+
 func (zm *ZMachine) CalcJumpAddress(offset int32) uint32 {
 	// Address after branch data + Offset - 2
 	return uint32(int64(zm.seq.pos) + int64(offset) - 2)
@@ -181,35 +541,39 @@ func (zm *ZMachine) CalcJumpAddress(offset int32) uint32 {
 func (zm *ZMachine) InterpretAll() error {
 	var err error = nil
 	for err == nil && !zm.quitted {
-		err = zm.Interpret()
+		err = zm.Step()
 	}
 	return err
 }
 
-func (zm *ZMachine) Interpret() error {
-	tmpPc := zm.seq.pos
-	op, err := NewZOp(zm)
-	if err != nil {
-		return err
-	}
-	zm.logger.Printf("Interpreting instruction at PC %X\n%s", tmpPc, op)
-
-	switch op.class {
-	case ZEROOP:
-		zeroOpFuncs[op.opcode](zm)
-	case ONEOP:
-		oneOpFuncs[op.opcode](zm, op.operands[0])
-	case TWOOP:
-		if op.opcode == 1 {
-			// ZJe is a two op func but it accepts VAR count of args,
-			// so we must handle separetly
-			ZJe(zm, op.operands)
-		} else {
-			twoOpFuncs[op.opcode](zm, op.operands[0], op.operands[1])
+// Interpret runs the instruction at PC, a *ZRuntimeError is returned if the
+// story can't go on
+func (zm *ZMachine) Interpret() (err error) {
+	pc := zm.seq.pos
+	var op *ZOp
+	defer func() {
+		if r := recover(); r != nil {
+			err = zm.runtimeError(pc, op, r)
+		}
+	}()
+
+	op = zm.ops[pc]
+	if op == nil {
+		op, err = NewZOp(zm)
+		if err != nil {
+			return zm.runtimeError(pc, op, err)
+		}
+		if pc >= uint32(zm.header.dynMemSize) {
+			zm.ops[pc] = op
 		}
-	case VAROP:
-		varOpFuncs[op.opcode](zm, op.operands)
 	}
+	zm.op = op
+	if zm.traces(TraceDebug, TraceInstructions) {
+		zm.trace(TraceDebug, TraceInstructions, 0, "")
+	}
+	zm.seq.pos = op.next
+	op.exec(zm)
+
 	return nil
 }
 
@@ -219,7 +583,7 @@ func (zm *ZMachine) String() string {
 
 	ret += fmt.Sprintf("PC: %X\n", zm.seq.pos)
 	ret += fmt.Sprintf("Stack: %s\n", zm.stack)
-	ret += fmt.Sprintf("Quitted: %b\n", zm.quitted)
+	ret += fmt.Sprintf("Quitted: %t\n", zm.quitted)
 
 	return ret
 }
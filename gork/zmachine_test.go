@@ -1,6 +1,9 @@
 package gork
 
-import "testing"
+import (
+	"fmt"
+	"testing"
+)
 
 var someRoutines []*ZRoutine = []*ZRoutine{
 	&ZRoutine{
@@ -44,3 +47,347 @@ func TestZStackPop(t *testing.T) {
 	}
 
 }
+
+const (
+	testObjTblPos   = 0x40
+	testObjTblPosV4 = 0x200
+	testGlobalsPos  = 0x90
+	testDynMemSize  = 0x300
+	testDictPos     = 0x300
+	testPC          = 0x304
+)
+
+// newTestStory builds a minimal v3 story with a single object, an empty
+// dictionary and some code at testPC
+func newTestStory(code ...byte) []byte {
+	return newTestStoryVersion(3, code...)
+}
+
+// newTestStoryVersion is newTestStory for other versions, from v4 the
+// object table is at testObjTblPosV4 because it doesn't fit before the
+// globals
+func newTestStoryVersion(version byte, code ...byte) []byte {
+	story := make([]byte, testPC)
+
+	format := zobjectFormatV3
+	objTblPos := testObjTblPos
+	if version >= 4 {
+		format = zobjectFormatV4
+		objTblPos = testObjTblPosV4
+	}
+
+	story[0x00] = version
+	story[0x04], story[0x05] = 0x03, 0x04 // high memory
+	story[0x06], story[0x07] = 0x03, 0x04 // initial PC
+	story[0x08], story[0x09] = 0x03, 0x00 // dictionary
+	story[0x0A], story[0x0B] = byte(objTblPos>>8), byte(objTblPos)
+	story[0x0C], story[0x0D] = 0x00, testGlobalsPos
+	story[0x0E], story[0x0F] = 0x03, 0x00 // dynamic memory size
+	copy(story[0x12:], "161018")
+
+	// object #1 after the default properties, its properties table
+	// has the name "zork" and no properties
+	obj := objTblPos + int(format.defaultsSize())
+	props := obj + int(format.size)
+	story[obj+int(format.propertyOffset)] = byte(props >> 8)
+	story[obj+int(format.propertyOffset)+1] = byte(props)
+	copy(story[props:], []byte{2, 0x7E, 0x97, 0xC0, 0xA5, 0})
+
+	// dictionary without separators and words
+	story[testDictPos+1] = 4
+
+	story = append(story, code...)
+
+	// the file length is stored divided by the scale of packed addresses
+	scale := int((&ZHeader{version: version}).packedScale())
+	for len(story)%scale != 0 {
+		story = append(story, 0)
+	}
+	length := len(story) / scale
+	story[0x1A], story[0x1B] = byte(length>>8), byte(length)
+
+	return story
+}
+
+type testIODev struct {
+	input  []string
+	output string
+}
+
+func (dev *testIODev) Print(s ...interface{}) {
+	for _, si := range s {
+		dev.output += fmt.Sprint(si)
+	}
+}
+
+func (dev *testIODev) ReadLine() (string, error) {
+	if len(dev.input) == 0 {
+		return "", nil
+	}
+	l := dev.input[0]
+	dev.input = dev.input[1:]
+	return l, nil
+}
+
+func newTestMachine(t *testing.T, buf []byte) (*ZMachine, *testIODev) {
+	story, err := NewZStory(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dev := &testIODev{}
+	zm, err := NewZMachine(story, dev, NewZMemorySaveStore(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return zm, dev
+}
+
+func TestZMachineReset(t *testing.T) {
+	zm, _ := newTestMachine(t, newTestStory(0xB7))
+
+	zm.StoreVarAt(0x10, 42)
+	zm.StoreVarAt(0, 73)
+	zm.stack.Push(&ZRoutine{retAddr: testPC, locals: []uint16{1}})
+	zm.seq.mem.WriteByteAt(flags2Pos, 0x07)
+	zm.object(1).setParent(1)
+	zm.seq.pos = testPC + 1
+
+	// @restart
+	zm.seq.pos = testPC
+	if err := zm.Interpret(); err != nil {
+		t.Fatal(err)
+	}
+
+	if zm.seq.pos != testPC || len(zm.stack) != 1 || len(zm.stack.Top().stack) != 0 {
+		t.Errorf("restart did not reset PC and stack: %s", zm)
+	}
+
+	if zm.GetVarAt(0x10) != 0 {
+		t.Error("restart did not reset globals")
+	}
+
+	// only the transcript and fixed pitch bits survive
+	if zm.seq.mem.ByteAt(flags2Pos) != 0x03 {
+		t.Errorf("unexpected Flags 2 %X", zm.seq.mem.ByteAt(flags2Pos))
+	}
+
+	if zm.object(1).ParentId() != NULL_OBJECT_INDEX {
+		t.Error("restart did not reload objects")
+	}
+}
+
+func TestZQuit(t *testing.T) {
+	// @quit, the following instruction must not be executed
+	zm, _ := newTestMachine(t, newTestStory(0xBA, 0xB7))
+
+	if err := zm.InterpretAll(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !zm.quitted || zm.seq.pos != testPC+1 {
+		t.Fail()
+	}
+}
+
+func TestZVerify(t *testing.T) {
+	// @verify ?~fail, @quit
+	story := newTestStory(0xBD, 0x40, 0xBA, 0x00)
+
+	sum := uint16(0)
+	for _, b := range story[0x40:] {
+		sum += uint16(b)
+	}
+	story[0x1C], story[0x1D] = byte(sum>>8), byte(sum)
+
+	zm, _ := newTestMachine(t, story)
+
+	// changes to dynamic memory do not affect the checksum
+	zm.StoreVarAt(0x10, 0xFFFF)
+
+	if zm.Checksum() != sum {
+		t.Errorf("checksum %X, expected %X", zm.Checksum(), sum)
+	}
+
+	if err := zm.Interpret(); err != nil {
+		t.Fatal(err)
+	}
+	if zm.seq.pos != testPC+2 {
+		t.Error("verify failed on a correct story")
+	}
+
+	zm.header.fileChecksum++
+	zm.seq.pos = testPC
+	zm.stack.Push(&ZRoutine{retAddr: testPC + 3, locals: []uint16{}})
+	if err := zm.Interpret(); err != nil {
+		t.Fatal(err)
+	}
+	if len(zm.stack) != 1 {
+		t.Error("verify succeeded on a corrupted story")
+	}
+}
+
+type testSizedDev struct {
+	testIODev
+}
+
+func (dev *testSizedDev) ScreenSize() (int, int) {
+	return 100, 30
+}
+
+func (dev *testSizedDev) SetTextStyle(style int) {
+}
+
+func TestZMachineInterpreterHeader(t *testing.T) {
+	story, err := NewZStory(newTestStoryVersion(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	zm, err := NewZMachine(story, &testIODev{}, NewZMemorySaveStore(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the screen is infinite when its size is unknown
+	mem := zm.seq.mem
+	if mem.ByteAt(screenWidthPos) != 80 || mem.ByteAt(screenHeightPos) != 255 || mem.ByteAt(flags1Pos) != 0 {
+		t.Errorf("unexpected header %X", mem.dyn[:0x22])
+	}
+
+	zm, err = NewZMachine(story, &testSizedDev{}, NewZMemorySaveStore(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mem = zm.seq.mem
+	mem.writeByte(screenWidthPos, 0)
+
+	// restarting fills the header again
+	if err := zm.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	if mem.ByteAt(screenWidthPos) != 100 || mem.ByteAt(screenHeightPos) != 30 || mem.ByteAt(flags1Pos) != flags1Styles {
+		t.Errorf("unexpected header %X", mem.dyn[:0x22])
+	}
+}
+
+func TestZMachineInterpreterHeaderV3(t *testing.T) {
+	buf := newTestStory()
+	buf[flags1Pos] = 0x02 // the story has an hours:minutes status line
+
+	// a device without status line and windows
+	zm, _ := newTestMachine(t, buf)
+	if flags1 := zm.seq.mem.ByteAt(flags1Pos); flags1 != 0x02|flags1NoStatusLine {
+		t.Errorf("unexpected Flags 1 %X", flags1)
+	}
+
+	zm.iodev = &testWindowDev{}
+	if err := zm.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	if flags1 := zm.seq.mem.ByteAt(flags1Pos); flags1 != 0x02|flags1NoStatusLine|flags1SplitScreen {
+		t.Errorf("unexpected Flags 1 %X", flags1)
+	}
+
+	zm.iodev = &testStatusDev{}
+	if err := zm.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	if flags1 := zm.seq.mem.ByteAt(flags1Pos); flags1 != 0x02 {
+		t.Errorf("unexpected Flags 1 %X", flags1)
+	}
+}
+
+type testColouredDev struct {
+	testSizedDev
+	colours [][2]int
+}
+
+func (dev *testColouredDev) SetColour(foreground, background int) {
+	dev.colours = append(dev.colours, [2]int{foreground, background})
+}
+
+func TestZMachineInterpreterHeaderV5(t *testing.T) {
+	// @set_colour 3 0
+	buf := newTestStoryVersion(5, 0x1B, 0x03, 0x00)
+	// the story would like pictures and sounds
+	buf[flags2Pos] = 0xFF
+
+	zm, _ := newTestMachine(t, buf)
+	dev := &testColouredDev{}
+	zm.iodev = dev
+	if err := zm.Reset(); err != nil {
+		t.Fatal(err)
+	}
+
+	mem := zm.seq.mem
+	if mem.WordAt(screenWidthUnitsPos) != 100 || mem.WordAt(screenHeightUnitsPos) != 30 ||
+		mem.ByteAt(flags1Pos)&flags1Colours == 0 || mem.ByteAt(defaultFgPos) != ColourWhite {
+		t.Errorf("unexpected header %X", mem.dyn[:0x30])
+	}
+	if mem.ByteAt(flags2Pos) != 0x57 {
+		t.Errorf("unexpected Flags 2 %X", mem.ByteAt(flags2Pos))
+	}
+
+	runTestMachine(t, zm, 1)
+	if len(dev.colours) != 1 || dev.colours[0] != [2]int{ColourRed, ColourCurrent} {
+		t.Errorf("unexpected colours %v", dev.colours)
+	}
+}
+
+// newBenchmarkMachine runs a loop calling a routine which does some
+// arithmetic on the stack, 6 instructions per iteration. When the loop is
+// in dynamic memory its instructions are decoded each time they're run,
+// the routine is always in high memory.
+func newBenchmarkMachine(b *testing.B, dynamicCode bool) *ZMachine {
+	// @call 0x190 5 -> g0, @add g0 1 -> g1, @jump -11
+	code := []byte{
+		0xE0, 0x1F, 0x01, 0x90, 0x05, 0x10,
+		0x54, 0x10, 0x01, 0x11,
+		0x8C, 0xFF, 0xF5,
+	}
+	// @mul L01 2 -> sp, @add sp 3 -> sp, @ret_popped
+	routine := []byte{0x01, 0x00, 0x00, 0x56, 0x01, 0x02, 0x00, 0x54, 0x00, 0x03, 0x00, 0xB8}
+
+	buf := newTestStoryRoutines(3, code, routine)
+	if dynamicCode {
+		// dynamic memory and high memory meet at the routine
+		buf[0x04], buf[0x05] = 0x03, 0x20
+		buf[0x0E], buf[0x0F] = 0x03, 0x20
+	}
+
+	story, err := NewZStory(buf)
+	if err != nil {
+		b.Fatal(err)
+	}
+	zm, err := NewZMachine(story, &testIODev{}, NewZMemorySaveStore(), nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return zm
+}
+
+func benchmarkInterpret(b *testing.B, dynamicCode bool) {
+	zm := newBenchmarkMachine(b, dynamicCode)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := zm.Interpret(); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "instr/s")
+}
+
+func BenchmarkInterpret(b *testing.B) {
+	benchmarkInterpret(b, false)
+}
+
+// BenchmarkInterpretUncached decodes every instruction, as it was done
+// before the instructions were cached
+func BenchmarkInterpretUncached(b *testing.B) {
+	benchmarkInterpret(b, true)
+}
@@ -1,13 +1,16 @@
 package gork
 
-import (
-	"fmt"
-	"strings"
-)
+import "fmt"
 
-// v3
+// encodedZstringLen is the length of the encoded words of the dictionary,
+// 6 characters up to v3 and 9 from v4.
 // number of words, not characters!
-const encodedZstringLen int = 2
+func encodedZstringLen(version byte) int {
+	if version >= 4 {
+		return 3
+	}
+	return 2
+}
 
 // v3
 var Alphabets = [3]string{
@@ -16,43 +19,118 @@ var Alphabets = [3]string{
 	" \n0123456789.,!?_#'\"/\\-:()",
 }
 
-type ZMemory []byte
+// ZMemory is the memory of a single ZMachine: reads of static and high
+// memory go straight to the story, while dynamic memory is a private copy
+// so that many machines can safely play the same story at once.
+// Accessing memory out of its range is a fault of the story, the
+// ZMemoryError is handed to Interpret which returns it.
+type ZMemory struct {
+	dyn   []byte
+	story []byte
+	// the header can be written only where the story is allowed to, the
+	// rest of it belongs to the interpreter
+	protected bool
+	// code marks the bytes of dynamic memory which have been compiled,
+	// writing one of them calls codeWritten
+	code        []bool
+	codeWritten func(addr uint32)
+}
+
+// the header is the first 64 bytes of dynamic memory
+const headerSize = uint32(0x40)
+
+// ZMemoryError is an access out of memory or a write out of dynamic memory
+type ZMemoryError struct {
+	Addr  uint32
+	Write bool
+}
+
+func (e *ZMemoryError) Error() string {
+	if e.Write {
+		return fmt.Sprintf("write to read only memory at %X", e.Addr)
+	}
+	return fmt.Sprintf("read out of memory at %X", e.Addr)
+}
+
 type ZMemorySequential struct {
 	mem *ZMemory
 	pos uint32
 }
 
+// NewZMemory creates a memory where the whole buffer is writable,
+// it's meant for tools that don't run the story
 func NewZMemory(mem []byte) *ZMemory {
-	zmem := new(ZMemory)
-	*zmem = mem
-	return zmem
+	return &ZMemory{dyn: mem, story: mem}
+}
+
+func (zmem *ZMemory) Size() uint32 {
+	return uint32(len(zmem.story))
 }
 
 func (zmem *ZMemory) ByteAt(addr uint32) byte {
-	return (*zmem)[addr]
+	if addr < uint32(len(zmem.dyn)) {
+		return zmem.dyn[addr]
+	}
+	if addr >= uint32(len(zmem.story)) {
+		panic(zfault{&ZMemoryError{Addr: addr}})
+	}
+	return zmem.story[addr]
 }
 
 func (zmem *ZMemory) WordAt(addr uint32) uint16 {
 	// Big Endian
-	return (uint16((*zmem)[addr]) << 8) |
-		(uint16((*zmem)[addr+1]))
+	return (uint16(zmem.ByteAt(addr)) << 8) |
+		(uint16(zmem.ByteAt(addr + 1)))
 }
 
 func (zmem *ZMemory) UInt32At(addr uint32) uint32 {
 	// Big Endian
-	return (uint32((*zmem)[addr]) << 24) |
-		(uint32((*zmem)[addr+1]) << 16) |
-		(uint32((*zmem)[addr+2]) << 8) |
-		uint32((*zmem)[addr+3])
+	return (uint32(zmem.WordAt(addr)) << 16) |
+		uint32(zmem.WordAt(addr+2))
 }
 
+// WriteByteAt writes a byte for the story, only dynamic memory is
+// writable and only some bits of the header
 func (zmem *ZMemory) WriteByteAt(addr uint32, val byte) {
-	(*zmem)[addr] = val
+	if zmem.protected && addr < headerSize {
+		// the story can change only some bits of Flags 2
+		mask := byte(0)
+		if addr == flags2Pos {
+			mask = flags2Story
+		}
+		if (zmem.dyn[addr]^val)&^mask != 0 {
+			panic(zfault{&ZMemoryError{Addr: addr, Write: true}})
+		}
+	}
+	zmem.writeByte(addr, val)
+}
+
+// writeByte writes anywhere in dynamic memory, the header included
+func (zmem *ZMemory) writeByte(addr uint32, val byte) {
+	if addr >= uint32(len(zmem.dyn)) {
+		// the story is shared, never write it
+		panic(zfault{&ZMemoryError{Addr: addr, Write: true}})
+	}
+	zmem.dyn[addr] = val
+	if zmem.code != nil && zmem.code[addr] {
+		zmem.codeWritten(addr)
+	}
+}
+
+// writeHeaderWord is writeByte for the words of the header owned by the
+// interpreter
+func (zmem *ZMemory) writeHeaderWord(addr uint32, val uint16) {
+	zmem.writeByte(addr, byte(val>>8))
+	zmem.writeByte(addr+1, byte(val&0x00FF))
 }
 
 func (zmem *ZMemory) WriteWordAt(addr uint32, val uint16) {
-	(*zmem)[addr] = byte(val >> 8)
-	(*zmem)[addr+1] = byte(val & 0X00FF)
+	// a word across the end of dynamic memory is not written at all
+	if addr+1 >= uint32(len(zmem.dyn)) {
+		panic(zfault{&ZMemoryError{Addr: addr + 1, Write: true}})
+	}
+	zmem.WriteByteAt(addr, byte(val>>8))
+	zmem.WriteByteAt(addr+1, byte(val&0x00FF))
 }
 
 func (zmem *ZMemory) GetSequential(addr uint32) *ZMemorySequential {
@@ -71,7 +149,7 @@ func (zmem *ZMemorySequential) PeekUInt32() uint32 {
 	return zmem.mem.UInt32At(zmem.pos)
 }
 
-func (zmem *ZMemorySequential) ReadByte() byte {
+func (zmem *ZMemorySequential) ReadUint8() byte {
 	tmp := zmem.mem.ByteAt(zmem.pos)
 	zmem.pos++
 	return tmp
@@ -89,7 +167,7 @@ func (zmem *ZMemorySequential) ReadUint32() uint32 {
 	return tmp
 }
 
-func (zmem *ZMemorySequential) WriteByte(b byte) {
+func (zmem *ZMemorySequential) WriteUint8(b byte) {
 	zmem.mem.WriteByteAt(zmem.pos, b)
 	zmem.pos++
 }
@@ -104,7 +182,13 @@ func (zmem *ZMemory) DecodeZStringAt(addr uint32, header *ZHeader) string {
 }
 
 func (zmem *ZMemorySequential) DecodeZString(header *ZHeader) string {
-	// v3
+	return zmem.decodeZString(header, true)
+}
+
+// decodeZString decodes the string at the current position, abbreviations
+// are expanded only if expand is set: they can't contain other
+// abbreviations and a story which does that must not loop forever
+func (zmem *ZMemorySequential) decodeZString(header *ZHeader, expand bool) string {
 
 	ret := ""
 	data := uint16(0)
@@ -132,8 +216,10 @@ func (zmem *ZMemorySequential) DecodeZString(header *ZHeader) string {
 				synonimFlag = false
 				synonim = (synonim - 1) * 64
 
-				tmpAddr := uint32(zmem.mem.WordAt(uint32(header.abbrTblPos+synonim+code*2))) * 2
-				ret += zmem.mem.DecodeZStringAt(tmpAddr, header)
+				if expand {
+					tmpAddr := uint32(zmem.mem.WordAt(uint32(header.abbrTblPos+synonim+code*2))) * 2
+					ret += zmem.mem.GetSequential(tmpAddr).decodeZString(header, false)
+				}
 
 				alphabet = shiftLock
 			} else if asciiPart > 0 {
@@ -143,15 +229,21 @@ func (zmem *ZMemorySequential) DecodeZString(header *ZHeader) string {
 					asciiFirstPart = code << 5
 				} else {
 					asciiPart = 0
-					ret += string(asciiFirstPart | code)
+					if r, ok := header.zsciiRune(asciiFirstPart | code); ok {
+						ret += string(r)
+					}
 				}
 			} else if code > 5 {
 				code -= 6
 
 				if alphabet == 2 && code == 0 {
 					asciiPart = 1
+				} else if alphabet == 2 && code == 1 {
+					ret += "\n"
 				} else {
-					ret += string(Alphabets[alphabet][code])
+					if r, ok := header.zsciiRune(uint16(header.alphabet(int(alphabet))[code])); ok {
+						ret += string(r)
+					}
 				}
 				alphabet = shiftLock
 			} else if code == 0 {
@@ -169,67 +261,21 @@ func (zmem *ZMemorySequential) DecodeZString(header *ZHeader) string {
 	return ret
 }
 
-func ZStringEncode(what string) [encodedZstringLen]uint16 {
-	const padding byte = 0x05
-
-	ret := [encodedZstringLen]uint16{}
-
-	what = strings.ToLower(what)
-
-	curWordIdx := 0
-	offset := 10
-
-	writeChar := func(ch byte) {
-		ret[curWordIdx] |= uint16(ch) << uint8(offset)
-		offset -= 5
-
-		if offset < 0 {
-			// new word
-			offset = 10
-			curWordIdx++
-		}
-	}
-
-	for c := range what {
-		i := strings.IndexByte(Alphabets[0], what[c])
-		if i < 0 {
-			// v3
-			// shift to A2
-			writeChar(0x05)
-			i = strings.IndexByte(Alphabets[2], what[c])
-		}
-
-		if i < 0 {
-			// 10 bit zscii
-			writeChar(0x06)
-			writeChar(what[c] >> 5)
-			writeChar(what[c] & 0x1F)
-		}
-
-		writeChar(byte(i + 6))
-
-	}
-
-	for curWordIdx < encodedZstringLen {
-		writeChar(padding)
-	}
-
-	// end of the string
-	ret[encodedZstringLen-1] |= 1 << 15
-
-	return ret
+// ZStringEncode encodes the ZSCII text what as a dictionary word using the
+// alphabets of the story, words are truncated to the length of the
+// dictionary entries
+func ZStringEncode(what string, header *ZHeader) []uint16 {
+	return NewZStringEncoder(header, nil).encodeWord([]byte(what))
 }
 
-func PackedAddress(addr uint32) uint32 {
-	// v3
-	return addr * 2
+func PackedAddress(addr uint32, header *ZHeader) uint32 {
+	return addr * header.packedScale()
 }
 
-func IsPackedAddress(addr uint32) bool {
-	// v3
-	return addr%2 == 0
+func IsPackedAddress(addr uint32, header *ZHeader) bool {
+	return addr%header.packedScale() == 0
 }
 
 func (zmem *ZMemory) String() string {
-	return fmt.Sprintf("buf: %v\n", []byte(*zmem))
+	return fmt.Sprintf("dyn: %v\n", zmem.dyn)
 }
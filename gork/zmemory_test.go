@@ -2,6 +2,7 @@ package gork
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"testing"
 )
@@ -46,7 +47,7 @@ var encodedZstringsExpected [][]uint16 = [][]uint16{
 var byteOrder binary.ByteOrder = binary.BigEndian
 
 func TestByteAt(t *testing.T) {
-	mem := ZMemory(readTestData)
+	mem := NewZMemory(readTestData)
 
 	for i := range readTestData {
 		if readTestData[i] != mem.ByteAt(uint32(i)) {
@@ -56,27 +57,27 @@ func TestByteAt(t *testing.T) {
 }
 
 func TestWordAt(t *testing.T) {
-	mem := ZMemory(readTestData)
+	mem := NewZMemory(readTestData)
 
 	for i := uint32(0); i < uint32(len(readTestData)/2); i++ {
-		if byteOrder.Uint16(mem[i:i+2]) != mem.WordAt(i) {
+		if byteOrder.Uint16(readTestData[i:i+2]) != mem.WordAt(i) {
 			t.Fail()
 		}
 	}
 }
 
 func TestUint32At(t *testing.T) {
-	mem := ZMemory(readTestData)
+	mem := NewZMemory(readTestData)
 
 	for i := uint32(0); i < uint32(len(readTestData)/4); i++ {
-		if byteOrder.Uint16(mem[i:i+4]) != mem.WordAt(i) {
+		if byteOrder.Uint16(readTestData[i:i+4]) != mem.WordAt(i) {
 			t.Fail()
 		}
 	}
 }
 
-func TestWriteByteAt(t *testing.T) {
-	mem := ZMemory(readTestData)
+func TestWriteUint8At(t *testing.T) {
+	mem := NewZMemory(readTestData)
 
 	for i := range readTestData {
 		mem.WriteByteAt(uint32(i), writeTestData[i])
@@ -87,7 +88,7 @@ func TestWriteByteAt(t *testing.T) {
 }
 
 func TestWriteWordAt(t *testing.T) {
-	mem := ZMemory(readTestData)
+	mem := NewZMemory(readTestData)
 
 	for i := uint32(0); i < uint32(len(readTestData)/2); i++ {
 		toWrite := byteOrder.Uint16(writeTestData[i : i+2])
@@ -99,7 +100,7 @@ func TestWriteWordAt(t *testing.T) {
 }
 
 func TestPeekByte(t *testing.T) {
-	mem := ZMemory(readTestData)
+	mem := NewZMemory(readTestData)
 	seq := mem.GetSequential(0)
 
 	for i := range readTestData {
@@ -111,10 +112,10 @@ func TestPeekByte(t *testing.T) {
 }
 
 func TestPeekWord(t *testing.T) {
-	mem := ZMemory(readTestData)
+	mem := NewZMemory(readTestData)
 	seq := mem.GetSequential(0)
 
-	for i := uint32(0); i < uint32(len(mem)/2); i++ {
+	for i := uint32(0); i < uint32(int(mem.Size())/2); i++ {
 		if seq.PeekWord() != seq.mem.WordAt(seq.pos) || seq.pos != uint32(i*2) {
 			t.Fail()
 		}
@@ -123,10 +124,10 @@ func TestPeekWord(t *testing.T) {
 }
 
 func TestPeekUint32(t *testing.T) {
-	mem := ZMemory(readTestData)
+	mem := NewZMemory(readTestData)
 	seq := mem.GetSequential(0)
 
-	for i := uint32(0); i < uint32(len(mem)/4); i++ {
+	for i := uint32(0); i < uint32(int(mem.Size())/4); i++ {
 		if seq.PeekUInt32() != seq.mem.UInt32At(seq.pos) || seq.pos != uint32(i*4) {
 			t.Fail()
 		}
@@ -134,22 +135,22 @@ func TestPeekUint32(t *testing.T) {
 	}
 }
 
-func TestReadByte(t *testing.T) {
-	mem := ZMemory(readTestData)
+func TestReadUint8(t *testing.T) {
+	mem := NewZMemory(readTestData)
 	seq := mem.GetSequential(0)
 
 	for i := range readTestData {
-		if seq.pos != uint32(i) || seq.ReadByte() != seq.mem.ByteAt(uint32(i)) {
+		if seq.pos != uint32(i) || seq.ReadUint8() != seq.mem.ByteAt(uint32(i)) {
 			t.Fail()
 		}
 	}
 }
 
 func TestReadWord(t *testing.T) {
-	mem := ZMemory(readTestData)
+	mem := NewZMemory(readTestData)
 	seq := mem.GetSequential(0)
 
-	for i := uint32(0); i < uint32(len(mem)/2); i++ {
+	for i := uint32(0); i < uint32(int(mem.Size())/2); i++ {
 		if seq.pos != uint32(i*2) || seq.ReadWord() != seq.mem.WordAt(i*2) {
 			t.Fail()
 		}
@@ -157,22 +158,22 @@ func TestReadWord(t *testing.T) {
 }
 
 func TestReadUint32(t *testing.T) {
-	mem := ZMemory(readTestData)
+	mem := NewZMemory(readTestData)
 	seq := mem.GetSequential(0)
 
-	for i := uint32(0); i < uint32(len(mem)/4); i++ {
+	for i := uint32(0); i < uint32(int(mem.Size())/4); i++ {
 		if seq.pos != uint32(i*4) || seq.ReadUint32() != seq.mem.UInt32At(i*4) {
 			t.Fail()
 		}
 	}
 }
 
-func TestWriteByte(t *testing.T) {
-	mem := ZMemory(readTestData)
+func TestWriteUint8(t *testing.T) {
+	mem := NewZMemory(readTestData)
 	seq := mem.GetSequential(0)
 
 	for i := range readTestData {
-		seq.WriteByte(writeTestData[i])
+		seq.WriteUint8(writeTestData[i])
 		if mem.ByteAt(uint32(i)) != writeTestData[i] || seq.pos != uint32(i+1) {
 			t.Fail()
 		}
@@ -180,7 +181,7 @@ func TestWriteByte(t *testing.T) {
 }
 
 func TestWriteWord(t *testing.T) {
-	mem := ZMemory(readTestData)
+	mem := NewZMemory(readTestData)
 	seq := mem.GetSequential(0)
 
 	for i := uint32(0); i < uint32(len(readTestData)/2); i++ {
@@ -201,7 +202,7 @@ func TestWriteWord(t *testing.T) {
 
 func TestPackedAddres(t *testing.T) {
 	for i := uint32(0); i < 10; i++ {
-		if !IsPackedAddress(PackedAddress(i)) {
+		if !IsPackedAddress(PackedAddress(i, header), header) {
 			t.Fail()
 		}
 	}
@@ -209,7 +210,7 @@ func TestPackedAddres(t *testing.T) {
 
 func TestZStringDecodeAt(t *testing.T) {
 	for i, zstring := range zstrings {
-		mem := ZMemory(zstring)
+		mem := NewZMemory(zstring)
 
 		// in this case zstring doesn't have abbreviations,
 		// so don't pass the header
@@ -221,7 +222,7 @@ func TestZStringDecodeAt(t *testing.T) {
 
 func TestZStringDecode(t *testing.T) {
 	for _, zstring := range zstrings {
-		mem := ZMemory(zstring)
+		mem := NewZMemory(zstring)
 		seq := mem.GetSequential(0)
 
 		if mem.DecodeZStringAt(0, header) != seq.DecodeZString(header) {
@@ -235,7 +236,7 @@ func TestZStringDecode(t *testing.T) {
 func TestZStringEncode(t *testing.T) {
 	for i, zstr := range encodedZstrings {
 		expected := encodedZstringsExpected[i]
-		encoded := ZStringEncode(zstr)
+		encoded := ZStringEncode(zstr, &ZHeader{version: 3})
 
 		for i := range encoded {
 			if encoded[i] != expected[i] {
@@ -248,7 +249,7 @@ func TestZStringEncode(t *testing.T) {
 				buf[i*2+1] = byte(v)
 			}
 
-			seq := ZMemory(buf)
+			seq := NewZMemory(buf)
 			decoded := seq.DecodeZStringAt(0, nil)
 
 			if decoded != zstr {
@@ -258,3 +259,99 @@ func TestZStringEncode(t *testing.T) {
 
 	}
 }
+
+// memoryFault runs f and returns the fault it caused
+func memoryFault(f func()) (err error) {
+	defer recoverFault(&err)
+	f()
+	return nil
+}
+
+func TestZMemoryProtection(t *testing.T) {
+	story, err := NewZStory(newTestStory(0xBA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mem := story.NewMemory()
+
+	// the story can turn the transcript on, not claim undo support
+	if err := memoryFault(func() { mem.WriteByteAt(flags2Pos, transcriptFlag) }); err != nil {
+		t.Error(err)
+	}
+	if err := memoryFault(func() { mem.WriteByteAt(flags2Pos, 0x10) }); err == nil {
+		t.Error("only some bits of Flags 2 are writable")
+	}
+	// writing the same value is fine, like storew does to the high byte
+	if err := memoryFault(func() { mem.WriteWordAt(flags2Pos-1, 0x0003) }); err != nil {
+		t.Error(err)
+	}
+
+	faults := []func(){
+		func() { mem.WriteByteAt(screenWidthPos, 1) },
+		func() { mem.WriteWordAt(testDynMemSize-1, 0x4273) },
+		func() { mem.WriteByteAt(testPC, 0) },
+		func() { mem.ByteAt(mem.Size()) },
+		func() { mem.WordAt(mem.Size() - 1) },
+	}
+	for i, f := range faults {
+		var merr *ZMemoryError
+		if err := memoryFault(f); !errors.As(err, &merr) {
+			t.Errorf("access %d did not fault: %v", i, err)
+		}
+	}
+
+	// a faulty word write doesn't write half of it
+	if mem.ByteAt(testDynMemSize-1) != 0 {
+		t.Error("word partially written")
+	}
+
+	// tools can write everywhere
+	if err := memoryFault(func() { NewZMemory(make([]byte, 4)).WriteByteAt(1, 1) }); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestZMemoryFaultInterpret(t *testing.T) {
+	// @storew 0 7 0 overwrites the size of dynamic memory
+	zm, _ := newTestMachine(t, newTestStory(0xE1, 0x57, 0x00, 0x07, 0x00))
+
+	err := zm.Interpret()
+	var merr *ZMemoryError
+	if !errors.As(err, &merr) || merr.Addr != 0x0E || !merr.Write {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestZArrayAddressWraps(t *testing.T) {
+	// @storew 0xFFFE 0x81 0x4273, @loadw 0xFFFE 0x81 -> G00,
+	// @storeb 0xFFFF 0x103 0x2A, @loadb 0xFFFF 0x103 -> G01
+	zm, _ := newTestMachine(t, newTestStory(
+		0xE1, 0x03, 0xFF, 0xFE, 0x00, 0x81, 0x42, 0x73,
+		0xCF, 0x0F, 0xFF, 0xFE, 0x00, 0x81, 0x10,
+		0xE2, 0x03, 0xFF, 0xFF, 0x01, 0x03, 0x00, 0x2A,
+		0xD0, 0x0F, 0xFF, 0xFF, 0x01, 0x03, 0x11,
+	))
+
+	runTestMachine(t, zm, 4)
+	if b := zm.dynMem()[0x100:0x103]; b[0] != 0x42 || b[1] != 0x73 || b[2] != 0x2A {
+		t.Errorf("unexpected memory % X", b)
+	}
+	if zm.GetVarAt(0x10) != 0x4273 || zm.GetVarAt(0x11) != 0x2A {
+		t.Errorf("unexpected loads %X %X", zm.GetVarAt(0x10), zm.GetVarAt(0x11))
+	}
+}
+
+func TestZStoryTruncated(t *testing.T) {
+	if _, err := NewZStory([]byte{3, 0, 0x10}); err == nil {
+		t.Error("a story without a whole header must not load")
+	}
+}
+
+func TestZStringNestedAbbreviation(t *testing.T) {
+	// abbreviation 0 is the string at 4, which uses abbreviation 0
+	mem := NewZMemory([]byte{0x00, 0x02, 0x00, 0x00, 0x84, 0x05})
+
+	if s := mem.DecodeZStringAt(4, &ZHeader{version: 3}); s != "" {
+		t.Errorf("unexpected string %q", s)
+	}
+}
@@ -3,404 +3,508 @@ package gork
 import (
 	"errors"
 	"fmt"
-	"sort"
 )
 
 const (
-	MaxZObjects       = 255       // v3
-	zobjectSize       = uint32(9) // v3
-	propertyOffset    = uint32(7) //v3
-	NULL_OBJECT_INDEX = uint8(0)
+	NULL_OBJECT_INDEX = uint16(0)
 )
 
-type ZObject struct {
-	number        uint8
-	attributes    [32]bool //v3 never gonna be more than 32
-	parent        byte
-	sibling       byte
-	child         byte
-	name          string
-	propertiesPos uint16
-	properties    map[byte][]byte
-	mem           *ZMemory
-	header        *ZHeader
-}
-
-func NewZObject(mem *ZMemory, number uint8, header *ZHeader) (*ZObject, error) {
-	obj := new(ZObject)
-	if err := obj.configure(mem, number, header); err != nil {
-		return nil, err
+// zobjectFormat describes the layout of the object table, which changes
+// from v4 on: objects ids are words, there are 48 attributes and 63
+// properties
+type zobjectFormat struct {
+	maxObjects      uint16
+	attributesCount byte
+	propertiesCount byte
+	size            uint32
+	// offsets of the fields in an object entry
+	parentOffset   uint32
+	siblingOffset  uint32
+	childOffset    uint32
+	propertyOffset uint32
+	// ids are bytes up to v3 and words from v4
+	wideIds bool
+}
+
+var (
+	zobjectFormatV3 = &zobjectFormat{
+		maxObjects:      255,
+		attributesCount: 32,
+		propertiesCount: 31,
+		size:            9,
+		parentOffset:    4,
+		siblingOffset:   5,
+		childOffset:     6,
+		propertyOffset:  7,
+	}
+
+	zobjectFormatV4 = &zobjectFormat{
+		maxObjects:      65535,
+		attributesCount: 48,
+		propertiesCount: 63,
+		size:            14,
+		parentOffset:    6,
+		siblingOffset:   8,
+		childOffset:     10,
+		propertyOffset:  12,
+		wideIds:         true,
+	}
+)
+
+func objectFormat(header *ZHeader) *zobjectFormat {
+	if header.version >= 4 {
+		return zobjectFormatV4
 	}
-	return obj, nil
+	return zobjectFormatV3
 }
 
-func (obj *ZObject) configure(mem *ZMemory, number uint8, header *ZHeader) error {
-	obj.number = number
+// defaultsSize is the size of the property defaults table that comes
+// before the objects
+func (format *zobjectFormat) defaultsSize() uint32 {
+	return uint32(format.propertiesCount) * 2
+}
 
-	obj.mem = mem
-	obj.header = header
+// ZObject is a view over an object entry in memory, it doesn't cache
+// anything so that changes made by the story through loadb/storeb and
+// restores are always visible and every change is written to memory
+type ZObject struct {
+	number uint16
+	addr   uint32
+	mem    *ZMemory
+	header *ZHeader
+	format *zobjectFormat
+}
 
+func NewZObject(mem *ZMemory, number uint16, header *ZHeader) (*ZObject, error) {
 	addr, err := ZObjectAddress(number, header)
-
 	if err != nil {
-		return err
-	}
-
-	seq := mem.GetSequential(addr)
-
-	// v3 attributes is 32 bit
-	// more significant bit <-> attribute # smaller
-	//
-	// Bit  #  0 1 2 3 4 5 6 7
-	// Attr #  7 6 5 4 3 2 1 0
-	attr := seq.ReadUint32()
-	for i := 3; i >= 0; i-- {
-		byteno := uint8(3 - i)
-		bits := uint8(attr >> (uint8(i) * 8))
-		for j := 7; j >= 0; j-- {
-			obj.attributes[byteno*8+7-uint8(j)] = (bits>>uint8(j))&0x01 == 0x01
-		}
+		return nil, err
 	}
 
-	obj.parent = seq.ReadByte()
-	obj.sibling = seq.ReadByte()
-	obj.child = seq.ReadByte()
-	obj.propertiesPos = seq.ReadWord()
+	return &ZObject{
+		number: number,
+		addr:   addr,
+		mem:    mem,
+		header: header,
+		format: objectFormat(header),
+	}, nil
+}
 
-	obj.readProperties(header)
-	return nil
+// object returns a view on another object of the same table
+func (obj *ZObject) object(number uint16) *ZObject {
+	other, _ := NewZObject(obj.mem, number, obj.header)
+	return other
 }
 
-func (obj *ZObject) readProperties(header *ZHeader) {
-	// v3
+// attributes are 32 bit up to v3 and 48 bit from v4
+// more significant bit <-> attribute # smaller
+//
+// Bit  #  0 1 2 3 4 5 6 7
+// Attr #  7 6 5 4 3 2 1 0
+func (obj *ZObject) attributePos(attr byte) (uint32, byte) {
+	return obj.addr + uint32(attr/8), 0x80 >> (attr % 8)
+}
 
-	obj.properties = make(map[byte][]byte)
+// TestAttribute returns whether attr is set, invalid attributes are never set
+func (obj *ZObject) TestAttribute(attr byte) bool {
+	if attr >= obj.format.attributesCount {
+		return false
+	}
 
-	seq := obj.mem.GetSequential(uint32(obj.propertiesPos))
+	addr, mask := obj.attributePos(attr)
+	return obj.mem.ByteAt(addr)&mask != 0
+}
 
-	// number of words
-	textLength := uint16(seq.ReadByte())
-	if textLength != 0 {
-		obj.name = string(seq.DecodeZString(header))
+// SetAttribute sets or clears attr, invalid attributes are ignored
+func (obj *ZObject) SetAttribute(attr byte, value bool) {
+	if attr >= obj.format.attributesCount {
+		return
 	}
 
-	dataSize := seq.ReadByte()
-	for dataSize > 0 {
-		prop := dataSize & (0x20 - 1)
-		count := ((dataSize & 0xE0) >> 5) + 1
+	addr, mask := obj.attributePos(attr)
+	b := obj.mem.ByteAt(addr)
+	if value {
+		b |= mask
+	} else {
+		b &^= mask
+	}
+	obj.mem.WriteByteAt(addr, b)
+}
 
-		for i := byte(0); i < count; i++ {
-			obj.properties[prop] = append(obj.properties[prop],
-				seq.ReadByte())
+func (obj *ZObject) Attributes() []byte {
+	ret := []byte{}
+	for attr := byte(0); attr < obj.format.attributesCount; attr++ {
+		if obj.TestAttribute(attr) {
+			ret = append(ret, attr)
 		}
-		dataSize = seq.ReadByte()
 	}
+	return ret
 }
 
-func (obj *ZObject) SetProperty(propertyId byte, value uint16) error {
-	if _, ok := obj.properties[propertyId]; !ok {
-		return errors.New(fmt.Sprintf("Property %d not found\n", propertyId))
+func (obj *ZObject) readId(offset uint32) uint16 {
+	if obj.format.wideIds {
+		return obj.mem.WordAt(obj.addr + offset)
 	}
+	return uint16(obj.mem.ByteAt(obj.addr + offset))
+}
+
+func (obj *ZObject) writeId(offset uint32, id uint16) {
+	if obj.format.wideIds {
+		obj.mem.WriteWordAt(obj.addr+offset, id)
+	} else {
+		obj.mem.WriteByteAt(obj.addr+offset, byte(id))
+	}
+}
+
+func (obj *ZObject) setParent(id uint16) {
+	obj.writeId(obj.format.parentOffset, id)
+}
 
-	// TODO
-	// check if it is legal for a story to get/set property
-	// directly via store/load or it is forced to use putprop/getprop
-	// in case it's legal try to uncomment the commented lines and hope
-	// the best
-	// however if the story table address can be modified as well
-	// than ZMachine cannot cache objects, because otherwise it would
-	// be too complex to intercept writes to the address of the property
-	// table of an object
+func (obj *ZObject) setSibling(id uint16) {
+	obj.writeId(obj.format.siblingOffset, id)
+}
+
+func (obj *ZObject) setChild(id uint16) {
+	obj.writeId(obj.format.childOffset, id)
+}
 
-	// addr := obj.GetPropertyAddr(propertyId)
+func (obj *ZObject) PropertiesPos() uint16 {
+	return obj.mem.WordAt(obj.addr + obj.format.propertyOffset)
+}
+
+func (obj *ZObject) SetProperty(propertyId byte, value uint16) error {
+	addr := obj.GetPropertyAddr(propertyId)
+	if addr == 0 {
+		return fmt.Errorf("Property %d not found\n", propertyId)
+	}
 
-	// it seems we cannot take address of values of a map :'(
-	switch len(obj.properties[propertyId]) {
+	switch GetPropertyLen(obj.mem, addr, obj.header) {
 	case 1:
 		// store only least significant byte
-		data := byte(value & 0x00FF)
-		obj.properties[propertyId][0] = data
-		// obj.mem.WriteByteAt(addr, data)
+		obj.mem.WriteByteAt(addr, byte(value&0x00FF))
 	case 2:
-		// big endian
-		obj.properties[propertyId][0] = byte((value >> 8) & 0x00FF)
-		obj.properties[propertyId][1] = byte(value & 0x00FF)
-		// obj.mem.WriteWordAt(addr, value)
+		obj.mem.WriteWordAt(addr, value)
 	default:
-		return errors.New(fmt.Sprintf("cannot set property, because its length is > 2 bytes"))
+		return errors.New("cannot set property, because its length is > 2 bytes")
 	}
 	return nil
 }
 
 func (obj *ZObject) GetProperty(propertyId byte) (uint16, error) {
-	if _, ok := obj.properties[propertyId]; !ok {
+	addr := obj.GetPropertyAddr(propertyId)
+
+	if addr == 0 {
 		// DON'T PANIC, cause the property could be in the
 		// global default properties table
 
-		// v3
-		if propertyId < 1 || propertyId > 31 {
-			return 0, errors.New(fmt.Sprintf("Invalid propertyIndex %d, values range in v3 is [1,31]\n", propertyId))
-		}
-
-		// property table is a sequence of words
-		addr := uint32(obj.header.objTblPos) + uint32((propertyId-1)*2)
-		return obj.mem.WordAt(addr), nil
+		return defaultProperty(obj.mem, propertyId, obj.header)
 	}
 
-	res := uint16(0)
-
-	// it seems we cannot take address of values of a map :'(
-	switch len(obj.properties[propertyId]) {
+	switch GetPropertyLen(obj.mem, addr, obj.header) {
 	case 1:
-		res = uint16(obj.properties[propertyId][0])
+		return uint16(obj.mem.ByteAt(addr)), nil
 	case 2:
-		// big endian
-		res |= uint16(obj.properties[propertyId][0]) << 8
-		res |= uint16(obj.properties[propertyId][1])
+		return obj.mem.WordAt(addr), nil
 	default:
 		return 0, errors.New("cannot get property, because its length is > 2 bytes")
 	}
+}
+
+// defaultProperty reads propertyId from the property defaults table at the
+// start of the object table
+func defaultProperty(mem *ZMemory, propertyId byte, header *ZHeader) (uint16, error) {
+	format := objectFormat(header)
+	if propertyId < 1 || propertyId > format.propertiesCount {
+		return 0, fmt.Errorf("Invalid propertyIndex %d, values range is [1,%d]\n", propertyId, format.propertiesCount)
+	}
+
+	// property table is a sequence of words
+	addr := uint32(header.objTblPos) + uint32(propertyId-1)*2
+	return mem.WordAt(addr), nil
+}
+
+// Property returns a copy of the data of the property or nil if the object
+// doesn't have it
+func (obj *ZObject) Property(propertyId byte) []byte {
+	addr := obj.GetPropertyAddr(propertyId)
+	if addr == 0 {
+		return nil
+	}
 
-	return res, nil
+	data := make([]byte, GetPropertyLen(obj.mem, addr, obj.header))
+	for i := range data {
+		data[i] = obj.mem.ByteAt(addr + uint32(i))
+	}
+	return data
 }
 
-func GetPropertyLen(mem *ZMemory, propertyPos uint32) uint16 {
+func GetPropertyLen(mem *ZMemory, propertyPos uint32, header *ZHeader) uint16 {
 	// the property size byte is the byte before propertyPos
 	size := mem.ByteAt(uint32(propertyPos - 1))
-	nbytes := (size >> 5) + 1
-	return uint16(nbytes)
+
+	if header.version < 4 {
+		nbytes := (size >> 5) + 1
+		return uint16(nbytes)
+	}
+
+	// v4 if bit #7 is set this is the second size byte and the length
+	// is in the bottom 6 bits, 0 meaning 64
+	if size&0x80 != 0 {
+		nbytes := size & 0x3F
+		if nbytes == 0 {
+			nbytes = 64
+		}
+		return uint16(nbytes)
+	}
+
+	// otherwise bit #6 tells whether the length is 2 or 1
+	if size&0x40 != 0 {
+		return 2
+	}
+	return 1
+}
+
+// propertySize parses the size bytes of the property at addr, it returns
+// the property id, the address of the data and its length
+func propertySize(mem *ZMemory, addr uint32, header *ZHeader) (byte, uint32, uint32) {
+	size := mem.ByteAt(addr)
+
+	if header.version < 4 {
+		return size & 0x1F, addr + 1, uint32((size >> 5) + 1)
+	}
+
+	// v4 when bit #7 is set the length is in a second byte
+	dataAddr := addr + 1
+	if size&0x80 != 0 {
+		dataAddr++
+	}
+	return size & 0x3F, dataAddr, uint32(GetPropertyLen(mem, dataAddr, header))
 }
 
 func (obj *ZObject) GetFirstPropertySizeAddr() uint32 {
 	// returns the address of the size byte
 
 	// text length is in words
-	textLength := obj.mem.ByteAt(uint32(obj.propertiesPos))
-	return uint32(obj.propertiesPos) + 1 + uint32(textLength)*2
+	propertiesPos := uint32(obj.PropertiesPos())
+	textLength := obj.mem.ByteAt(propertiesPos)
+	return propertiesPos + 1 + uint32(textLength)*2
 }
 
-func (obj *ZObject) GetPropertyAddr(propertyId byte) uint32 {
-	// v3
+// forEachProperty calls fn with the id and the address of the data of every
+// property in descending order until fn returns false
+func (obj *ZObject) forEachProperty(fn func(propertyId byte, addr uint32) bool) {
 	addr := obj.GetFirstPropertySizeAddr()
 
 	for {
-		size := obj.mem.ByteAt(addr)
-
-		propno := size & 0x1F
+		if obj.mem.ByteAt(addr) == 0 {
+			return
+		}
 
-		if size == 0 || propno < propertyId {
-			// must return 0 if property is not present
-			// properties are sorted in descending order
-			return 0
+		propertyId, dataAddr, length := propertySize(obj.mem, addr, obj.header)
+		if !fn(propertyId, dataAddr) {
+			return
 		}
 
-		// skip size
-		addr++
+		addr = dataAddr + length
+	}
+}
+
+func (obj *ZObject) GetPropertyAddr(propertyId byte) uint32 {
+	ret := uint32(0)
+
+	obj.forEachProperty(func(propno byte, addr uint32) bool {
 		if propno == propertyId {
-			return addr
+			ret = addr
 		}
 
-		addr += uint32((size >> 5) + 1)
-	}
+		// properties are sorted in descending order, so stop as soon
+		// as the property cannot be there anymore
+		return propno > propertyId
+	})
+
+	// must return 0 if property is not present
+	return ret
 }
 
-func (obj *ZObject) MakeOrphan(other []*ZObject) {
-	// TODO
-	// the same doubts of ZObject get/set properties apply here
-	// refer to the comment in zobject.go:SetProperty for
-	// better understanding
+func (obj *ZObject) MakeOrphan() {
+	parentId := obj.ParentId()
 
-	if obj.parent != NULL_OBJECT_INDEX {
-		parent := other[obj.parent-1]
-		if parent.child == obj.number {
+	if parentId != NULL_OBJECT_INDEX {
+		parent := obj.object(parentId)
+		if parent.ChildId() == obj.number {
 			// obj is the first child so move to sibling
-			parent.child = obj.sibling
+			parent.setChild(obj.SiblingId())
 		} else {
 			// we are among the siblings so update previous one
-			curChildId := parent.child
+			curChildId := parent.ChildId()
 			prevChildId := NULL_OBJECT_INDEX
 
 			for curChildId != obj.number && curChildId != NULL_OBJECT_INDEX {
 				prevChildId = curChildId
-				curChildId = other[curChildId-1].sibling
+				curChildId = obj.object(curChildId).SiblingId()
 			}
-			// TODO
-			// sanity checks
 
-			// update sibling to next one
-			other[prevChildId-1].sibling = obj.sibling
+			// update sibling to next one, unless the tree is corrupted
+			// and obj is not among its parent's children
+			if curChildId == obj.number && prevChildId != NULL_OBJECT_INDEX {
+				obj.object(prevChildId).setSibling(obj.SiblingId())
+			}
 		}
 	}
-	obj.parent = NULL_OBJECT_INDEX
+	obj.setParent(NULL_OBJECT_INDEX)
+	obj.setSibling(NULL_OBJECT_INDEX)
 }
 
-func (obj *ZObject) ChangeParent(newParentId uint8, other []*ZObject) error {
-	if obj.number == newParentId {
+// ChangeParent moves obj to the first child of newParent, which comes from
+// the object table so that it's a valid object
+func (obj *ZObject) ChangeParent(newParent *ZObject) error {
+	if newParent == nil {
+		return errors.New("cannot move an object into an invalid one")
+	}
+	if obj.number == newParent.number {
 		return errors.New("trying to set object's parent to the object itself, not sure is allowed")
 	}
 
-	obj.MakeOrphan(other)
+	obj.MakeOrphan()
 
 	// change object so that its sibling is the first child of parent
 	// set parent's child to objectId
 	// set child's parent to the newParent
-	other[obj.number-1].sibling = other[newParentId-1].child
-	other[newParentId-1].child = obj.number
-	other[obj.number-1].parent = newParentId
+	obj.setSibling(newParent.ChildId())
+	newParent.setChild(obj.number)
+	obj.setParent(newParent.number)
 
 	return nil
 }
 
 func (obj *ZObject) NextProperty(prop byte) byte {
 	// props are sorted in descending order
+	next := byte(0)
 
-	if prop == 0 {
-		max := byte(0)
-		for p, _ := range obj.properties {
-			if p > max {
-				max = p
-			}
-		}
-		return max
-	} else {
-		nextMaxProp := byte(0)
-		for p, _ := range obj.properties {
-			if p < prop && p > nextMaxProp {
-				nextMaxProp = p
-			}
+	obj.forEachProperty(func(propno byte, _ uint32) bool {
+		if prop == 0 || propno < prop {
+			next = propno
+			return false
 		}
-		return nextMaxProp
-	}
+		return true
+	})
+
+	return next
 }
 
-func ZObjectAddress(idx uint8, header *ZHeader) (uint32, error) {
-	if idx < 1 {
-		return 0, errors.New("objects are numbered from 1 to 255")
+func ZObjectAddress(idx uint16, header *ZHeader) (uint32, error) {
+	format := objectFormat(header)
+	if idx < 1 || idx > format.maxObjects {
+		return 0, fmt.Errorf("objects are numbered from 1 to %d", format.maxObjects)
 	}
-	// v3 skip 31 words containing property default table
-	addr := uint32(header.objTblPos) + 31*2 + uint32(idx-1)*zobjectSize
+	// skip the property defaults table
+	addr := uint32(header.objTblPos) + format.defaultsSize() + uint32(idx-1)*format.size
 	return addr, nil
 }
 
-func ZObjectId(address uint32, header *ZHeader) uint8 {
-	res := (address - uint32(header.objTblPos) - 31*2) / zobjectSize
-	return uint8(res) + 1
+func ZObjectId(address uint32, header *ZHeader) uint16 {
+	format := objectFormat(header)
+	res := (address - uint32(header.objTblPos) - format.defaultsSize()) / format.size
+	return uint16(res) + 1
 }
 
-func ZObjectsCount(mem *ZMemory, header *ZHeader) (uint8, error) {
-	count := uint8(0)
+// ZObjectsCount infers the number of objects, the table doesn't store it
+// but the property tables usually come right after the last object so the
+// objects end where the first property table begins
+func ZObjectsCount(mem *ZMemory, header *ZHeader) (uint16, error) {
+	format := objectFormat(header)
 	firstPropertyPos := uint32(0)
 
-	addr, err := ZObjectAddress(1, header)
-	if err != nil {
-		return 0, err
-	}
-
-	seq := mem.GetSequential(addr)
-
-	doCount := func() error {
-		count++
-
-		addr, err := ZObjectAddress(count, header)
+	count := uint16(0)
+	for count < format.maxObjects {
+		addr, err := ZObjectAddress(count+1, header)
 		if err != nil {
-			return err
+			return 0, err
 		}
-
-		seq.pos = addr
-
-		if firstPropertyPos == 0 || seq.pos < firstPropertyPos {
-			seq.pos += propertyOffset
-
-			propertyPos := uint32(seq.PeekWord())
-			if firstPropertyPos == 0 || propertyPos < firstPropertyPos {
-				firstPropertyPos = propertyPos
-			}
+		if firstPropertyPos != 0 && addr >= firstPropertyPos {
+			break
 		}
 
-		return nil
-	}
+		propertyPos := uint32(mem.WordAt(addr + format.propertyOffset))
+		if propertyPos < addr+format.size {
+			return 0, fmt.Errorf("object %d has its properties at %X, inside the object table", count+1, propertyPos)
+		}
+		if firstPropertyPos == 0 || propertyPos < firstPropertyPos {
+			firstPropertyPos = propertyPos
+		}
 
-	// v3 objects tree
-	// object #1
-	// object #2
-	// ...
-	// object #N
-	// object #1 properties
-	err = doCount()
-	for err == nil && seq.pos < firstPropertyPos {
-		err = doCount()
+		count++
 	}
 
-	// do not count object #0
-	return count - 1, err
+	return count, nil
 }
 
 func (obj *ZObject) PropertiesIds() []byte {
-	var keys []int
-	for k := range obj.properties {
-		keys = append(keys, int(k))
-	}
-	sort.Sort(sort.Reverse(sort.IntSlice(keys)))
-
-	ret := make([]byte, len(keys))
+	ret := []byte{}
 
-	for i, v := range keys {
-		ret[i] = byte(v)
-	}
+	obj.forEachProperty(func(propno byte, _ uint32) bool {
+		ret = append(ret, propno)
+		return true
+	})
 
 	return ret
 }
 
-func (obj *ZObject) Id() uint8 {
+func (obj *ZObject) Id() uint16 {
 	return obj.number
 }
 
 func (obj *ZObject) Name() string {
-	return obj.name
+	propertiesPos := uint32(obj.PropertiesPos())
+
+	// number of words
+	if obj.mem.ByteAt(propertiesPos) == 0 {
+		return ""
+	}
+	return obj.mem.DecodeZStringAt(propertiesPos+1, obj.header)
 }
 
-func (obj *ZObject) ParentId() uint8 {
-	return obj.parent
+func (obj *ZObject) ParentId() uint16 {
+	return obj.readId(obj.format.parentOffset)
 }
 
-func (obj *ZObject) SiblingId() uint8 {
-	return obj.sibling
+func (obj *ZObject) SiblingId() uint16 {
+	return obj.readId(obj.format.siblingOffset)
 }
 
-func (obj *ZObject) ChildId() uint8 {
-	return obj.child
+func (obj *ZObject) ChildId() uint16 {
+	return obj.readId(obj.format.childOffset)
 }
 
 func (obj *ZObject) String() string {
 	ret := ""
 
 	ret += fmt.Sprintf("Attributes: ")
-	if len(obj.attributes) > 0 {
-		for i, attr := range obj.attributes {
-			if attr {
-				ret += fmt.Sprintf("%d, ", i)
+	if attrs := obj.Attributes(); len(attrs) > 0 {
+		for i, attr := range attrs {
+			if i > 0 {
+				ret += ", "
 			}
+			ret += fmt.Sprintf("%d", attr)
 		}
-		// do not include " ,"
-		ret = ret[:len(ret)-2]
 		ret += fmt.Sprintln("")
 	} else {
-		ret += fmt.Sprintln("None\n")
+		ret += fmt.Sprint("None\n")
 	}
 
-	ret += fmt.Sprintf("     Parent object: %3d  ", obj.parent)
-	ret += fmt.Sprintf("Sibling object: %3d  ", obj.sibling)
-	ret += fmt.Sprintf("Child object: %3d\n", obj.child)
+	ret += fmt.Sprintf("     Parent object: %3d  ", obj.ParentId())
+	ret += fmt.Sprintf("Sibling object: %3d  ", obj.SiblingId())
+	ret += fmt.Sprintf("Child object: %3d\n", obj.ChildId())
 
-	ret += fmt.Sprintf("     Property address: %04x\n", obj.propertiesPos)
-	ret += fmt.Sprintf("         Description: \"%s\"\n", obj.name)
+	ret += fmt.Sprintf("     Property address: %04x\n", obj.PropertiesPos())
+	ret += fmt.Sprintf("         Description: \"%s\"\n", obj.Name())
 
 	ret += fmt.Sprintln("          Properties:")
 
 	for _, k := range obj.PropertiesIds() {
 		ret += fmt.Sprintf("              [%2d] ", k)
-		for b := range obj.properties[k] {
-			ret += fmt.Sprintf("%02X ", obj.properties[k][b])
+		for _, b := range obj.Property(k) {
+			ret += fmt.Sprintf("%02X ", b)
 		}
 		ret += fmt.Sprintln("")
 	}
@@ -23,9 +23,30 @@ var zobjectProps [][]byte = [][]byte{
 const defaultPropByte byte = 0xFF
 const defaultPropWord uint16 = uint16(defaultPropByte)<<8 | uint16(defaultPropByte)
 
+type zobjectTestData struct {
+	number        uint16
+	attributes    [32]bool
+	parent        uint16
+	sibling       uint16
+	child         uint16
+	name          string
+	propertiesPos uint16
+	properties    map[byte][]byte
+}
+
+func (obj *zobjectTestData) PropertiesIds() []byte {
+	ret := []byte{}
+	for id := byte(31); id > 0; id-- {
+		if _, ok := obj.properties[id]; ok {
+			ret = append(ret, id)
+		}
+	}
+	return ret
+}
+
 // TODO generate automatically propertiesPos
-var zobjectExpected []ZObject = []ZObject{
-	ZObject{
+var zobjectExpected []zobjectTestData = []zobjectTestData{
+	zobjectTestData{
 		number:        1,
 		attributes:    genAttrs(14, 28),
 		parent:        0,
@@ -38,7 +59,7 @@ var zobjectExpected []ZObject = []ZObject{
 			16: []byte{0x82},
 		},
 	},
-	ZObject{
+	zobjectTestData{
 		number:        2,
 		attributes:    genAttrs(7, 22, 23),
 		parent:        1,
@@ -51,7 +72,7 @@ var zobjectExpected []ZObject = []ZObject{
 			16: []byte{0x82, 0x21},
 		},
 	},
-	ZObject{
+	zobjectTestData{
 		number:        3,
 		attributes:    genAttrs(7, 22, 23),
 		parent:        1,
@@ -85,7 +106,7 @@ func createZObjectBuf() []byte {
 		ret[i] = defaultPropByte
 	}
 
-	firstPropPos := uint16(len(ret)) + uint16(len(zobjectData))*uint16(zobjectSize)
+	firstPropPos := uint16(len(ret)) + uint16(len(zobjectData))*uint16(zobjectFormatV3.size)
 
 	lastPropPos := firstPropPos
 	for i := range zobjectData {
@@ -103,22 +124,22 @@ func createZObjectBuf() []byte {
 	return ret
 }
 
-func prelude() (*ZMemory, *ZHeader, uint8) {
-	mem := ZMemory(createZObjectBuf())
+func prelude() (*ZMemory, *ZHeader, uint16) {
+	mem := NewZMemory(createZObjectBuf())
 	header := &ZHeader{objTblPos: 0x00}
 
-	count, err := ZObjectsCount(&mem, header)
+	count, err := ZObjectsCount(mem, header)
 	if err != nil {
 		panic("count failed -> test corrupted")
 	}
 
-	return &mem, header, count
+	return mem, header, count
 }
 
 func TestZObjectCount(t *testing.T) {
 	_, _, count := prelude()
 
-	if count != uint8(len(zobjectExpected)) {
+	if count != uint16(len(zobjectExpected)) {
 		t.Fail()
 	}
 }
@@ -126,7 +147,7 @@ func TestZObjectCount(t *testing.T) {
 func TestZObject(t *testing.T) {
 	mem, header, count := prelude()
 
-	for i := uint8(0); i < count; i++ {
+	for i := uint16(0); i < count; i++ {
 		obj, err := NewZObject(mem, i+1, header)
 		if err != nil {
 			t.Fail()
@@ -134,24 +155,29 @@ func TestZObject(t *testing.T) {
 
 		expected := zobjectExpected[i]
 
-		if obj.number != expected.number ||
-			obj.attributes != expected.attributes ||
-			obj.parent != expected.parent ||
-			obj.sibling != expected.sibling ||
-			obj.child != expected.child ||
-			obj.name != expected.name ||
-			obj.propertiesPos != expected.propertiesPos ||
+		attributes := [32]bool{}
+		for attr := range attributes {
+			attributes[attr] = obj.TestAttribute(byte(attr))
+		}
+
+		if obj.Id() != expected.number ||
+			attributes != expected.attributes ||
+			obj.ParentId() != expected.parent ||
+			obj.SiblingId() != expected.sibling ||
+			obj.ChildId() != expected.child ||
+			obj.Name() != expected.name ||
+			obj.PropertiesPos() != expected.propertiesPos ||
 			obj.mem != mem {
 			t.Fail()
 		}
 
-		if len(obj.properties) != len(expected.properties) {
+		if len(obj.PropertiesIds()) != len(expected.properties) {
 			t.Fail()
 		}
 
 		for k, v := range expected.properties {
-			p, ok := obj.properties[k]
-			if !ok {
+			p := obj.Property(k)
+			if p == nil {
 				t.Fail()
 			}
 
@@ -172,7 +198,7 @@ func TestZObject(t *testing.T) {
 func TestZObjectGetProperty(t *testing.T) {
 	mem, header, count := prelude()
 
-	for i := byte(0); i < count; i++ {
+	for i := uint16(0); i < count; i++ {
 		obj, err := NewZObject(mem, i+1, header)
 		if err != nil {
 			t.Fail()
@@ -199,7 +225,7 @@ func TestZObjectGetProperty(t *testing.T) {
 		}
 
 		// should return default property
-		if _, ok := obj.properties[31]; !ok {
+		if obj.Property(31) == nil {
 			p, err := obj.GetProperty(31)
 
 			if err != nil && p != defaultPropWord {
@@ -212,7 +238,7 @@ func TestZObjectGetProperty(t *testing.T) {
 func TestZObjectSetProperty(t *testing.T) {
 	mem, header, count := prelude()
 
-	for i := byte(0); i < count; i++ {
+	for i := uint16(0); i < count; i++ {
 		obj, err := NewZObject(mem, i+1, header)
 		if err != nil {
 			t.Fail()
@@ -220,7 +246,8 @@ func TestZObjectSetProperty(t *testing.T) {
 
 		var expected uint16
 
-		for id, prop := range obj.properties {
+		for _, id := range obj.PropertiesIds() {
+			prop := obj.Property(id)
 			ok := true
 			switch len(prop) {
 			case 1:
@@ -233,9 +260,16 @@ func TestZObjectSetProperty(t *testing.T) {
 
 			if ok {
 				obj.SetProperty(id, expected)
-				if p, err := obj.GetProperty(id); err != nil && p != expected {
+				if p, err := obj.GetProperty(id); err != nil || p != expected {
 					t.Fail()
 				}
+
+				// the change must be visible in memory
+				for _, b := range obj.Property(id) {
+					if b != defaultPropByte {
+						t.Fail()
+					}
+				}
 			}
 		}
 	}
@@ -244,26 +278,26 @@ func TestZObjectSetProperty(t *testing.T) {
 func TestZObjectPropertyLen(t *testing.T) {
 	mem, header, count := prelude()
 
-	for i := byte(0); i < count; i++ {
+	for i := uint16(0); i < count; i++ {
 		obj, err := NewZObject(mem, i+1, header)
 		if err != nil {
 			t.Fail()
 		}
 
-		seq := mem.GetSequential(uint32(obj.propertiesPos))
-		if seq.ReadByte() != 0 {
+		seq := mem.GetSequential(uint32(obj.PropertiesPos()))
+		if seq.ReadUint8() != 0 {
 			// skip name
 			seq.DecodeZString(header)
 		}
 		// skip dataSize
-		seq.ReadByte()
+		seq.ReadUint8()
 
 		propertyPos := uint16(seq.pos)
 
 		for _, k := range obj.PropertiesIds() {
-			prop := obj.properties[k]
+			prop := obj.Property(k)
 
-			if GetPropertyLen(mem, uint32(propertyPos)) != uint16(len(prop)) {
+			if GetPropertyLen(mem, uint32(propertyPos), header) != uint16(len(prop)) {
 				t.Fail()
 			}
 
@@ -276,15 +310,15 @@ func TestZObjectPropertyLen(t *testing.T) {
 func TestZObjectGetFirstPropertyAddr(t *testing.T) {
 	mem, header, count := prelude()
 
-	for i := byte(0); i < count; i++ {
+	for i := uint16(0); i < count; i++ {
 		obj, err := NewZObject(mem, i+1, header)
 		if err != nil {
 			t.Fail()
 		}
 
-		seq := mem.GetSequential(uint32(obj.propertiesPos))
+		seq := mem.GetSequential(uint32(obj.PropertiesPos()))
 
-		if seq.ReadByte() != 0 {
+		if seq.ReadUint8() != 0 {
 			// skip name
 			seq.DecodeZString(header)
 		}
@@ -298,15 +332,15 @@ func TestZObjectGetFirstPropertyAddr(t *testing.T) {
 func TestZObjectGetPropertyAddr(t *testing.T) {
 	mem, header, count := prelude()
 
-	for i := byte(0); i < count; i++ {
+	for i := uint16(0); i < count; i++ {
 		obj, err := NewZObject(mem, i+1, header)
 		if err != nil {
 			t.Fail()
 		}
 
-		seq := mem.GetSequential(uint32(obj.propertiesPos))
+		seq := mem.GetSequential(uint32(obj.PropertiesPos()))
 
-		if seq.ReadByte() != 0 {
+		if seq.ReadUint8() != 0 {
 			// skip name
 			seq.DecodeZString(header)
 		}
@@ -346,7 +380,7 @@ func TestZObjectGetPropertyAddr(t *testing.T) {
 func TestZObjectNextProperty(t *testing.T) {
 	mem, header, count := prelude()
 
-	for i := byte(0); i < count; i++ {
+	for i := uint16(0); i < count; i++ {
 		obj, err := NewZObject(mem, i+1, header)
 		if err != nil {
 			t.Fail()
@@ -370,7 +404,7 @@ func TestZObjectNextProperty(t *testing.T) {
 
 func TestZObjectId(t *testing.T) {
 	header := &ZHeader{objTblPos: 0}
-	for i := byte(0); i < 255; i++ {
+	for i := uint16(0); i < 255; i++ {
 		addr, err := ZObjectAddress(i+1, header)
 
 		if err != nil || ZObjectId(addr, header) != i+1 {
@@ -378,3 +412,104 @@ func TestZObjectId(t *testing.T) {
 		}
 	}
 }
+
+func TestZObjectWriteThrough(t *testing.T) {
+	mem, header, _ := prelude()
+
+	obj1, _ := NewZObject(mem, 1, header)
+	obj2, _ := NewZObject(mem, 2, header)
+	obj3, _ := NewZObject(mem, 3, header)
+
+	entry := func(obj *ZObject, offset uint32) byte {
+		return mem.ByteAt(obj.addr + offset)
+	}
+
+	obj1.SetAttribute(0, true)
+	obj1.SetAttribute(14, false)
+	obj1.SetAttribute(31, true)
+	if entry(obj1, 0) != 0x80 || entry(obj1, 1) != 0x00 || entry(obj1, 3) != 0x09 {
+		t.Errorf("attributes not written to memory: %X", mem.UInt32At(obj1.addr))
+	}
+
+	if err := obj3.ChangeParent(nil); err == nil {
+		t.Error("moved an object into an invalid one")
+	}
+	obj3.ChangeParent(obj1)
+	if entry(obj1, zobjectFormatV3.childOffset) != 3 || entry(obj3, zobjectFormatV3.parentOffset) != 1 || entry(obj3, zobjectFormatV3.siblingOffset) != 2 {
+		t.Error("insert_obj not written to memory")
+	}
+
+	obj2.MakeOrphan()
+	if entry(obj2, zobjectFormatV3.parentOffset) != 0 || entry(obj3, zobjectFormatV3.siblingOffset) != 0 || entry(obj1, zobjectFormatV3.childOffset) != 3 {
+		t.Error("remove_obj not written to memory")
+	}
+
+	// changes made directly to memory are visible to the objects
+	mem.WriteByteAt(obj2.addr+zobjectFormatV3.parentOffset, 3)
+	if obj2.ParentId() != 3 {
+		t.Fail()
+	}
+}
+
+func TestZObjectV4(t *testing.T) {
+	header := &ZHeader{version: 4, objTblPos: 0}
+	format := zobjectFormatV4
+
+	buf := make([]byte, format.defaultsSize()+2*format.size)
+	buf[4*2-1] = 0x42 // default of property 4
+
+	// object #1 has attribute 47 and object #300 as parent
+	obj1 := format.defaultsSize()
+	buf[obj1+5] = 0x01
+	buf[obj1+6], buf[obj1+7] = 0x01, 0x2C
+
+	props := uint32(len(buf))
+	buf[obj1+12], buf[obj1+13] = byte(props>>8), byte(props)
+
+	// no name, property 40 with two size bytes and 3 bytes of data,
+	// property 5 of 2 bytes and property 2 of 1 byte
+	buf = append(buf, 0x00,
+		0x80|40, 0x80|3, 1, 2, 3,
+		0x40|5, 0xAB, 0xCD,
+		2, 0xEF,
+		0)
+
+	mem := NewZMemory(buf)
+	obj, err := NewZObject(mem, 1, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !obj.TestAttribute(47) || obj.TestAttribute(32) {
+		t.Errorf("unexpected attributes %v", obj.Attributes())
+	}
+
+	if obj.ParentId() != 300 {
+		t.Errorf("unexpected parent %d", obj.ParentId())
+	}
+
+	if ids := obj.PropertiesIds(); len(ids) != 3 || ids[0] != 40 || ids[1] != 5 || ids[2] != 2 {
+		t.Errorf("unexpected properties %v", ids)
+	}
+
+	addr := obj.GetPropertyAddr(40)
+	if addr != props+3 || GetPropertyLen(mem, addr, header) != 3 {
+		t.Errorf("unexpected property 40 at %X", addr)
+	}
+
+	if v, err := obj.GetProperty(5); err != nil || v != 0xABCD {
+		t.Errorf("unexpected property 5 %X", v)
+	}
+	if v, err := obj.GetProperty(2); err != nil || v != 0xEF {
+		t.Errorf("unexpected property 2 %X", v)
+	}
+	if v, err := obj.GetProperty(4); err != nil || v != 0x42 {
+		t.Errorf("unexpected default property %X", v)
+	}
+
+	// 64 bytes long properties have a length of 0
+	mem.WriteByteAt(props+2, 0x80)
+	if GetPropertyLen(mem, addr, header) != 64 {
+		t.Error("length 0 is not 64")
+	}
+}
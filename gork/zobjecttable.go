@@ -0,0 +1,74 @@
+package gork
+
+import (
+	"fmt"
+)
+
+// ZObjectTable is the object tree of a story, it hides the layout of the
+// table which depends on the version: up to v3 there are 255 objects with
+// 32 attributes, from v4 65535 objects with 48 attributes. The objects are
+// views on memory, so the table only needs to be rebuilt when the whole
+// dynamic memory is replaced.
+type ZObjectTable struct {
+	mem    *ZMemory
+	header *ZHeader
+	format *zobjectFormat
+	count  uint16
+}
+
+func NewZObjectTable(mem *ZMemory, header *ZHeader) (*ZObjectTable, error) {
+	count, err := ZObjectsCount(mem, header)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ZObjectTable{
+		mem:    mem,
+		header: header,
+		format: objectFormat(header),
+		count:  count,
+	}, nil
+}
+
+// Count returns the number of objects, the table doesn't store it so it's
+// inferred from where the property tables start
+func (table *ZObjectTable) Count() uint16 {
+	return table.count
+}
+
+func (table *ZObjectTable) AttributesCount() byte {
+	return table.format.attributesCount
+}
+
+func (table *ZObjectTable) PropertiesCount() byte {
+	return table.format.propertiesCount
+}
+
+// Object returns the object id, objects are numbered from 1
+func (table *ZObjectTable) Object(id uint16) (*ZObject, error) {
+	if id < 1 || id > table.count {
+		return nil, fmt.Errorf("invalid object %d, objects are numbered from 1 to %d", id, table.count)
+	}
+
+	return NewZObject(table.mem, id, table.header)
+}
+
+// DefaultProperty returns the value of propertyId of the objects that
+// don't have it
+func (table *ZObjectTable) DefaultProperty(propertyId byte) (uint16, error) {
+	return defaultProperty(table.mem, propertyId, table.header)
+}
+
+// Roots returns the objects without a parent
+func (table *ZObjectTable) Roots() []*ZObject {
+	roots := []*ZObject{}
+
+	for id := uint16(1); id <= table.count; id++ {
+		obj, _ := table.Object(id)
+		if obj.ParentId() == NULL_OBJECT_INDEX {
+			roots = append(roots, obj)
+		}
+	}
+
+	return roots
+}
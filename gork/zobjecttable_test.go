@@ -0,0 +1,79 @@
+package gork
+
+import (
+	"testing"
+)
+
+func TestZObjectTable(t *testing.T) {
+	mem, header, count := prelude()
+
+	objects, err := NewZObjectTable(mem, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if objects.Count() != count || objects.AttributesCount() != 32 || objects.PropertiesCount() != 31 {
+		t.Errorf("unexpected table %d objects", objects.Count())
+	}
+
+	for _, id := range []uint16{0, count + 1} {
+		if _, err := objects.Object(id); err == nil {
+			t.Errorf("object %d found", id)
+		}
+	}
+
+	obj, err := objects.Object(count)
+	if err != nil || obj.Id() != count {
+		t.Errorf("object %d not found", count)
+	}
+
+	if _, err := objects.DefaultProperty(32); err == nil {
+		t.Error("invalid default property read")
+	}
+
+	for _, root := range objects.Roots() {
+		if root.ParentId() != NULL_OBJECT_INDEX {
+			t.Errorf("object %d is not a root", root.Id())
+		}
+	}
+}
+
+func TestZObjectTableV4(t *testing.T) {
+	header := &ZHeader{version: 4, objTblPos: 0}
+	format := zobjectFormatV4
+
+	// more objects than v3 can have, all sharing the same property
+	// table, the last one is the child of the first one
+	const count = 300
+	buf := make([]byte, format.defaultsSize()+count*format.size)
+	props := len(buf)
+	buf = append(buf, 0, 0)
+
+	for i := uint32(0); i < count; i++ {
+		obj := format.defaultsSize() + i*format.size
+		buf[obj+format.propertyOffset] = byte(props >> 8)
+		buf[obj+format.propertyOffset+1] = byte(props)
+	}
+	first := format.defaultsSize()
+	buf[first+format.childOffset], buf[first+format.childOffset+1] = 0x01, 0x2C
+	last := format.defaultsSize() + (count-1)*format.size
+	buf[last+format.parentOffset+1] = 1
+
+	objects, err := NewZObjectTable(NewZMemory(buf), header)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if objects.Count() != count || objects.AttributesCount() != 48 || objects.PropertiesCount() != 63 {
+		t.Fatalf("unexpected table %d objects", objects.Count())
+	}
+
+	obj, _ := objects.Object(1)
+	if obj.ChildId() != count {
+		t.Errorf("unexpected child %d", obj.ChildId())
+	}
+
+	if roots := objects.Roots(); len(roots) != count-1 {
+		t.Errorf("found %d roots", len(roots))
+	}
+}
@@ -11,9 +11,9 @@ import (
 const (
 	// optypes
 	LARGE_CONSTANT    = byte(0x00)
-	SMALL_CONSTANT    = byte(0X01)
-	VARIABLE_CONSTANT = byte(0X02)
-	OMMITTED_CONSTANT = byte(0X03)
+	SMALL_CONSTANT    = byte(0x01)
+	VARIABLE_CONSTANT = byte(0x02)
+	OMMITTED_CONSTANT = byte(0x03)
 )
 
 const (
@@ -21,31 +21,99 @@ const (
 	ONEOP  = byte(0x01)
 	TWOOP  = byte(0x02)
 	VAROP  = byte(0x03)
-	// v3 ignore EXTENDED OPERAND
+	// v5
+	EXTOP = byte(0x04)
 )
 
+// v5 extended opcodes start with this byte
+const extendedForm = byte(0xBE)
+
+// the trailers which follow the operands of an instruction, opEnd marks
+// the instructions which may not go on with the next one
+const (
+	opStore = byte(1 << iota)
+	opBranch
+	opText
+	opEnd
+)
+
+var (
+	zeroOpShapes = [16]byte{
+		0: opEnd, 1: opEnd, 2: opText, 3: opText | opEnd, 5: opBranch,
+		6: opBranch, 7: opEnd, 8: opEnd, 10: opEnd, 13: opBranch, 15: opBranch,
+	}
+	oneOpShapes = [16]byte{
+		0: opBranch, 1: opStore | opBranch, 2: opStore | opBranch, 3: opStore,
+		4: opStore, 8: opStore | opEnd, 11: opEnd, 12: opEnd, 14: opStore,
+		15: opStore,
+	}
+	twoOpShapes = [32]byte{
+		1: opBranch, 2: opBranch, 3: opBranch, 4: opBranch, 5: opBranch,
+		6: opBranch, 7: opBranch, 8: opStore, 9: opStore, 10: opBranch,
+		15: opStore, 16: opStore, 17: opStore, 18: opStore, 19: opStore,
+		20: opStore, 21: opStore, 22: opStore, 23: opStore, 24: opStore,
+		25: opStore | opEnd, 26: opEnd, 28: opEnd,
+	}
+	varOpShapes = [32]byte{
+		0: opStore | opEnd, 4: opEnd, 7: opStore, 12: opStore | opEnd,
+		22: opStore | opEnd, 23: opStore | opBranch, 24: opStore, 25: opEnd,
+		26: opEnd, 31: opBranch,
+	}
+	extOpShapes = [32]byte{
+		0: opStore | opEnd, 1: opStore | opEnd, 2: opStore, 3: opStore,
+		4: opStore, 9: opStore | opEnd, 10: opStore | opEnd, 12: opStore,
+	}
+)
+
+// zbranch is the branch data of an instruction
+type zbranch struct {
+	onTrue bool
+	// 0 and 1 return false and true
+	offset int32
+}
+
+// ZOp is a decoded instruction, it's decoded once and it can be executed
+// many times: the variables among the operands are read only when it's
+// executed
 type ZOp struct {
-	zm       *ZMachine
-	opcode   byte
-	class    byte
-	optypes  []byte
-	operands []uint16 // actually not all operands are large constants
+	zm      *ZMachine
+	opcode  byte
+	class   byte
+	optypes []byte
+	// the values of the constants and the numbers of the variables
+	operands []uint16
 	name     string
 
-	// optional values are not read,
-	// the actual implementation of the functions will read them
-	// possible values are:
-	// - store  	byte
-	// - branch(es) word
-	// - text   	zstring
+	// where the instruction starts, where its trailers start and where
+	// the next instruction starts
+	pc       uint32
+	trailers uint32
+	next     uint32
+
+	shape  byte
+	store  byte
+	branch zbranch
+	text   string
+
+	// the function executing the instruction, nil if the opcode doesn't
+	// exist
+	zeroOp ZeroOpFunc
+	oneOp  OneOpFunc
+	twoOp  TwoOpFunc
+	varOp  VarOpFunc
 }
 
-func NewZOp(zm *ZMachine) (*ZOp, error) {
-	zop := new(ZOp)
+// NewZOp decodes the instruction at PC, the PC is moved to the next one
+func NewZOp(zm *ZMachine) (zop *ZOp, err error) {
+	// the instruction may run past the end of memory
+	defer recoverFault(&err)
+
+	zop = new(ZOp)
 
 	zop.zm = zm
+	zop.pc = zm.seq.pos
 
-	opcode := zm.seq.ReadByte()
+	opcode := zm.seq.ReadUint8()
 
 	if opcode < 0x80 {
 		zop.class = TWOOP
@@ -57,22 +125,34 @@ func NewZOp(zm *ZMachine) (*ZOp, error) {
 		zop.class = VAROP
 	}
 
-	var err error = nil
-	switch opcode >> 6 {
-	case 0x03:
+	switch {
+	case opcode == extendedForm && zm.header.version >= 5:
+		zop.class = EXTOP
+		err = zop.configureExtended()
+	case opcode>>6 == 0x03:
 		err = zop.configureVar(opcode)
-	case 0x02:
+	case opcode>>6 == 0x02:
 		zop.configureShort(opcode)
 	default:
 		zop.configureLong(opcode)
-		// v3 ignore EXTENDED
 	}
 
 	zop.name = zop.getOpName()
+	zop.configureFunc()
+	zop.trailers = zm.seq.pos
+	zop.readTrailers()
+	zop.next = zm.seq.pos
 
 	return zop, err
 }
 
+func (zop *ZOp) configureExtended() error {
+	// the opcode is in the following byte, the operands are the same as
+	// the variable form
+	zop.opcode = zop.zm.seq.ReadUint8()
+	return zop.readVarOperands(false)
+}
+
 func (zop *ZOp) configureVar(op byte) error {
 	// opcode is stored in the bottom 5 bits
 	zop.opcode = op & 0x1F
@@ -84,16 +164,27 @@ func (zop *ZOp) configureVar(op byte) error {
 		zop.class = VAROP
 	}
 
+	// call_vs2 and call_vn2 accept up to 8 operands and have 2 bytes
+	// of types
+	return zop.readVarOperands(op == 0xEC || op == 0xFA)
+}
+
+func (zop *ZOp) readVarOperands(doubleTypes bool) error {
 	// types are stored in an additional byte
 	// 2 bits per type
 	// bits #7 #6 are first operand's type
 	// bits #1 #0 are last operand's type
-	types := zop.zm.seq.ReadByte()
+	typesLen := 8
+	types := uint16(zop.zm.seq.ReadUint8()) << 8
+	if doubleTypes {
+		typesLen = 16
+		types |= uint16(zop.zm.seq.ReadUint8())
+	}
 
-	i := 6
+	i := 14
 
-	for ; i >= 0; i -= 2 {
-		ty := (types >> byte(i)) & 0x03
+	for ; i >= 16-typesLen; i -= 2 {
+		ty := byte(types>>uint(i)) & 0x03
 		if ty == OMMITTED_CONSTANT {
 			break
 		}
@@ -101,8 +192,8 @@ func (zop *ZOp) configureVar(op byte) error {
 		zop.operands = append(zop.operands, zop.readOpType(ty))
 	}
 
-	for ; i >= 0; i -= 2 {
-		if (types>>byte(i))&0x03 != OMMITTED_CONSTANT {
+	for ; i >= 16-typesLen; i -= 2 {
+		if byte(types>>uint(i))&0x03 != OMMITTED_CONSTANT {
 			return errors.New("non omitted type after omitted one!")
 		}
 	}
@@ -155,28 +246,175 @@ func (zop *ZOp) configureLong(op byte) {
 	}
 }
 
+// opFunc returns the function of opcode in table, nil for the opcodes
+// which don't exist in the version of the story
+func opFunc[F any](table []F, opcode byte) F {
+	var fn F
+	if int(opcode) < len(table) {
+		fn = table[opcode]
+	}
+	return fn
+}
+
+// readOpType reads an operand, variables are read when the instruction is
+// executed so only their number is read
 func (zop *ZOp) readOpType(optype byte) uint16 {
 	if optype == LARGE_CONSTANT {
 		return zop.zm.seq.ReadWord()
-	} else if optype == VARIABLE_CONSTANT {
-		tmp := zop.zm.GetVarAt(zop.zm.seq.ReadByte())
-		return tmp
+	}
+	return uint16(zop.zm.seq.ReadUint8())
+}
+
+// configureFunc looks up the function of the opcode
+func (zop *ZOp) configureFunc() {
+	switch zop.class {
+	case ZEROOP:
+		zop.zeroOp = opFunc(zeroOpTable(zop.version()), zop.opcode)
+	case ONEOP:
+		zop.oneOp = opFunc(oneOpTable(zop.version()), zop.opcode)
+	case TWOOP:
+		if zop.opcode == 1 {
+			// ZJe is a two op func but it accepts VAR count of args
+			zop.varOp = ZJe
+		} else {
+			zop.twoOp = opFunc(twoOpFuncs, zop.opcode)
+		}
+	case VAROP:
+		zop.varOp = opFunc(varOpFuncs, zop.opcode)
+	case EXTOP:
+		zop.varOp = opFunc(extOpFuncs, zop.opcode)
+	}
+}
+
+// opShape returns which trailers follow the instruction
+func (zop *ZOp) opShape() byte {
+	version := zop.version()
+
+	switch zop.class {
+	case ZEROOP:
+		switch {
+		case (zop.opcode == 5 || zop.opcode == 6) && version >= 4:
+			// save and restore store their result from v4
+			return opStore | opEnd
+		case zop.opcode == 9 && version >= 5:
+			// catch
+			return opStore
+		}
+		return zeroOpShapes[zop.opcode&0x0F]
+	case ONEOP:
+		if zop.opcode == 15 && version >= 5 {
+			// call_1n
+			return opEnd
+		}
+		return oneOpShapes[zop.opcode&0x0F]
+	case TWOOP:
+		return twoOpShapes[zop.opcode&0x1F]
+	case VAROP:
+		if zop.opcode == 4 && version >= 5 {
+			// aread stores the terminating character
+			return opStore | opEnd
+		}
+		return varOpShapes[zop.opcode&0x1F]
+	case EXTOP:
+		if int(zop.opcode) < len(extOpShapes) {
+			return extOpShapes[zop.opcode]
+		}
+	}
+	return 0
+}
+
+func (zop *ZOp) readTrailers() {
+	zop.shape = zop.opShape()
+	seq := zop.zm.seq
+
+	if zop.shape&opStore != 0 {
+		zop.store = seq.ReadUint8()
+	}
+	if zop.shape&opBranch != 0 {
+		zop.branch = seq.readBranch()
+	}
+	if zop.shape&opText != 0 {
+		zop.text = seq.DecodeZString(zop.zm.header)
+	}
+}
+
+// readBranch reads the branch data of an instruction
+func (seq *ZMemorySequential) readBranch() zbranch {
+	info := seq.ReadUint8()
+
+	// if bit #7 is set than branch on true
+	branch := zbranch{onTrue: (info >> 7) != 0x00}
+
+	// if bit #6 is set than the offset is stored in the bottom
+	// 6 bits
+	if info&0x40 != 0x00 {
+		branch.offset = int32(info & 0x3F)
 	} else {
-		return uint16(zop.zm.seq.ReadByte())
+		// if bit #6 is clear than the offset is store in a 14 bit signed
+		// integer composed by the bottom 5 bits of info and 8 bits of an
+		// additional byte
+		firstPart := uint16(info & 0x3F)
+
+		// if sign bit(#6) is set then it's a negative number
+		// in two complement form, so set the bits #6 and #7 too
+		if firstPart&0x20 != 0x00 {
+			firstPart |= 0x3 << 6
+		}
+
+		branch.offset = int32(int16(firstPart<<8) | int16(seq.ReadUint8()))
+	}
+
+	return branch
+}
+
+// exec runs the instruction, PC must already point to the next one
+func (zop *ZOp) exec(zm *ZMachine) {
+	// the variables are read in order, the stack is popped as they are
+	args := zm.args[:len(zop.operands)]
+	for i, ty := range zop.optypes {
+		if ty == VARIABLE_CONSTANT {
+			args[i] = zm.GetVarAt(byte(zop.operands[i]))
+		} else {
+			args[i] = zop.operands[i]
+		}
+	}
+
+	switch {
+	case zop.zeroOp != nil:
+		zop.zeroOp(zm)
+	case zop.oneOp != nil && len(args) >= 1:
+		zop.oneOp(zm, args[0])
+	case zop.twoOp != nil && len(args) >= 2:
+		zop.twoOp(zm, args[0], args[1])
+	case zop.varOp != nil:
+		zop.varOp(zm, args)
+	case zop.oneOp != nil || zop.twoOp != nil:
+		zm.fail(errMissingOperands)
+	default:
+		zm.fail(errUnknownOpcode)
 	}
 }
 
+// version returns the version of the story the instruction belongs to,
+// instructions without a machine are v3
+func (zop *ZOp) version() byte {
+	if zop.zm == nil {
+		return 3
+	}
+	return zop.zm.header.version
+}
+
 func (zop *ZOp) getOpName() string {
 	var fn interface{} = nil
 
 	switch zop.class {
 	case ZEROOP:
-		if int(zop.opcode) < len(zeroOpFuncs) {
-			fn = zeroOpFuncs[zop.opcode]
+		if ops := zeroOpTable(zop.version()); int(zop.opcode) < len(ops) {
+			fn = ops[zop.opcode]
 		}
 	case ONEOP:
-		if int(zop.opcode) < len(oneOpFuncs) {
-			fn = oneOpFuncs[zop.opcode]
+		if ops := oneOpTable(zop.version()); int(zop.opcode) < len(ops) {
+			fn = ops[zop.opcode]
 		}
 	case TWOOP:
 		if zop.opcode == 1 {
@@ -190,6 +428,10 @@ func (zop *ZOp) getOpName() string {
 		if int(zop.opcode) < len(varOpFuncs) {
 			fn = varOpFuncs[zop.opcode]
 		}
+	case EXTOP:
+		if int(zop.opcode) < len(extOpFuncs) {
+			fn = extOpFuncs[zop.opcode]
+		}
 	}
 	return getFuncName(fn, "unknown opcode name")
 }
@@ -229,6 +471,8 @@ func (zop *ZOp) String() string {
 		ret += "2OP"
 	case VAROP:
 		ret += "VAR"
+	case EXTOP:
+		ret += "EXT"
 	}
 	ret += "\n"
 
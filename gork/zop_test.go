@@ -6,7 +6,7 @@ import "testing"
 
 var zopBuf [][]byte = [][]byte{
 	[]byte{
-		0xE0, 0x3, 0x2A, 0x39, 0x80, 0x10, 0xFF, 0xFF,
+		0xE0, 0x3, 0x2A, 0x39, 0x80, 0x10, 0xFF, 0xFF, 0x10,
 	},
 	[]byte{
 		0x8C, 0xFF, 0xD7,
@@ -15,7 +15,7 @@ var zopBuf [][]byte = [][]byte{
 		0x0D, 0x10, 0xB4,
 	},
 	[]byte{
-		0xB2,
+		0xB2, 0xB8, 0xA5,
 	},
 }
 
@@ -31,7 +31,9 @@ var zopExpected []ZOp = []ZOp{
 		operands: []uint16{
 			0x2A39, 0x8010, 0xFFFF,
 		},
-		name: "ZCall",
+		name:  "ZCall",
+		store: 0x10,
+		next:  9,
 	},
 	ZOp{
 		opcode: 12,
@@ -43,6 +45,7 @@ var zopExpected []ZOp = []ZOp{
 			0xFFD7,
 		},
 		name: "ZJump",
+		next: 3,
 	},
 	ZOp{
 		opcode: 13,
@@ -55,6 +58,7 @@ var zopExpected []ZOp = []ZOp{
 			0x10, 0xB4,
 		},
 		name: "ZStore",
+		next: 3,
 	},
 	ZOp{
 		opcode:   2,
@@ -62,13 +66,15 @@ var zopExpected []ZOp = []ZOp{
 		optypes:  []byte{},
 		operands: []uint16{},
 		name:     "ZPrint",
+		text:     "i",
+		next:     3,
 	},
 }
 
 func TestZOP(t *testing.T) {
 	for i, mem := range zopBuf {
 
-		zmem := ZMemory(mem)
+		zmem := NewZMemory(mem)
 		zmachine := &ZMachine{
 			header: &ZHeader{},
 			seq:    zmem.GetSequential(0),
@@ -86,6 +92,11 @@ func TestZOP(t *testing.T) {
 			t.Fail()
 		}
 
+		if zop.store != expected.store || zop.text != expected.text ||
+			zop.next != expected.next || zmachine.seq.pos != expected.next {
+			t.Errorf("unexpected trailers of %s", zop.name)
+		}
+
 		for j, ty := range zop.optypes {
 			if ty != expected.optypes[j] {
 				t.Fail()
@@ -1,8 +1,9 @@
 package gork
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
-	"math/rand"
 	"strings"
 	"time"
 )
@@ -12,108 +13,268 @@ type OneOpFunc func(*ZMachine, uint16)
 type TwoOpFunc func(*ZMachine, uint16, uint16)
 type VarOpFunc func(*ZMachine, []uint16)
 
-var zeroOpFuncs = []ZeroOpFunc{
-	ZReturnTrue,
-	ZReturnFalse,
-	ZPrint,
-	ZPrintRet,
-	nil,
-	nil,
-	nil,
-	nil,
-	ZRetPop,
-	nil,
-	nil,
-	ZNl,
-}
-
-var oneOpFuncs = []OneOpFunc{
-	ZJ0,
-	ZGetSibling,
-	ZGetChild,
-	ZGetParent,
-	ZGetPropLen,
-	ZInc,
-	ZDec,
-	ZPrintAt,
-	nil,
-	ZMakeObjOrphan,
-	ZPrintObject,
-	ZReturn,
-	ZJump,
-	ZPrintAtPacked,
-	ZLoad,
-	ZNot,
-}
-
-var twoOpFuncs = []TwoOpFunc{
-	ZNOOP,
-	nil, // ZJe is a two op func but it accepts VAR count of args
-	ZJl,
-	ZJg,
-	ZDecChk,
-	ZIncChk,
-	ZJin,
-	ZTest,
-	ZOr,
-	ZAnd,
-	ZTestAttr,
-	ZSetAttr,
-	ZClearAttr,
-	ZStore,
-	ZInsertObj,
-	ZLoadW,
-	ZLoadB,
-	ZGetProp,
-	ZGetPropAddr,
-	ZGetNextProp,
-	ZAdd,
-	ZSub,
-	ZMul,
-	ZDiv,
-	ZMod,
-}
-
-var varOpFuncs = []VarOpFunc{
-	ZCall,
-	ZStoreW,
-	ZStoreB,
-	ZPutProp,
-	ZRead,
-	ZPrintChar,
-	ZPrintNum,
-	ZRandom,
-	ZPush,
-	ZPull,
+var (
+	zeroOpFuncs []ZeroOpFunc
+	oneOpFuncs  []OneOpFunc
+	twoOpFuncs  []TwoOpFunc
+	varOpFuncs  []VarOpFunc
+	extOpFuncs  []VarOpFunc
+
+	// v5 pop became catch and not became call_1n
+	zeroOpFuncsV5 []ZeroOpFunc
+	oneOpFuncsV5  []OneOpFunc
+)
+
+func zeroOpTable(version byte) []ZeroOpFunc {
+	if version >= 5 {
+		return zeroOpFuncsV5
+	}
+	return zeroOpFuncs
 }
 
-func ZCall(zm *ZMachine, operands []uint16) {
-	routineAddr := PackedAddress(uint32(operands[0]))
+func oneOpTable(version byte) []OneOpFunc {
+	if version >= 5 {
+		return oneOpFuncsV5
+	}
+	return oneOpFuncs
+}
+
+// the tables are filled in init because the opcodes end up calling
+// Interpret, which uses them
+func init() {
+	zeroOpFuncs = []ZeroOpFunc{
+		ZReturnTrue,
+		ZReturnFalse,
+		ZPrint,
+		ZPrintRet,
+		nil,
+		ZSave,
+		ZRestore,
+		ZRestart,
+		ZRetPop,
+		ZPop,
+		ZQuit,
+		ZNl,
+		ZShowStatus,
+		ZVerify,
+	}
+
+	oneOpFuncs = []OneOpFunc{
+		ZJ0,
+		ZGetSibling,
+		ZGetChild,
+		ZGetParent,
+		ZGetPropLen,
+		ZInc,
+		ZDec,
+		ZPrintAt,
+		ZCall1S,
+		ZMakeObjOrphan,
+		ZPrintObject,
+		ZReturn,
+		ZJump,
+		ZPrintAtPacked,
+		ZLoad,
+		ZNot,
+	}
+
+	twoOpFuncs = []TwoOpFunc{
+		ZNOOP,
+		nil, // ZJe is a two op func but it accepts VAR count of args
+		ZJl,
+		ZJg,
+		ZDecChk,
+		ZIncChk,
+		ZJin,
+		ZTest,
+		ZOr,
+		ZAnd,
+		ZTestAttr,
+		ZSetAttr,
+		ZClearAttr,
+		ZStore,
+		ZInsertObj,
+		ZLoadW,
+		ZLoadB,
+		ZGetProp,
+		ZGetPropAddr,
+		ZGetNextProp,
+		ZAdd,
+		ZSub,
+		ZMul,
+		ZDiv,
+		ZMod,
+		ZCall2S,
+		ZCall2N,
+		ZSetColour,
+		ZThrow,
+	}
+
+	varOpFuncs = []VarOpFunc{
+		ZCall,
+		ZStoreW,
+		ZStoreB,
+		ZPutProp,
+		ZRead,
+		ZPrintChar,
+		ZPrintNum,
+		ZRandom,
+		ZPush,
+		ZPull,
+		ZSplitWindow,
+		ZSetWindow,
+		ZCall, // call_vs2 is call with up to 7 arguments
+		ZEraseWindow,
+		nil,
+		ZSetCursor,
+		nil,
+		ZSetTextStyle,
+		ZBufferMode,
+		ZOutputStream,
+		ZInputStream,
+		ZSoundEffect,
+		ZReadChar,
+		ZScanTable,
+		ZNotVar,
+		ZCallVN,
+		ZCallVN, // call_vn2 is call_vn with up to 7 arguments
+		ZTokenise,
+		ZEncodeText,
+		ZCopyTable,
+		ZPrintTable,
+		ZCheckArgCount,
+	}
+
+	extOpFuncs = []VarOpFunc{
+		ZExtSave,
+		ZExtRestore,
+		ZLogShift,
+		ZArtShift,
+		ZSetFont,
+		nil,
+		nil,
+		nil,
+		nil,
+		ZSaveUndo,
+		ZRestoreUndo,
+		ZPrintUnicode,
+		ZCheckUnicode,
+	}
+
+	zeroOpFuncsV5 = append([]ZeroOpFunc{}, zeroOpFuncs...)
+	zeroOpFuncsV5[9] = ZCatch
+	zeroOpFuncsV5 = append(zeroOpFuncsV5, nil, ZPiracy)
+
+	oneOpFuncsV5 = append([]OneOpFunc{}, oneOpFuncs...)
+	oneOpFuncsV5[15] = ZCall1N
+}
+
+// call enters the routine at the packed address operands[0] with the other
+// operands as arguments, the caller goes on from the current PC
+func (zm *ZMachine) call(operands []uint16) *ZRoutine {
+	if len(zm.stack) >= maxCallDepth {
+		zm.fail(errCallOverflow)
+	}
 
 	retAddr := zm.seq.pos
-	zm.seq.pos = routineAddr
-	routine := NewZRoutine(zm.seq, retAddr)
+	zm.seq.pos = PackedAddress(uint32(operands[0]), zm.header)
+	routine, err := NewZRoutine(zm.seq, retAddr, zm.header)
+	if err != nil {
+		zm.fail(err)
+	}
+
+	// copy operands to locals, exceeding arguments are discarded
+	for i, v := range operands[1:] {
+		if i >= len(routine.locals) {
+			break
+		}
+		routine.locals[i] = v
+		routine.nargs++
+	}
 
+	if zm.traces(TraceInfo, TraceCalls) {
+		zm.trace(TraceInfo, TraceCalls, routine.addr, "call with %d arguments", len(operands)-1)
+	}
 	zm.stack.Push(routine)
 
-	if routineAddr == 0 {
-		ZReturnFalse(zm)
+	return routine
+}
+
+func ZCall(zm *ZMachine, operands []uint16) {
+	if operands[0] == 0 {
+		// calling 0 returns false
+		zm.StoreReturn(0)
 		return
 	}
 
-	if len(operands) > 1 {
-		// copy operands to locals
-		for i, v := range operands[1:] {
-			routine.locals[i] = v
-		}
+	zm.call(operands).store = zm.op.store
+}
+
+func ZCall1S(zm *ZMachine, routine uint16) {
+	ZCall(zm, []uint16{routine})
+}
+
+func ZCall2S(zm *ZMachine, routine uint16, arg uint16) {
+	ZCall(zm, []uint16{routine, arg})
+}
+
+// callDiscard calls a routine throwing away its result
+func callDiscard(zm *ZMachine, operands []uint16) {
+	if operands[0] == 0 {
+		// calling 0 does nothing
+		return
+	}
+
+	zm.call(operands).discard = true
+}
+
+func ZCall1N(zm *ZMachine, routine uint16) {
+	callDiscard(zm, []uint16{routine})
+}
+
+func ZCall2N(zm *ZMachine, routine uint16, arg uint16) {
+	callDiscard(zm, []uint16{routine, arg})
+}
+
+func ZCallVN(zm *ZMachine, operands []uint16) {
+	callDiscard(zm, operands)
+}
+
+func ZCheckArgCount(zm *ZMachine, args []uint16) {
+	zm.Branch(int(args[0]) <= int(zm.stack.Top().nargs))
+}
+
+func ZCatch(zm *ZMachine) {
+	// the frame is identified by the depth of the stack
+	zm.StoreReturn(uint16(len(zm.stack)))
+}
+
+func ZThrow(zm *ZMachine, value uint16, frame uint16) {
+	if int(frame) < 1 || int(frame) > len(zm.stack) {
+		zm.fail(fmt.Errorf("throw to invalid frame %d", frame))
 	}
-	zm.logger.Print("Call ", routine)
+
+	// return from the routine which executed catch
+	zm.stack = zm.stack[:frame]
+	ZReturn(zm, value)
 }
 
 func ZReturn(zm *ZMachine, retValue uint16) {
-	zm.seq.pos = zm.stack.Pop().retAddr
-	zm.logger.Printf("Returning to 0x%X\n", zm.seq.pos)
-	zm.StoreReturn(retValue)
+	if zm.traces(TraceInfo, TraceCalls) {
+		zm.trace(TraceInfo, TraceCalls, zm.stack.Top().retAddr, "return %d", retValue)
+	}
+	routine := zm.stack.Pop()
+	zm.seq.pos = routine.retAddr
+
+	if routine.interrupt {
+		// there's no store byte after an interrupt
+		zm.interruptResult = retValue
+		return
+	}
+	if routine.discard {
+		return
+	}
+	zm.StoreVarAt(routine.store, retValue)
 }
 
 func ZReturnFalse(zm *ZMachine) {
@@ -156,8 +317,7 @@ func ZJump(zm *ZMachine, offset uint16) {
 }
 
 func ZPrint(zm *ZMachine) {
-	str := zm.seq.DecodeZString(zm.header)
-	zm.iodev.Print(str)
+	zm.Print(zm.op.text)
 }
 
 func ZPrintRet(zm *ZMachine) {
@@ -167,31 +327,31 @@ func ZPrintRet(zm *ZMachine) {
 }
 
 func ZPrintObject(zm *ZMachine, obj uint16) {
-	// objects are 1-based
-	zm.iodev.Print(zm.objects[obj-1].name)
+	if zm.nullObject(obj) {
+		return
+	}
+	zm.Print(zm.object(obj).Name())
 }
 
 func ZPrintAt(zm *ZMachine, addr uint16) {
 	str := zm.seq.mem.DecodeZStringAt(uint32(addr), zm.header)
-	zm.iodev.Print(str)
+	zm.Print(str)
 }
 
 func ZPrintAtPacked(zm *ZMachine, paddr uint16) {
-	str := zm.seq.mem.DecodeZStringAt(PackedAddress(uint32(paddr)), zm.header)
-	zm.iodev.Print(str)
+	str := zm.seq.mem.DecodeZStringAt(PackedAddress(uint32(paddr), zm.header), zm.header)
+	zm.Print(str)
 }
 
 func ZPrintNum(zm *ZMachine, args []uint16) {
-	zm.iodev.Print(args[0])
+	// numbers are signed
+	zm.Print(fmt.Sprint(int16(args[0])))
 }
 
 func ZPrintChar(zm *ZMachine, args []uint16) {
-	// print only ASCII
-	if args[0] == 13 {
-		ZNl(zm)
-	} else if args[0] >= 32 && args[0] <= 126 {
-		zm.iodev.Print(fmt.Sprintf("%c", args[0]))
-	} // ignore everything else
+	if r, ok := zm.header.zsciiRune(args[0]); ok {
+		zm.Print(string(r))
+	}
 }
 
 func ZAdd(zm *ZMachine, lhs uint16, rhs uint16) {
@@ -208,14 +368,14 @@ func ZMul(zm *ZMachine, lhs uint16, rhs uint16) {
 
 func ZDiv(zm *ZMachine, lhs uint16, rhs uint16) {
 	if rhs == 0 {
-		zm.logger.Panic("division by zero error")
+		zm.fail(errors.New("division by zero"))
 	}
 	zm.StoreReturn(lhs / rhs)
 }
 
 func ZMod(zm *ZMachine, lhs uint16, rhs uint16) {
 	if rhs == 0 {
-		zm.logger.Panic("mod by zero error")
+		zm.fail(errors.New("mod by zero"))
 	}
 	zm.StoreReturn(lhs % rhs)
 }
@@ -228,80 +388,115 @@ func ZAnd(zm *ZMachine, lhs uint16, rhs uint16) {
 	zm.StoreReturn(lhs & rhs)
 }
 
-// v3
 func ZNot(zm *ZMachine, arg uint16) {
 	zm.StoreReturn(^arg)
 }
 
+// v5 not is a VAR opcode
+func ZNotVar(zm *ZMachine, args []uint16) {
+	ZNot(zm, args[0])
+}
+
+func ZLogShift(zm *ZMachine, args []uint16) {
+	places := int16(args[1])
+	if places >= 0 {
+		zm.StoreReturn(args[0] << uint(places))
+	} else {
+		zm.StoreReturn(args[0] >> uint(-places))
+	}
+}
+
+func ZArtShift(zm *ZMachine, args []uint16) {
+	places := int16(args[1])
+	if places >= 0 {
+		zm.StoreReturn(args[0] << uint(places))
+	} else {
+		zm.StoreReturn(uint16(int16(args[0]) >> uint(-places)))
+	}
+}
+
+func ZPiracy(zm *ZMachine) {
+	// the game is always genuine
+	zm.Branch(true)
+}
+
 func ZNOOP(zm *ZMachine, _ uint16, _ uint16) {
-	zm.logger.Panic("NO OP 2OP")
+	zm.fail(errUnknownOpcode)
 }
 
 func ZLoad(zm *ZMachine, varnum uint16) {
-	zm.StoreReturn(zm.GetVarAt(byte(varnum)))
+	zm.StoreReturn(zm.IndirectVarAt(byte(varnum)))
 }
 
 func ZLoadB(zm *ZMachine, array uint16, bidx uint16) {
-	// TODO access violation
-	zm.StoreReturn(uint16(zm.seq.mem.ByteAt(uint32(array + bidx))))
+	zm.StoreReturn(uint16(zm.seq.mem.ByteAt(arrayAddr(array, bidx, 1))))
 }
 
 func ZLoadW(zm *ZMachine, array uint16, widx uint16) {
-	// TODO access violation
 	// index is the index of the nth word
-	zm.StoreReturn(zm.seq.mem.WordAt(uint32(array + widx*2)))
+	zm.StoreReturn(zm.seq.mem.WordAt(arrayAddr(array, widx, 2)))
 }
 
 func ZStore(zm *ZMachine, varnum uint16, value uint16) {
-	zm.StoreVarAt(byte(varnum), value)
+	zm.SetIndirectVarAt(byte(varnum), value)
 }
 
 func ZStoreB(zm *ZMachine, args []uint16) {
-	// TODO access violation
-	addr := args[0] + args[1]
-	zm.seq.mem.WriteByteAt(uint32(addr), byte(args[2]))
+	zm.seq.mem.WriteByteAt(arrayAddr(args[0], args[1], 1), byte(args[2]))
 }
 
 func ZStoreW(zm *ZMachine, args []uint16) {
-	// TODO access violation
 	// index is the index of the nth word
-	addr := uint32(args[0]) + uint32(args[1])*2
-	zm.seq.mem.WriteWordAt(addr, args[2])
+	zm.seq.mem.WriteWordAt(arrayAddr(args[0], args[1], 2), args[2])
+}
+
+// arrayAddr is the address of the entry idx of the array of entries of
+// size bytes at array, it's a byte address so it wraps around at 16 bits
+func arrayAddr(array uint16, idx uint16, size uint16) uint32 {
+	return uint32(array + idx*size)
 }
 
 func ZPush(zm *ZMachine, args []uint16) {
-	zm.stack.Top().locals = append(zm.stack.Top().locals, args[0])
+	zm.push(args[0])
 }
 
 func ZPull(zm *ZMachine, args []uint16) {
-	varnum := args[0]
-
-	r := zm.stack.Top().locals[len(zm.stack.Top().locals)-1]
-	ZPop(zm)
-
-	zm.StoreVarAt(byte(varnum), r)
+	// pull to the stack pops the value and then replaces the new top
+	zm.SetIndirectVarAt(byte(args[0]), zm.pop())
 }
 
 func ZPop(zm *ZMachine) {
-	zm.stack.Top().locals = zm.stack.Top().locals[:len(zm.stack.Top().locals)-1]
+	zm.pop()
 }
 
 func ZRetPop(zm *ZMachine) {
-	ret := zm.stack.Top().locals[len(zm.stack.Top().locals)-1]
-	ZPop(zm)
-	ZReturn(zm, ret)
+	ZReturn(zm, zm.pop())
 }
 
 func ZInsertObj(zm *ZMachine, objectId uint16, newParentId uint16) {
-	zm.objects[objectId-1].ChangeParent(uint8(newParentId), zm.objects)
+	if zm.nullObject(objectId) || zm.nullObject(newParentId) {
+		return
+	}
+	if err := zm.object(objectId).ChangeParent(zm.object(newParentId)); err != nil {
+		zm.fail(err)
+	}
+	zm.trace(TraceInfo, TraceObjects, uint32(objectId), "moved into %d", newParentId)
 }
 
 func ZMakeObjOrphan(zm *ZMachine, objectId uint16) {
-	zm.objects[objectId-1].MakeOrphan(zm.objects)
+	if zm.nullObject(objectId) {
+		return
+	}
+	zm.object(objectId).MakeOrphan()
+	zm.trace(TraceInfo, TraceObjects, uint32(objectId), "removed")
 }
 
 func ZJin(zm *ZMachine, childId uint16, parentId uint16) {
-	condition := zm.objects[childId-1].parent == uint8(parentId)
+	if zm.nullObject(childId) {
+		zm.Branch(false)
+		return
+	}
+	condition := zm.object(childId).ParentId() == parentId
 	zm.Branch(condition)
 }
 
@@ -310,35 +505,63 @@ func ZTest(zm *ZMachine, bitmap uint16, flags uint16) {
 }
 
 func ZGetSibling(zm *ZMachine, objectId uint16) {
-	sibling := zm.objects[objectId-1].sibling
+	if zm.nullObject(objectId) {
+		zm.StoreReturn(0)
+		zm.Branch(false)
+		return
+	}
+	sibling := zm.object(objectId).SiblingId()
 	zm.StoreReturn(uint16(sibling))
 	zm.Branch(sibling != NULL_OBJECT_INDEX)
 }
 
 func ZGetChild(zm *ZMachine, objectId uint16) {
-	child := zm.objects[objectId-1].child
+	if zm.nullObject(objectId) {
+		zm.StoreReturn(0)
+		zm.Branch(false)
+		return
+	}
+	child := zm.object(objectId).ChildId()
 	zm.StoreReturn(uint16(child))
 	zm.Branch(child != NULL_OBJECT_INDEX)
 }
 
 func ZGetParent(zm *ZMachine, objectId uint16) {
-	zm.StoreReturn(uint16(zm.objects[objectId-1].parent))
+	if zm.nullObject(objectId) {
+		zm.StoreReturn(0)
+		return
+	}
+	zm.StoreReturn(uint16(zm.object(objectId).ParentId()))
 }
 
 func ZPutProp(zm *ZMachine, args []uint16) {
-	zm.objects[args[0]-1].SetProperty(byte(args[1]), args[2])
+	if zm.nullObject(args[0]) {
+		return
+	}
+	if err := zm.object(args[0]).SetProperty(byte(args[1]), args[2]); err != nil {
+		zm.fail(err)
+	}
+	zm.trace(TraceInfo, TraceObjects, uint32(args[0]), "property %d set to %d", args[1], args[2])
 }
 
 func ZGetProp(zm *ZMachine, objectId uint16, propertyId uint16) {
-	res, err := zm.objects[objectId-1].GetProperty(byte(propertyId))
+	if zm.nullObject(objectId) {
+		zm.StoreReturn(0)
+		return
+	}
+	res, err := zm.object(objectId).GetProperty(byte(propertyId))
 	if err != nil {
-		zm.logger.Panic(err)
+		zm.fail(err)
 	}
 	zm.StoreReturn(res)
 }
 
 func ZGetNextProp(zm *ZMachine, objectId uint16, prop uint16) {
-	res := zm.objects[objectId-1].NextProperty(byte(prop))
+	if zm.nullObject(objectId) {
+		zm.StoreReturn(0)
+		return
+	}
+	res := zm.object(objectId).NextProperty(byte(prop))
 	zm.StoreReturn(uint16(res))
 }
 
@@ -346,31 +569,47 @@ func ZGetPropLen(zm *ZMachine, propertyAddr uint16) {
 	if propertyAddr == 0 {
 		zm.StoreReturn(0)
 	} else {
-		res := GetPropertyLen(zm.seq.mem, uint32(propertyAddr))
+		res := GetPropertyLen(zm.seq.mem, uint32(propertyAddr), zm.header)
 		zm.StoreReturn(res)
 	}
 }
 
 func ZGetPropAddr(zm *ZMachine, objectId uint16, propertyId uint16) {
-	addr := zm.objects[objectId-1].GetPropertyAddr(byte(propertyId))
+	if zm.nullObject(objectId) {
+		zm.StoreReturn(0)
+		return
+	}
+	addr := zm.object(objectId).GetPropertyAddr(byte(propertyId))
 	zm.StoreReturn(uint16(addr))
 }
 
 func ZTestAttr(zm *ZMachine, objectId uint16, attrId uint16) {
-	cond := zm.objects[objectId-1].attributes[attrId]
+	if zm.nullObject(objectId) {
+		zm.Branch(false)
+		return
+	}
+	cond := zm.object(objectId).TestAttribute(byte(attrId))
 	zm.Branch(cond)
 }
 
 func ZSetAttr(zm *ZMachine, objectId uint16, attrId uint16) {
-	zm.objects[objectId-1].attributes[attrId] = true
+	if zm.nullObject(objectId) {
+		return
+	}
+	zm.object(objectId).SetAttribute(byte(attrId), true)
+	zm.trace(TraceInfo, TraceObjects, uint32(objectId), "attribute %d set", attrId)
 }
 
 func ZClearAttr(zm *ZMachine, objectId uint16, attrId uint16) {
-	zm.objects[objectId-1].attributes[attrId] = false
+	if zm.nullObject(objectId) {
+		return
+	}
+	zm.object(objectId).SetAttribute(byte(attrId), false)
+	zm.trace(TraceInfo, TraceObjects, uint32(objectId), "attribute %d cleared", attrId)
 }
 
 func ZNl(zm *ZMachine) {
-	zm.iodev.Print("\n")
+	zm.Print("\n")
 }
 
 func ZInc(zm *ZMachine, varnum uint16) {
@@ -393,60 +632,375 @@ func ZDecChk(zm *ZMachine, varnum uint16, value uint16) {
 
 func ZRead(zm *ZMachine, args []uint16) {
 	textPos := uint32(args[0])
-	parseTblPos := uint32(args[1])
+	parseTblPos := uint32(0)
+	if len(args) > 1 {
+		parseTblPos = uint32(args[1])
+	}
 
-	s := zm.iodev.ReadLine()
+	if zm.header.version < 4 {
+		// v3 the status line is redrawn before every read
+		zm.ShowStatus()
+	}
 
-	zm.logger.Printf("Read %s", s)
+	tenths, routine := uint16(0), uint16(0)
+	if len(args) > 2 {
+		tenths, routine = timedReadArgs(args[2:])
+	}
+	s, ok, err := zm.readLine(tenths, routine)
+	if err != nil {
+		zm.fail(err)
+	}
+	if !ok {
+		// the interrupt routine stopped the input
+		s = ""
+	}
+
+	zm.writeTextBuffer(textPos, zm.header.zsciiInput(strings.Trim(s, " \r\n")))
 
+	// v5 the parse table is optional
+	if parseTblPos != 0 {
+		zm.tokenise(textPos, parseTblPos, zm.dictionary, false)
+	}
+
+	if zm.header.version >= 5 {
+		// v5 read returns the character which terminated the input
+		if ok {
+			zm.StoreReturn(13)
+		} else {
+			zm.StoreReturn(0)
+		}
+	}
+}
+
+// writeTextBuffer stores the ZSCII text s in the text buffer of read, up
+// to v4 the text starts from byte #1 and it's terminated by 0, from v5
+// byte #1 is the length of the text that follows
+func (zm *ZMachine) writeTextBuffer(textPos uint32, s []byte) {
 	seq := zm.seq.mem.GetSequential(textPos)
 
-	maxLen := int(seq.ReadByte()) + 1
+	// byte #0 is the size of the buffer, up to v4 it includes the
+	// terminator
+	maxLen := int(seq.ReadUint8())
+	if zm.header.version < 5 {
+		maxLen--
+	}
 	if maxLen < len(s) {
 		s = s[:maxLen]
 	}
-	// doubling ToLower and Trim :(
-	s = strings.Trim(strings.ToLower(s), " \r\n")
 
-	for i := range s {
-		seq.WriteByte(s[i])
+	if zm.header.version >= 5 {
+		seq.WriteUint8(byte(len(s)))
+	}
+	for _, c := range s {
+		seq.WriteUint8(c)
 	}
-	// null terminator
-	seq.WriteByte(0)
+	if zm.header.version < 5 {
+		// null terminator
+		seq.WriteUint8(0)
+	}
+}
 
-	// ignore incomplete reads :)
+// readTextBuffer returns the ZSCII text in the text buffer at textPos and
+// the offset of its first character
+func (zm *ZMachine) readTextBuffer(textPos uint32) ([]byte, int) {
+	text := []byte{}
 
-	words := SplitSentence(s, string(zm.dictionary.wordSeparators))
+	if zm.header.version >= 5 {
+		n := uint32(zm.seq.mem.ByteAt(textPos + 1))
+		for i := uint32(0); i < n; i++ {
+			text = append(text, zm.seq.mem.ByteAt(textPos+2+i))
+		}
+		return text, 2
+	}
 
-	seq = zm.seq.mem.GetSequential(parseTblPos)
-	maxWords := seq.ReadByte()
-	if int(maxWords) < len(words) {
-		words = words[:maxWords]
+	for addr := textPos + 1; zm.seq.mem.ByteAt(addr) != 0; addr++ {
+		text = append(text, zm.seq.mem.ByteAt(addr))
 	}
+	return text, 1
+}
 
-	seq.WriteByte(byte(len(words)))
+// tokenise splits the text of the text buffer at textPos into the words
+// of dict and writes them in the parse table at parseTblPos. When
+// skipUnknown is set the entries of the words not in dict are left as
+// they are.
+func (zm *ZMachine) tokenise(textPos uint32, parseTblPos uint32, dict *ZDictionary, skipUnknown bool) {
+	text, start := zm.readTextBuffer(textPos)
+	tokens := tokeniseText(text, dict.wordSeparators)
+
+	seq := zm.seq.mem.GetSequential(parseTblPos)
+	maxWords := seq.ReadUint8()
+	if int(maxWords) < len(tokens) {
+		tokens = tokens[:maxWords]
+	}
 
-	// byte #0 is maxLen, so start from byte #1
-	lastWordPos := byte(1)
-	for _, w := range words {
-		// truncate words to the max entrysize
-		originalLen := len(w)
-		if len(w) > int(zm.dictionary.entrySize)-1 {
-			w = w[:zm.dictionary.entrySize-1]
-		}
+	seq.WriteUint8(byte(len(tokens)))
 
+	for _, token := range tokens {
 		// 4 byte block
 		// word: address of word searched in the dict
 		// byte: #chars of the word
 		// byte: position of the first letter of the word in text-buffer
 
-		seq.WriteWord(zm.dictionary.Search(w))
-		seq.WriteByte(uint8(originalLen))
-		seq.WriteByte(lastWordPos)
+		addr := dict.Search(string(token.text))
+		if addr == 0 && skipUnknown {
+			seq.pos += 4
+			continue
+		}
+
+		seq.WriteWord(addr)
+		seq.WriteUint8(uint8(len(token.text)))
+		seq.WriteUint8(uint8(start + token.pos))
+	}
+}
 
-		lastWordPos += byte(len(w))
+func ZTokenise(zm *ZMachine, args []uint16) {
+	dict := zm.dictionary
+	if len(args) > 2 && args[2] != 0 {
+		dict = NewZDictionaryAt(zm.seq.mem, uint32(args[2]), zm.header)
 	}
 
+	skipUnknown := len(args) > 3 && args[3] != 0
+	zm.tokenise(uint32(args[0]), uint32(args[1]), dict, skipUnknown)
+}
+
+func ZEncodeText(zm *ZMachine, args []uint16) {
+	text := uint32(args[0]) + uint32(args[2])
+
+	chars := make([]byte, args[1])
+	for i := range chars {
+		chars[i] = zm.seq.mem.ByteAt(text + uint32(i))
+	}
+
+	coded := uint32(args[3])
+	for i, w := range ZStringEncode(string(chars), zm.header) {
+		zm.seq.mem.WriteWordAt(coded+uint32(i)*2, w)
+	}
+}
+
+func ZScanTable(zm *ZMachine, args []uint16) {
+	x, table, n := args[0], uint32(args[1]), uint32(args[2])
+
+	// by default the table is made of words
+	form := uint16(0x82)
+	if len(args) > 3 {
+		form = args[3]
+	}
+	entryLen := uint32(form & 0x7F)
+
+	for i := uint32(0); i < n; i++ {
+		addr := table + i*entryLen
+
+		var v uint16
+		if form&0x80 != 0 {
+			v = zm.seq.mem.WordAt(addr)
+		} else {
+			v = uint16(zm.seq.mem.ByteAt(addr))
+		}
+
+		if v == x {
+			zm.StoreReturn(uint16(addr))
+			zm.Branch(true)
+			return
+		}
+	}
+
+	zm.StoreReturn(0)
+	zm.Branch(false)
+}
+
+func ZCopyTable(zm *ZMachine, args []uint16) {
+	first, second := uint32(args[0]), uint32(args[1])
+	size := int(int16(args[2]))
+	mem := zm.seq.mem
+
+	if second == 0 {
+		if size < 0 {
+			size = -size
+		}
+		for i := 0; i < size; i++ {
+			mem.WriteByteAt(first+uint32(i), 0)
+		}
+		return
+	}
+
+	// a negative size forces a forward copy even if it corrupts first,
+	// otherwise the copy goes backwards when the tables overlap
+	if size > 0 && second > first {
+		for i := size - 1; i >= 0; i-- {
+			mem.WriteByteAt(second+uint32(i), mem.ByteAt(first+uint32(i)))
+		}
+		return
+	}
+
+	if size < 0 {
+		size = -size
+	}
+	for i := 0; i < size; i++ {
+		mem.WriteByteAt(second+uint32(i), mem.ByteAt(first+uint32(i)))
+	}
+}
+
+func ZPrintTable(zm *ZMachine, args []uint16) {
+	text, width := uint32(args[0]), uint32(args[1])
+
+	height, skip := uint32(1), uint32(0)
+	if len(args) > 2 {
+		height = uint32(args[2])
+	}
+	if len(args) > 3 {
+		skip = uint32(args[3])
+	}
+
+	for row := uint32(0); row < height; row++ {
+		if row > 0 {
+			zm.Print("\n")
+		}
+
+		line := make([]byte, width)
+		for col := range line {
+			line[col] = zm.seq.mem.ByteAt(text)
+			text++
+		}
+		zm.Print(zm.header.zsciiString(line))
+
+		text += skip
+	}
+}
+
+func ZSplitWindow(zm *ZMachine, args []uint16) {
+	zm.SplitWindow(int(args[0]))
+}
+
+func ZSetWindow(zm *ZMachine, args []uint16) {
+	zm.SetWindow(int(args[0]))
+}
+
+// timedReadArgs returns the optional time and routine operands of read
+// and read_char
+func timedReadArgs(args []uint16) (uint16, uint16) {
+	if len(args) < 2 {
+		return 0, 0
+	}
+	return args[0], args[1]
+}
+
+func ZReadChar(zm *ZMachine, args []uint16) {
+	// the first operand is always 1, the keyboard
+	tenths, routine := timedReadArgs(args[1:])
+
+	// the devices read whole lines, so the first character is used and
+	// an empty line is a return
+	c := uint16(0)
+	s, ok, err := zm.readLine(tenths, routine)
+	if err != nil {
+		zm.fail(err)
+	}
+	if ok {
+		s = strings.TrimRight(s, "\r\n")
+		if s == "" {
+			c = 13
+		} else {
+			// read_char doesn't lower the case
+			r := []rune(s)[0]
+			if zscii, ok := zm.header.runeZscii(r); ok {
+				c = zscii
+			} else {
+				c = '?'
+			}
+		}
+	}
+
+	zm.StoreReturn(c)
+}
+
+func ZEraseWindow(zm *ZMachine, args []uint16) {
+	zm.EraseWindow(int(int16(args[0])))
+}
+
+func ZSetCursor(zm *ZMachine, args []uint16) {
+	zm.SetCursor(int(args[0]), int(args[1]))
+}
+
+func ZSetTextStyle(zm *ZMachine, args []uint16) {
+	zm.SetTextStyle(int(args[0]))
+}
+
+func ZSoundEffect(zm *ZMachine, args []uint16) {
+	// there are no sounds, not even bleeps
+}
+
+func ZSetColour(zm *ZMachine, foreground uint16, background uint16) {
+	zm.SetColour(int(foreground), int(background))
+}
+
+func ZSetFont(zm *ZMachine, args []uint16) {
+	font := args[0]
+
+	switch font {
+	case 0:
+		// it only asks for the current font
+		zm.StoreReturn(zm.font)
+	case normalFont, fixedFont:
+		zm.StoreReturn(zm.font)
+		zm.font = font
+	default:
+		zm.StoreReturn(0)
+	}
+}
+
+func ZPrintUnicode(zm *ZMachine, args []uint16) {
+	if r := rune(args[0]); canPrintUnicode(r) {
+		zm.Print(string(r))
+	} else {
+		zm.Print("?")
+	}
+}
+
+func ZCheckUnicode(zm *ZMachine, args []uint16) {
+	// bit #0 tells whether the character can be printed, bit #1 whether
+	// it can be typed, which requires a ZSCII code
+	r := rune(args[0])
+
+	ret := uint16(0)
+	if canPrintUnicode(r) {
+		ret |= 0x01
+	}
+	if _, ok := zm.header.runeZscii(r); ok && r != '\n' {
+		ret |= 0x02
+	}
+	zm.StoreReturn(ret)
+}
+
+func ZBufferMode(zm *ZMachine, args []uint16) {
+	// the output is never buffered, the devices wrap the text
+}
+
+func ZOutputStream(zm *ZMachine, args []uint16) {
+	stream := int(int16(args[0]))
+	if stream == 0 {
+		return
+	}
+
+	table := uint32(0)
+	if len(args) > 1 {
+		table = uint32(args[1])
+	}
+
+	// negative numbers deselect the stream
+	on := stream > 0
+	if !on {
+		stream = -stream
+	}
+
+	if err := zm.SelectOutputStream(stream, on, table); err != nil {
+		zm.trace(TraceWarn, TraceIO, 0, "output_stream failed: %s", err)
+	}
+}
+
+func ZInputStream(zm *ZMachine, args []uint16) {
+	if err := zm.SelectInputStream(int(args[0])); err != nil {
+		zm.trace(TraceWarn, TraceIO, 0, "input_stream failed: %s", err)
+	}
 }
 
 func ZRandom(zm *ZMachine, args []uint16) {
@@ -455,12 +1009,182 @@ func ZRandom(zm *ZMachine, args []uint16) {
 	retVal := uint16(0)
 
 	if value > 0 {
-		retVal = uint16(rand.Intn(int(value)) + 1)
+		retVal = uint16(zm.rand.Intn(int(value)) + 1)
 	} else if value < 0 {
-		rand.Seed(int64(value))
+		zm.rand.Seed(int64(value))
+	} else if zm.seeded {
+		// runs seeded by the interpreter must stay reproducible
+		zm.rand.Seed(zm.seed)
 	} else {
-		rand.Seed(time.Now().Unix())
+		zm.rand.Seed(time.Now().UnixNano())
 	}
 
 	zm.StoreReturn(retVal)
 }
+
+func ZSave(zm *ZMachine) {
+	// the branch data (store byte from v4) follows the instruction, a
+	// restore will resume from there
+	pc := zm.op.trailers
+
+	name, err := promptSaveName(zm)
+	if err == nil {
+		buf := &bytes.Buffer{}
+		if err = zm.SaveQuetzal(buf, pc); err == nil {
+			err = zm.saves.Save(name, buf.Bytes())
+		}
+	}
+
+	if err != nil {
+		zm.trace(TraceWarn, TraceIO, 0, "save to %s failed: %s", name, err)
+	}
+
+	if err == nil {
+		saveResult(zm, true, 1)
+	} else {
+		saveResult(zm, false, 0)
+	}
+}
+
+// saveResult is how save and restore report the result: they branch up to
+// v3 and store a value from v4
+func saveResult(zm *ZMachine, ok bool, value uint16) {
+	if zm.header.version < 4 {
+		zm.Branch(ok)
+	} else {
+		zm.StoreReturn(value)
+	}
+}
+
+func ZRestore(zm *ZMachine) {
+	name, err := promptSaveName(zm)
+
+	var data []byte
+	if err == nil {
+		data, err = zm.saves.Load(name)
+	}
+	if err == nil {
+		err = zm.RestoreQuetzal(bytes.NewReader(data))
+	}
+
+	if err != nil {
+		zm.trace(TraceWarn, TraceIO, 0, "restore from %s failed: %s", name, err)
+		saveResult(zm, false, 0)
+		return
+	}
+
+	// the PC now points to the branch data (store byte from v4) of the
+	// save instruction that created the file, that save succeeded and
+	// from v4 it returns 2
+	zm.resumeSave()
+	saveResult(zm, true, 2)
+}
+
+// v5 save and restore are extended opcodes, the optional operands save a
+// table instead of the whole game and that isn't supported
+func ZExtSave(zm *ZMachine, args []uint16) {
+	if len(args) > 0 {
+		zm.StoreReturn(0)
+		return
+	}
+	ZSave(zm)
+}
+
+func ZExtRestore(zm *ZMachine, args []uint16) {
+	if len(args) > 0 {
+		zm.StoreReturn(0)
+		return
+	}
+	ZRestore(zm)
+}
+
+func ZSaveUndo(zm *ZMachine, args []uint16) {
+	// the store byte follows the instruction, restore_undo will resume
+	// from there
+	buf := &bytes.Buffer{}
+	if err := zm.SaveQuetzal(buf, zm.op.trailers); err != nil {
+		zm.trace(TraceWarn, TraceIO, 0, "undo save failed: %s", err)
+		zm.StoreReturn(0)
+		return
+	}
+
+	zm.undo = buf.Bytes()
+	zm.StoreReturn(1)
+}
+
+func ZRestoreUndo(zm *ZMachine, args []uint16) {
+	if zm.undo == nil {
+		zm.StoreReturn(0)
+		return
+	}
+
+	if err := zm.RestoreQuetzal(bytes.NewReader(zm.undo)); err != nil {
+		zm.trace(TraceWarn, TraceIO, 0, "undo restore failed: %s", err)
+		zm.StoreReturn(0)
+		return
+	}
+
+	// like restore, save_undo returns 2
+	zm.resumeSave()
+	zm.StoreReturn(2)
+}
+
+func ZRestart(zm *ZMachine) {
+	if err := zm.Reset(); err != nil {
+		zm.fail(err)
+	}
+}
+
+func ZQuit(zm *ZMachine) {
+	zm.quitted = true
+}
+
+func ZShowStatus(zm *ZMachine) {
+	// from v4 the story draws its own status line, show_status is a nop
+	if zm.header.version >= 4 {
+		return
+	}
+	zm.ShowStatus()
+}
+
+func ZVerify(zm *ZMachine) {
+	zm.Branch(zm.Checksum() == zm.header.fileChecksum)
+}
+
+// promptSaveName asks the player the name of a save showing the existing
+// ones, "delete name" removes one of them and asks again
+func promptSaveName(zm *ZMachine) (string, error) {
+	for {
+		names, err := zm.saves.List()
+		if err != nil {
+			return "", err
+		}
+
+		if len(names) > 0 {
+			zm.iodev.Print(fmt.Sprintf("Saved games: %s (delete NAME removes one)\n", strings.Join(names, ", ")))
+		}
+		zm.iodev.Print(fmt.Sprintf("Please enter a save name [%s]: ", defaultSaveName))
+
+		name, err := zm.ReadLine()
+		if err != nil {
+			return "", err
+		}
+		name = strings.TrimSpace(name)
+
+		// save names have no spaces, so this is never one of them
+		if deleted, ok := strings.CutPrefix(name, "delete "); ok {
+			deleted = strings.TrimSpace(deleted)
+			if err := zm.saves.Delete(deleted); err != nil {
+				zm.iodev.Print(fmt.Sprintf("Cannot delete %s: %s\n", deleted, err))
+			} else {
+				zm.iodev.Print(fmt.Sprintf("Deleted %s\n", deleted))
+			}
+			continue
+		}
+
+		if name == "" {
+			name = defaultSaveName
+		}
+		return name, ValidSaveName(name)
+	}
+}
@@ -0,0 +1,412 @@
+package gork
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func runTestMachine(t *testing.T, zm *ZMachine, n int) {
+	for i := 0; i < n; i++ {
+		if err := zm.Interpret(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// newTestStoryRoutines appends routines to the code at testPC, every
+// routine starts at the next packed address from 0x320
+func newTestStoryRoutines(version byte, code []byte, routines ...[]byte) []byte {
+	story := newTestStoryVersion(version, code...)
+	story = story[:testPC+len(code)]
+
+	scale := int((&ZHeader{version: version}).packedScale())
+	for len(story) < 0x320 {
+		story = append(story, 0)
+	}
+	for _, routine := range routines {
+		for len(story)%scale != 0 {
+			story = append(story, 0)
+		}
+		story = append(story, routine...)
+	}
+
+	return newTestStoryVersion(version, story[testPC:]...)
+}
+
+func TestZCallV4(t *testing.T) {
+	// @call_2s 0xC8 7 -> sp, @call_vs2 0xCA 1 2 3 4 5 -> sp,
+	// @call_1s 0xC8 -> sp
+	code := []byte{
+		0x19, 0xC8, 0x07, 0x00,
+		0xEC, 0x55, 0x5F, 0xCA, 1, 2, 3, 4, 5, 0x00,
+		0x98, 0xC8, 0x00,
+	}
+	// the first routine returns L01, the second one has 4 locals and
+	// returns the last one
+	zm, _ := newTestMachine(t, newTestStoryRoutines(4, code,
+		[]byte{0x01, 0x00, 0x2A, 0xAB, 0x01},
+		[]byte{0x04, 0, 0, 0, 0, 0, 0, 0, 0, 0xAB, 0x04},
+	))
+
+	runTestMachine(t, zm, 2)
+	if v := zm.GetVarAt(0); v != 7 {
+		t.Errorf("call_2s returned %d", v)
+	}
+
+	zm.StoreVarAt(0x10, 0)
+	zm.seq.pos = testPC + 4
+	runTestMachine(t, zm, 1)
+	if nargs := zm.stack.Top().nargs; nargs != 4 {
+		t.Errorf("call_vs2 passed %d arguments", nargs)
+	}
+	runTestMachine(t, zm, 1)
+	if v := zm.GetVarAt(0); v != 4 {
+		t.Errorf("call_vs2 returned %d", v)
+	}
+
+	// without arguments the local keeps its initial value
+	runTestMachine(t, zm, 2)
+	if v := zm.GetVarAt(0); v != 0x2A {
+		t.Errorf("call_1s returned %d", v)
+	}
+}
+
+type testTimedDev struct {
+	testIODev
+	timeouts int
+}
+
+func (dev *testTimedDev) ReadLineTimeout(timeout time.Duration) (string, bool, error) {
+	if dev.timeouts > 0 {
+		dev.timeouts--
+		return "", false, nil
+	}
+	s, err := dev.ReadLine()
+	return s, true, err
+}
+
+func TestZReadTimed(t *testing.T) {
+	// @sread 0x100 0x120 5 0xC8, the interrupt routine increments G00
+	// and returns G00 == 3
+	code := []byte{0xE4, 0x05, 0x01, 0x00, 0x01, 0x20, 0x05, 0xC8}
+	buf := newTestStoryRoutines(4, code, []byte{0x00, 0x95, 0x10, 0x41, 0x10, 0x03, 0xC1, 0xB1})
+	buf[0x100] = 20
+	buf[0x120] = 4
+
+	zm, _ := newTestMachine(t, buf)
+	dev := &testTimedDev{testIODev: testIODev{input: []string{"look"}}, timeouts: 2}
+	zm.iodev = dev
+
+	runTestMachine(t, zm, 1)
+	if calls := zm.GetVarAt(0x10); calls != 2 {
+		t.Errorf("interrupt called %d times", calls)
+	}
+	if zm.seq.mem.ByteAt(0x101) != 'l' {
+		t.Error("line not read")
+	}
+
+	// the third interrupt returns true and the input is aborted
+	zm.seq.pos = testPC
+	zm.StoreVarAt(0x10, 0)
+	dev.input = []string{"look"}
+	dev.timeouts = 5
+
+	runTestMachine(t, zm, 1)
+	if calls := zm.GetVarAt(0x10); calls != 3 {
+		t.Errorf("interrupt called %d times", calls)
+	}
+	if zm.seq.mem.ByteAt(0x101) != 0 || zm.seq.mem.ByteAt(0x121) != 0 {
+		t.Error("aborted input read")
+	}
+	if zm.seq.pos != testPC+uint32(len(code)) {
+		t.Errorf("read didn't resume at %X", zm.seq.pos)
+	}
+}
+
+func TestZReadChar(t *testing.T) {
+	// @read_char 1 -> sp, @read_char 1 -> sp
+	zm, dev := newTestMachine(t, newTestStoryVersion(4, 0xF6, 0x7F, 0x01, 0x00, 0xF6, 0x7F, 0x01, 0x00))
+	dev.input = []string{"yes", ""}
+
+	runTestMachine(t, zm, 1)
+	if c := zm.GetVarAt(0); c != 'y' {
+		t.Errorf("read %c", c)
+	}
+
+	runTestMachine(t, zm, 1)
+	if c := zm.GetVarAt(0); c != 13 {
+		t.Errorf("read %d instead of return", c)
+	}
+}
+
+func TestZSaveRestoreV4(t *testing.T) {
+	// @save -> sp, @restore -> G00
+	zm, dev := newTestMachine(t, newTestStoryVersion(4, 0xB5, 0x00, 0xB6, 0x10))
+	dev.input = []string{"", ""}
+
+	runTestMachine(t, zm, 1)
+	if v := zm.GetVarAt(0); v != 1 {
+		t.Fatalf("save returned %d", v)
+	}
+
+	runTestMachine(t, zm, 1)
+	if zm.seq.pos != testPC+2 {
+		t.Errorf("restore resumed at %X", zm.seq.pos)
+	}
+
+	// the stack is the one at the time of the save
+	if v := zm.GetVarAt(0); v != 2 {
+		t.Errorf("restored save returned %d", v)
+	}
+}
+
+func TestZCallVN(t *testing.T) {
+	// @call_vn 0xC8 7, @call_1s 0xC8 -> sp
+	code := []byte{0xF9, 0x1F, 0x00, 0xC8, 0x07, 0x98, 0xC8, 0x00}
+	// the routine stores L01 in G00 and returns whether it got an
+	// argument
+	zm, _ := newTestMachine(t, newTestStoryRoutines(5, code,
+		[]byte{0x01, 0x2D, 0x10, 0x01, 0xFF, 0x7F, 0x01, 0xC1, 0xB1},
+	))
+
+	runTestMachine(t, zm, 3)
+	if v := zm.GetVarAt(0x10); v != 7 {
+		t.Errorf("call_vn passed %d", v)
+	}
+	if len(zm.stack) != 1 || len(zm.stack.Top().stack) != 0 || zm.seq.pos != testPC+5 {
+		t.Errorf("call_vn stored its result: %s", zm)
+	}
+
+	runTestMachine(t, zm, 4)
+	if v := zm.GetVarAt(0); v != 0 {
+		t.Errorf("check_arg_count succeeded without arguments")
+	}
+}
+
+func TestZCallV8(t *testing.T) {
+	// @call_vs 0x64 -> sp, routines are at addresses multiple of 8
+	zm, _ := newTestMachine(t, newTestStoryRoutines(8, []byte{0xE0, 0x7F, 0x64, 0x00},
+		[]byte{0x00, 0x9B, 0x2A},
+	))
+
+	runTestMachine(t, zm, 2)
+	if v := zm.GetVarAt(0); v != 42 {
+		t.Errorf("call_vs returned %d", v)
+	}
+}
+
+func TestZExtended(t *testing.T) {
+	// @set_font 0 -> sp, @set_font 4 -> sp, @set_font 3 -> sp
+	code := []byte{
+		0xBE, 0x04, 0x7F, 0x00, 0x00,
+		0xBE, 0x04, 0x7F, 0x04, 0x00,
+		0xBE, 0x04, 0x7F, 0x03, 0x00,
+	}
+	zm, _ := newTestMachine(t, newTestStoryVersion(5, code...))
+
+	runTestMachine(t, zm, 3)
+	if fonts := zm.stack.Top().stack; !reflect.DeepEqual(fonts, []uint16{1, 1, 0}) || zm.font != fixedFont {
+		t.Errorf("unexpected fonts %v", fonts)
+	}
+}
+
+func TestZNullObject(t *testing.T) {
+	// @get_parent 0 -> G00, @get_child 0 -> G01 ?+5, @get_sibling 0 -> G02 ?+5,
+	// @jin 0 1 ?+5, @get_prop 0 5 -> G03, @get_prop_addr 0 5 -> G04,
+	// @get_next_prop 0 0 -> G05, @test_attr 0 3 ?+5
+	reads := []byte{
+		0x93, 0x00, 0x10,
+		0x92, 0x00, 0x11, 0xC5,
+		0x91, 0x00, 0x12, 0xC5,
+		0x06, 0x00, 0x01, 0xC5,
+		0x11, 0x00, 0x05, 0x13,
+		0x12, 0x00, 0x05, 0x14,
+		0x13, 0x00, 0x00, 0x15,
+		0x0A, 0x00, 0x03, 0xC5,
+	}
+	// @print_obj 0, @set_attr 0 3, @clear_attr 0 3, @insert_obj 0 1,
+	// @insert_obj 1 0, @remove_obj 0, @put_prop 0 5 7
+	writes := []byte{
+		0x9A, 0x00,
+		0x0B, 0x00, 0x03,
+		0x0C, 0x00, 0x03,
+		0x0E, 0x00, 0x01,
+		0x0E, 0x01, 0x00,
+		0x99, 0x00,
+		0xE3, 0x57, 0x00, 0x05, 0x07,
+	}
+	zm, dev := newTestMachine(t, newTestStory(append(reads, writes...)...))
+	tracer := &testTracer{}
+	zm.tracer = tracer
+	for n := 0; n < 6; n++ {
+		zm.StoreVarAt(byte(0x10+n), 0xFFFF)
+	}
+	mem := append([]byte{}, zm.dynMem()...)
+
+	runTestMachine(t, zm, 15)
+	for n := 0; n < 6; n++ {
+		if v := zm.GetVarAt(byte(0x10 + n)); v != 0 {
+			t.Errorf("G%02X is %X", n, v)
+		}
+	}
+	if zm.seq.pos != testPC+uint32(len(reads)+len(writes)) {
+		t.Errorf("branched on object 0, PC %X", zm.seq.pos)
+	}
+	for n := 0; n < 6; n++ {
+		zm.StoreVarAt(byte(0x10+n), 0xFFFF)
+	}
+	if !reflect.DeepEqual(zm.dynMem(), mem) || dev.output != "" {
+		t.Error("object 0 changed the story")
+	}
+	if len(tracer.events) != 15 || tracer.events[0].Level != TraceWarn || tracer.events[14].Opcode != "ZPutProp" {
+		t.Errorf("unexpected events %+v", tracer.events)
+	}
+}
+
+func TestZUndo(t *testing.T) {
+	// @restore_undo -> G02, @save_undo -> G00, @store G01 5,
+	// @restore_undo -> G02
+	code := []byte{
+		0xBE, 0x0A, 0xFF, 0x12,
+		0xBE, 0x09, 0xFF, 0x10,
+		0x0D, 0x11, 0x05,
+		0xBE, 0x0A, 0xFF, 0x12,
+	}
+	zm, _ := newTestMachine(t, newTestStoryVersion(5, code...))
+
+	// nothing to undo yet
+	zm.StoreVarAt(0x12, 0xFFFF)
+	runTestMachine(t, zm, 1)
+	if v := zm.GetVarAt(0x12); v != 0 {
+		t.Errorf("restore_undo without save returned %d", v)
+	}
+
+	runTestMachine(t, zm, 1)
+	if v := zm.GetVarAt(0x10); v != 1 {
+		t.Errorf("save_undo returned %d", v)
+	}
+
+	// restoring resumes from the store byte of save_undo
+	runTestMachine(t, zm, 2)
+	if zm.GetVarAt(0x10) != 2 || zm.GetVarAt(0x11) != 0 || zm.seq.pos != testPC+8 {
+		t.Errorf("restore_undo didn't go back: %s", zm)
+	}
+}
+
+func TestZScanCopyTable(t *testing.T) {
+	// @scan_table 0x1234 0x100 3 -> sp ?next
+	code := []byte{0xF7, 0x07, 0x12, 0x34, 0x01, 0x00, 0x03, 0x00, 0xC2}
+	buf := newTestStoryVersion(5, code...)
+	copy(buf[0x100:], []byte{0xAA, 0xAA, 0x12, 0x34, 0x55, 0x55})
+	copy(buf[0x110:], []byte{1, 2, 3, 4})
+
+	zm, _ := newTestMachine(t, buf)
+	runTestMachine(t, zm, 1)
+	if v := zm.GetVarAt(0); v != 0x102 {
+		t.Errorf("scan_table found %X", v)
+	}
+
+	// the tables overlap, the copy must not corrupt the source
+	ZCopyTable(zm, []uint16{0x110, 0x111, 3})
+	if b := zm.dynMem()[0x110:0x114]; !reflect.DeepEqual(b, []byte{1, 1, 2, 3}) {
+		t.Errorf("unexpected copy %v", b)
+	}
+
+	// a negative size forces copying forwards
+	ZCopyTable(zm, []uint16{0x110, 0x111, 0xFFFD})
+	if b := zm.dynMem()[0x110:0x114]; !reflect.DeepEqual(b, []byte{1, 1, 1, 1}) {
+		t.Errorf("unexpected forward copy %v", b)
+	}
+
+	ZCopyTable(zm, []uint16{0x111, 0, 2})
+	if b := zm.dynMem()[0x110:0x114]; !reflect.DeepEqual(b, []byte{1, 0, 0, 1}) {
+		t.Errorf("unexpected zeroing %v", b)
+	}
+}
+
+func TestZEncodeText(t *testing.T) {
+	buf := newTestStoryVersion(5)
+	copy(buf[0x100:], "xhello")
+
+	zm, _ := newTestMachine(t, buf)
+	ZEncodeText(zm, []uint16{0x100, 5, 1, 0x110})
+
+	// v5 words are 3 words long
+	if s := zm.seq.mem.DecodeZStringAt(0x110, zm.header); s != "hello" || zm.seq.mem.ByteAt(0x114)&0x80 == 0 {
+		t.Errorf("encoded %q", s)
+	}
+}
+
+func TestZReadV5(t *testing.T) {
+	// @aread 0x100 0x140 -> sp
+	buf := newTestStoryVersion(5, 0xE4, 0x0F, 0x01, 0x00, 0x01, 0x40, 0x00)
+	buf[0x100] = 20
+	buf[0x140] = 4
+
+	zm, dev := newTestMachine(t, buf)
+	dev.input = []string{"Look"}
+
+	runTestMachine(t, zm, 1)
+	if b := zm.dynMem()[0x101:0x106]; string(b) != "\x04look" {
+		t.Errorf("unexpected text buffer %q", b)
+	}
+	if v := zm.GetVarAt(0); v != 13 {
+		t.Errorf("aread returned %d", v)
+	}
+	if b := zm.dynMem()[0x141:0x146]; !reflect.DeepEqual(b, []byte{1, 0, 0, 4, 2}) {
+		t.Errorf("unexpected parse buffer %v", b)
+	}
+
+	// @aread 0x100 -> sp, without the parse buffer nothing is tokenised
+	buf = newTestStoryVersion(5, 0xE4, 0x3F, 0x01, 0x00, 0x00)
+	buf[0x100] = 20
+	buf[0x140] = 4
+
+	zm, dev = newTestMachine(t, buf)
+	dev.input = []string{"Look"}
+
+	runTestMachine(t, zm, 1)
+	if b := zm.dynMem()[0x101:0x106]; string(b) != "\x04look" {
+		t.Errorf("unexpected text buffer %q", b)
+	}
+	if v := zm.GetVarAt(0); v != 13 {
+		t.Errorf("aread returned %d", v)
+	}
+	if zm.dynMem()[0x141] != 0 {
+		t.Error("aread without parse buffer tokenised the input")
+	}
+}
+
+func TestZTokenise(t *testing.T) {
+	buf := newTestStoryVersion(5)
+	header := &ZHeader{version: 5}
+
+	// the text buffer has already been filled by aread
+	copy(buf[0x100:], "\x14\x09look,zork")
+
+	// unsorted dictionary at 0x180 with ',' as separator
+	copy(buf[0x180:], []byte{1, ',', 7, 0xFF, 0xFE})
+	for i, word := range []string{"zork", "look"} {
+		for j, w := range ZStringEncode(word, header) {
+			pos := 0x185 + i*7 + j*2
+			buf[pos], buf[pos+1] = byte(w>>8), byte(w)
+		}
+	}
+
+	zm, _ := newTestMachine(t, buf)
+
+	zm.seq.mem.WriteByteAt(0x140, 4)
+	ZTokenise(zm, []uint16{0x100, 0x140, 0x180})
+	expected := []byte{3, 0x01, 0x8C, 4, 2, 0, 0, 1, 6, 0x01, 0x85, 4, 7}
+	if b := zm.dynMem()[0x141:0x14E]; !reflect.DeepEqual(b, expected) {
+		t.Errorf("unexpected parse buffer %v", b)
+	}
+
+	// the separator isn't in the dictionary and its entry is kept
+	copy(zm.dynMem()[0x146:], []byte{0xAA, 0xAA})
+	ZTokenise(zm, []uint16{0x100, 0x140, 0x180, 1})
+	if b := zm.dynMem()[0x146:0x148]; !reflect.DeepEqual(b, []byte{0xAA, 0xAA}) {
+		t.Errorf("unknown word overwritten %v", b)
+	}
+}
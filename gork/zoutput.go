@@ -0,0 +1,133 @@
+package gork
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	ScreenStream     = 1
+	TranscriptStream = 2
+	MemoryStream     = 3
+	CommandStream    = 4
+
+	// stream 3 can be selected up to 16 times, every time with a new table
+	maxMemoryStreams = 16
+
+	transcriptFlag = byte(0x01)
+)
+
+// zmemoryStream redirects the output to a table in memory: the first word
+// is the number of characters printed, the characters follow it
+type zmemoryStream struct {
+	addr  uint32
+	count uint16
+}
+
+// zoutput sits between the printing opcodes and the device, it sends the
+// text to the selected output streams
+type zoutput struct {
+	screen     bool
+	transcript io.Writer
+	tables     []zmemoryStream
+	commands   bool
+	record     io.Writer
+}
+
+// SetTranscript sets where stream 2 writes, nil disables it
+func (zm *ZMachine) SetTranscript(w io.Writer) {
+	zm.output.transcript = w
+}
+
+// SetCommandRecord sets where stream 4 writes the commands typed by the
+// player, nil disables it
+func (zm *ZMachine) SetCommandRecord(w io.Writer) {
+	zm.output.record = w
+}
+
+// transcriptOn checks the transcript bit in Flags 2, stories can set it
+// directly without using output_stream
+func (zm *ZMachine) transcriptOn() bool {
+	return zm.seq.mem.ByteAt(flags2Pos)&transcriptFlag != 0
+}
+
+func (zm *ZMachine) setTranscriptOn(on bool) {
+	flags2 := zm.seq.mem.ByteAt(flags2Pos)
+	if on {
+		flags2 |= transcriptFlag
+	} else {
+		flags2 &^= transcriptFlag
+	}
+	zm.seq.mem.writeByte(flags2Pos, flags2)
+}
+
+// Print sends s to the active output streams. While stream 3 is selected
+// the text goes only to the most recent table.
+func (zm *ZMachine) Print(s string) {
+	out := &zm.output
+
+	if len(out.tables) > 0 {
+		table := &out.tables[len(out.tables)-1]
+		// tables hold ZSCII text
+		for _, c := range zm.header.zsciiText(s) {
+			zm.seq.mem.WriteByteAt(table.addr+2+uint32(table.count), c)
+			table.count++
+		}
+		return
+	}
+
+	if out.screen {
+		zm.iodev.Print(s)
+	}
+
+	// only the lower window goes into the transcript
+	if out.transcript != nil && zm.window == 0 && zm.transcriptOn() {
+		if _, err := io.WriteString(out.transcript, s); err != nil {
+			zm.trace(TraceWarn, TraceIO, 0, "transcript failed: %s", err)
+		}
+	}
+}
+
+// recordCommand writes a line typed by the player to stream 4
+func (zm *ZMachine) recordCommand(line string) {
+	if zm.output.commands && zm.output.record != nil {
+		if _, err := io.WriteString(zm.output.record, line+"\n"); err != nil {
+			zm.trace(TraceWarn, TraceIO, 0, "command record failed: %s", err)
+		}
+	}
+}
+
+// SelectOutputStream turns stream on or off, table is the address of
+// the table used by stream 3
+func (zm *ZMachine) SelectOutputStream(stream int, on bool, table uint32) error {
+	out := &zm.output
+
+	switch stream {
+	case ScreenStream:
+		out.screen = on
+	case TranscriptStream:
+		zm.setTranscriptOn(on)
+	case MemoryStream:
+		if on {
+			if len(out.tables) >= maxMemoryStreams {
+				return errors.New("output stream 3 nested too deeply")
+			}
+			out.tables = append(out.tables, zmemoryStream{addr: table})
+			return nil
+		}
+
+		if len(out.tables) == 0 {
+			return nil
+		}
+		last := out.tables[len(out.tables)-1]
+		out.tables = out.tables[:len(out.tables)-1]
+		zm.seq.mem.WriteWordAt(last.addr, last.count)
+	case CommandStream:
+		out.commands = on
+	default:
+		return fmt.Errorf("invalid output stream %d", stream)
+	}
+
+	return nil
+}
@@ -0,0 +1,112 @@
+package gork
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestZOutputMemoryStream(t *testing.T) {
+	// @output_stream 3 0x100, @output_stream 3 0x110,
+	// @output_stream -3, @output_stream -3
+	zm, dev := newTestMachine(t, newTestStory(
+		0xF3, 0x4F, 0x03, 0x01, 0x00,
+		0xF3, 0x4F, 0x03, 0x01, 0x10,
+		0xF3, 0x3F, 0xFF, 0xFD,
+		0xF3, 0x3F, 0xFF, 0xFD,
+	))
+
+	run := func() {
+		if err := zm.Interpret(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	run()
+	zm.Print("ab\n")
+	run()
+	zm.Print("c")
+	run()
+	zm.Print("d")
+	run()
+	zm.Print("e")
+
+	if zm.seq.mem.WordAt(0x110) != 1 || zm.seq.mem.ByteAt(0x112) != 'c' {
+		t.Error("inner table not written")
+	}
+
+	if zm.seq.mem.WordAt(0x100) != 4 || !bytes.Equal(zm.seq.mem.dyn[0x102:0x106], []byte{'a', 'b', 13, 'd'}) {
+		t.Errorf("outer table not written: %v", zm.seq.mem.dyn[0x100:0x106])
+	}
+
+	// text goes to the screen only when no table is selected
+	if dev.output != "e" {
+		t.Errorf("unexpected screen output %q", dev.output)
+	}
+}
+
+func TestZOutputTranscript(t *testing.T) {
+	// @output_stream 2, @output_stream -2, @output_stream -1
+	zm, dev := newTestMachine(t, newTestStory(
+		0xF3, 0x7F, 0x02,
+		0xF3, 0x3F, 0xFF, 0xFE,
+		0xF3, 0x3F, 0xFF, 0xFF,
+	))
+
+	transcript := &bytes.Buffer{}
+	zm.SetTranscript(transcript)
+
+	zm.Print("not scripted ")
+	zm.Interpret()
+	if zm.seq.mem.ByteAt(flags2Pos)&transcriptFlag == 0 {
+		t.Error("output_stream 2 must set the transcript bit")
+	}
+
+	zm.Print("scripted ")
+	zm.SetWindow(1)
+	zm.Print("upper ")
+	zm.SetWindow(0)
+	zm.Interpret()
+	zm.Print("not scripted ")
+
+	// stories can turn on the transcript by setting the bit
+	zm.seq.mem.WriteByteAt(flags2Pos, transcriptFlag)
+	zm.Interpret()
+	zm.Print("only scripted")
+
+	if transcript.String() != "scripted only scripted" {
+		t.Errorf("unexpected transcript %q", transcript.String())
+	}
+
+	if dev.output != "not scripted scripted upper not scripted " {
+		t.Errorf("unexpected screen output %q", dev.output)
+	}
+}
+
+func TestZOutputCommandRecord(t *testing.T) {
+	// @output_stream 4, @sread 0x100 0x110, @print_num -42
+	zm, dev := newTestMachine(t, newTestStory(
+		0xF3, 0x7F, 0x04,
+		0xE4, 0x0F, 0x01, 0x00, 0x01, 0x10,
+		0xE6, 0x3F, 0xFF, 0xD6,
+	))
+	zm.seq.mem.WriteByteAt(0x100, 10)
+	zm.seq.mem.WriteByteAt(0x110, 2)
+
+	record := &bytes.Buffer{}
+	zm.SetCommandRecord(record)
+	dev.input = []string{"open mailbox\n"}
+
+	for i := 0; i < 3; i++ {
+		if err := zm.Interpret(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if record.String() != "open mailbox\n" {
+		t.Errorf("unexpected record %q", record.String())
+	}
+
+	if dev.output != "-42" {
+		t.Errorf("unexpected output %q", dev.output)
+	}
+}
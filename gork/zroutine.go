@@ -1,39 +1,112 @@
 package gork
 
 import (
+	"errors"
 	"fmt"
-	"log"
+)
+
+const (
+	// a routine has at most 15 locals
+	maxLocals = 15
+	// the limits of the stacks, a story going past them is looping
+	maxEvalStack = 1024
+	maxCallDepth = 1024
+)
+
+var (
+	errStackUnderflow = errors.New("evaluation stack underflow")
+	errStackOverflow  = errors.New("evaluation stack overflow")
+	errCallOverflow   = errors.New("too many nested calls")
 )
 
 // aka StackFrame
 type ZRoutine struct {
-	addr    uint32
+	addr uint32
+	// the PC the caller goes on from, after the call instruction
 	retAddr uint32
 	locals  []uint16
+	// the evaluation stack, the top is the last value
+	stack []uint16
+
+	// the variable the return value is stored in, unused if the result
+	// is not stored
+	store byte
+	// number of arguments the routine has been called with
+	nargs byte
+	// the routine has been called by the interpreter, the return value
+	// is not stored
+	interrupt bool
+	// the routine has been called by a call_*n opcode, the return value
+	// is thrown away
+	discard bool
 }
 
-func NewZRoutine(seq *ZMemorySequential, retAddr uint32) *ZRoutine {
-	if !IsPackedAddress(seq.pos) {
-		log.Fatal("attempt to read routine at non packed address")
+func NewZRoutine(seq *ZMemorySequential, retAddr uint32, header *ZHeader) (*ZRoutine, error) {
+	// routines are code, which lives in high memory
+	if seq.pos < header.HighStart() || seq.pos >= seq.mem.Size() {
+		return nil, fmt.Errorf("routine at %X outside of high memory", seq.pos)
 	}
 
 	routine := new(ZRoutine)
 	routine.retAddr = retAddr
 
 	routine.addr = seq.pos
-	numLocals := seq.ReadByte()
+	numLocals := seq.ReadUint8()
+	if numLocals > maxLocals {
+		return nil, fmt.Errorf("routine at %X has %d locals", routine.addr, numLocals)
+	}
 
 	routine.locals = make([]uint16, numLocals)
 
-	for i := byte(0); i < numLocals; i++ {
-		routine.locals[i] = seq.ReadWord()
+	// from v5 the locals start from 0 and their initial values are not
+	// stored in the routine header
+	if header.version < 5 {
+		for i := byte(0); i < numLocals; i++ {
+			routine.locals[i] = seq.ReadWord()
+		}
+	}
+
+	return routine, nil
+}
+
+func (routine *ZRoutine) push(v uint16) error {
+	if len(routine.stack) >= maxEvalStack {
+		return errStackOverflow
+	}
+	routine.stack = append(routine.stack, v)
+	return nil
+}
+
+func (routine *ZRoutine) pop() (uint16, error) {
+	v, err := routine.peek()
+	if err == nil {
+		routine.stack = routine.stack[:len(routine.stack)-1]
+	}
+	return v, err
+}
+
+func (routine *ZRoutine) peek() (uint16, error) {
+	if len(routine.stack) == 0 {
+		return 0, errStackUnderflow
 	}
+	return routine.stack[len(routine.stack)-1], nil
+}
 
-	return routine
+// local returns a pointer to the local variable n, counting from 1
+func (routine *ZRoutine) local(n byte) (*uint16, error) {
+	if n < 1 || int(n) > len(routine.locals) {
+		return nil, fmt.Errorf("routine at %X has no local %d", routine.addr, n)
+	}
+	return &routine.locals[n-1], nil
 }
 
 func MainRoutine(mem *ZMemory, header *ZHeader) *ZRoutine {
-	return NewZRoutine(mem.GetSequential(PackedAddress(uint32(header.pc))), 0)
+	// v3 the main routine is not a real routine: the initial PC points
+	// directly to its first instruction and it has no locals
+	return &ZRoutine{
+		addr:   uint32(header.pc),
+		locals: []uint16{},
+	}
 }
 
 func (routine *ZRoutine) String() string {
@@ -1,6 +1,9 @@
 package gork
 
-import "testing"
+import (
+	"errors"
+	"testing"
+)
 
 var zroutineBuf [][]byte = [][]byte{
 	[]byte{
@@ -32,7 +35,10 @@ func TestZRoutine(t *testing.T) {
 	for i, buf := range zroutineBuf {
 		mem := NewZMemory(buf)
 
-		routine := NewZRoutine(mem.GetSequential(0), 42)
+		routine, err := NewZRoutine(mem.GetSequential(0), 42, header)
+		if err != nil {
+			t.Fatal(err)
+		}
 		expected := zroutineExpected[i]
 
 		if expected.addr != routine.addr ||
@@ -47,3 +53,86 @@ func TestZRoutine(t *testing.T) {
 		}
 	}
 }
+
+func TestZRoutineOutsideCode(t *testing.T) {
+	// @call 0x10 -> sp calls 0x20, which is in dynamic memory
+	zm, _ := newTestMachine(t, newTestStory(0xE0, 0x7F, 0x10, 0x00))
+	if zerr := interpretError(t, zm, 1); zerr.Opcode != "ZCall" {
+		t.Errorf("unexpected error %s", zerr)
+	}
+
+	// @call 0xFFFF -> sp is past the end of the story
+	zm, _ = newTestMachine(t, newTestStory(0xE0, 0x3F, 0xFF, 0xFF, 0x00))
+	if zerr := interpretError(t, zm, 1); zerr.Opcode != "ZCall" {
+		t.Errorf("unexpected error %s", zerr)
+	}
+}
+
+func TestZRoutineStack(t *testing.T) {
+	routine := &ZRoutine{locals: []uint16{42}}
+
+	if _, err := routine.pop(); err != errStackUnderflow {
+		t.Errorf("popping an empty stack returned %v", err)
+	}
+
+	for i := 0; i < maxEvalStack; i++ {
+		if err := routine.push(uint16(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := routine.push(0); err != errStackOverflow {
+		t.Errorf("pushing a full stack returned %v", err)
+	}
+
+	if v, err := routine.pop(); v != maxEvalStack-1 || err != nil || routine.locals[0] != 42 {
+		t.Errorf("unexpected pop %d %v", v, err)
+	}
+}
+
+func TestZRoutineLocalsUnderflow(t *testing.T) {
+	// @call 0x190 -> sp, the routine has a local and does @ret_popped
+	zm, _ := newTestMachine(t, newTestStoryRoutines(3, []byte{0xE0, 0x3F, 0x01, 0x90, 0x00},
+		[]byte{0x01, 0x00, 0x05, 0xB8},
+	))
+
+	runTestMachine(t, zm, 1)
+	if err := zm.Interpret(); !errors.Is(err, errStackUnderflow) {
+		t.Errorf("ret_popped returned the local instead of failing: %v", err)
+	}
+}
+
+func TestZRoutineOperandsPop(t *testing.T) {
+	// @push 3, @push 4, @sub sp sp -> g0, @push 7, @inc sp, @load sp -> g1
+	zm, _ := newTestMachine(t, newTestStory(
+		0xE8, 0x7F, 0x03,
+		0xE8, 0x7F, 0x04,
+		0x75, 0x00, 0x00, 0x10,
+		0xE8, 0x7F, 0x07,
+		0x95, 0x00,
+		0x9E, 0x00, 0x11,
+	))
+
+	runTestMachine(t, zm, 6)
+	if v := zm.GetVarAt(0x10); v != 1 {
+		t.Errorf("sub sp sp stored %d", v)
+	}
+	// inc and load use the top of the stack in place
+	if v := zm.GetVarAt(0x11); v != 8 || len(zm.stack.Top().stack) != 1 {
+		t.Errorf("load sp stored %d, stack %v", v, zm.stack.Top().stack)
+	}
+}
+
+func TestZRoutineCallOverflow(t *testing.T) {
+	// the routine calls itself forever
+	zm, _ := newTestMachine(t, newTestStoryRoutines(3, []byte{0xE0, 0x3F, 0x01, 0x90, 0x00},
+		[]byte{0x00, 0xE0, 0x3F, 0x01, 0x90, 0x00},
+	))
+
+	var err error
+	for i := 0; i <= maxCallDepth && err == nil; i++ {
+		err = zm.Interpret()
+	}
+	if !errors.Is(err, errCallOverflow) {
+		t.Errorf("unexpected error %v", err)
+	}
+}
@@ -0,0 +1,192 @@
+package gork
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	saveFileExt     = ".qzl"
+	maxSaveNameLen  = 64
+	defaultSaveName = "save"
+)
+
+// ZSaveStore is where save games are kept, every save lives in a slot
+// identified by a name chosen by the player
+type ZSaveStore interface {
+	Save(name string, data []byte) error
+	Load(name string) ([]byte, error)
+	// List returns the names of the existing slots in alphabetical order
+	List() ([]string, error)
+	Delete(name string) error
+}
+
+var ErrSaveNotFound = errors.New("save not found")
+
+// ValidSaveName checks that name can be used as a slot name: it must not be
+// empty and it can contain only letters, digits, '-', '_' and '.'.
+// Names never contain path separators so that they can be used as file
+// names safely.
+func ValidSaveName(name string) error {
+	if name == "" || len(name) > maxSaveNameLen {
+		return fmt.Errorf("save name must be between 1 and %d characters long", maxSaveNameLen)
+	}
+
+	if name[0] == '.' {
+		return errors.New("save name cannot start with '.'")
+	}
+
+	for _, c := range name {
+		ok := c >= 'a' && c <= 'z' ||
+			c >= 'A' && c <= 'Z' ||
+			c >= '0' && c <= '9' ||
+			strings.ContainsRune("-_.", c)
+
+		if !ok {
+			return fmt.Errorf("invalid character %q in save name", c)
+		}
+	}
+
+	return nil
+}
+
+// ZFileSaveStore keeps every slot in its own file inside Dir,
+// Dir is created on the first save
+type ZFileSaveStore struct {
+	Dir string
+}
+
+func NewZFileSaveStore(dir string) *ZFileSaveStore {
+	return &ZFileSaveStore{Dir: dir}
+}
+
+func (store *ZFileSaveStore) path(name string) (string, error) {
+	if err := ValidSaveName(name); err != nil {
+		return "", err
+	}
+	return filepath.Join(store.Dir, name+saveFileExt), nil
+}
+
+func (store *ZFileSaveStore) Save(name string, data []byte) error {
+	path, err := store.path(name)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(store.Dir, 0755); err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, data, 0644)
+}
+
+func (store *ZFileSaveStore) Load(name string) ([]byte, error) {
+	path, err := store.path(name)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, ErrSaveNotFound
+	}
+	return data, err
+}
+
+func (store *ZFileSaveStore) List() ([]string, error) {
+	entries, err := os.ReadDir(store.Dir)
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for _, entry := range entries {
+		name := strings.TrimSuffix(entry.Name(), saveFileExt)
+
+		if entry.Type().IsRegular() && name != entry.Name() && ValidSaveName(name) == nil {
+			names = append(names, name)
+		}
+	}
+
+	// ReadDir already sorts by filename
+	return names, nil
+}
+
+func (store *ZFileSaveStore) Delete(name string) error {
+	path, err := store.path(name)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(path)
+	if os.IsNotExist(err) {
+		return ErrSaveNotFound
+	}
+	return err
+}
+
+// ZMemorySaveStore keeps the slots in memory, it's safe to share it
+// between goroutines
+type ZMemorySaveStore struct {
+	mu    sync.Mutex
+	slots map[string][]byte
+}
+
+func NewZMemorySaveStore() *ZMemorySaveStore {
+	return &ZMemorySaveStore{slots: make(map[string][]byte)}
+}
+
+func (store *ZMemorySaveStore) Save(name string, data []byte) error {
+	if err := ValidSaveName(name); err != nil {
+		return err
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	store.slots[name] = append([]byte{}, data...)
+	return nil
+}
+
+func (store *ZMemorySaveStore) Load(name string) ([]byte, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	data, ok := store.slots[name]
+	if !ok {
+		return nil, ErrSaveNotFound
+	}
+	return append([]byte{}, data...), nil
+}
+
+func (store *ZMemorySaveStore) List() ([]string, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	names := make([]string, 0, len(store.slots))
+	for name := range store.slots {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+func (store *ZMemorySaveStore) Delete(name string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if _, ok := store.slots[name]; !ok {
+		return ErrSaveNotFound
+	}
+	delete(store.slots, name)
+	return nil
+}
@@ -0,0 +1,72 @@
+package gork
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestValidSaveName(t *testing.T) {
+	valid := []string{"save", "zork-1", "before_troll.2"}
+	invalid := []string{"", ".hidden", "../etc/passwd", "a/b", "with space", string(make([]byte, 100))}
+
+	for _, name := range valid {
+		if ValidSaveName(name) != nil {
+			t.Errorf("%q must be valid", name)
+		}
+	}
+
+	for _, name := range invalid {
+		if ValidSaveName(name) == nil {
+			t.Errorf("%q must be invalid", name)
+		}
+	}
+}
+
+func testZSaveStore(t *testing.T, store ZSaveStore) {
+	if names, err := store.List(); err != nil || len(names) != 0 {
+		t.Errorf("new store is not empty: %v %v", names, err)
+	}
+
+	if _, err := store.Load("zork"); err != ErrSaveNotFound {
+		t.Errorf("loading a missing save returned %v", err)
+	}
+
+	if store.Save("../zork", []byte{1}) == nil {
+		t.Error("invalid names must be rejected")
+	}
+
+	for _, name := range []string{"zork", "cyclop", "zork"} {
+		if err := store.Save(name, []byte(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if names, err := store.List(); err != nil || !reflect.DeepEqual(names, []string{"cyclop", "zork"}) {
+		t.Errorf("unexpected slots %v %v", names, err)
+	}
+
+	if data, err := store.Load("cyclop"); err != nil || !bytes.Equal(data, []byte("cyclop")) {
+		t.Errorf("unexpected save data %v %v", data, err)
+	}
+
+	if err := store.Delete("cyclop"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Delete("cyclop"); err != ErrSaveNotFound {
+		t.Errorf("deleting a missing save returned %v", err)
+	}
+
+	if names, err := store.List(); err != nil || !reflect.DeepEqual(names, []string{"zork"}) {
+		t.Errorf("unexpected slots %v %v", names, err)
+	}
+}
+
+func TestZFileSaveStore(t *testing.T) {
+	testZSaveStore(t, NewZFileSaveStore(t.TempDir()+"/saves"))
+}
+
+func TestZMemorySaveStore(t *testing.T) {
+	testZSaveStore(t, NewZMemorySaveStore())
+}
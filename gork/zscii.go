@@ -0,0 +1,139 @@
+package gork
+
+import (
+	"strings"
+	"unicode"
+)
+
+const (
+	zsciiNewline = uint16(13)
+	// the extra characters, translated by the unicode table
+	zsciiExtraStart = uint16(155)
+	zsciiExtraEnd   = uint16(251)
+)
+
+// defaultUnicodeTable is used when the story doesn't have its own, it maps
+// ZSCII 155 to 223 to some accented latin letters and punctuation
+var defaultUnicodeTable = []rune{
+	'ä', 'ö', 'ü', 'Ä', 'Ö', 'Ü', 'ß', '»', '«', 'ë', 'ï', 'ÿ', 'Ë', 'Ï',
+	'á', 'é', 'í', 'ó', 'ú', 'ý', 'Á', 'É', 'Í', 'Ó', 'Ú', 'Ý',
+	'à', 'è', 'ì', 'ò', 'ù', 'À', 'È', 'Ì', 'Ò', 'Ù',
+	'â', 'ê', 'î', 'ô', 'û', 'Â', 'Ê', 'Î', 'Ô', 'Û',
+	'å', 'Å', 'ø', 'Ø', 'ã', 'ñ', 'õ', 'Ã', 'Ñ', 'Õ',
+	'æ', 'Æ', 'ç', 'Ç', 'þ', 'ð', 'Þ', 'Ð', '£', 'œ', 'Œ', '¡', '¿',
+}
+
+// extraChars returns the unicode table of the story, from v5 it can have
+// its own
+func (header *ZHeader) extraChars() []rune {
+	if header != nil && header.unicodeTable != nil {
+		return header.unicodeTable
+	}
+	return defaultUnicodeTable
+}
+
+// zsciiRune translates the ZSCII character c to Unicode for output, it
+// returns false for the characters that print nothing. The characters
+// that are not defined for output are printed as '?'.
+func (header *ZHeader) zsciiRune(c uint16) (rune, bool) {
+	switch {
+	case c == 0:
+		return 0, false
+	case c == zsciiNewline:
+		return '\n', true
+	case c >= 32 && c <= 126:
+		return rune(c), true
+	case c >= zsciiExtraStart && c <= zsciiExtraEnd:
+		if extra := header.extraChars(); int(c-zsciiExtraStart) < len(extra) {
+			return extra[c-zsciiExtraStart], true
+		}
+	}
+	return '?', true
+}
+
+// runeZscii translates r to ZSCII, it returns false when r has no ZSCII
+// code
+func (header *ZHeader) runeZscii(r rune) (uint16, bool) {
+	switch {
+	case r == '\n':
+		return zsciiNewline, true
+	case r >= 32 && r <= 126:
+		return uint16(r), true
+	}
+
+	for i, extra := range header.extraChars() {
+		if extra == r {
+			return zsciiExtraStart + uint16(i), true
+		}
+	}
+	return 0, false
+}
+
+// zsciiString translates the ZSCII characters in zscii to a string
+func (header *ZHeader) zsciiString(zscii []byte) string {
+	ret := make([]rune, 0, len(zscii))
+	for _, c := range zscii {
+		if r, ok := header.zsciiRune(uint16(c)); ok {
+			ret = append(ret, r)
+		}
+	}
+	return string(ret)
+}
+
+// canPrintUnicode tells whether r can be printed, every device takes UTF-8
+// so anything printable goes
+func canPrintUnicode(r rune) bool {
+	return unicode.IsPrint(r)
+}
+
+// zsciiText translates s to ZSCII for output, the characters without a
+// ZSCII code become '?'
+func (header *ZHeader) zsciiText(s string) []byte {
+	ret := make([]byte, 0, len(s))
+	for _, r := range s {
+		c, ok := header.runeZscii(r)
+		if !ok {
+			c = '?'
+		}
+		ret = append(ret, byte(c))
+	}
+	return ret
+}
+
+// inputSubstitutes are typed in place of the characters without a ZSCII
+// code, mostly the typographic punctuation that terminals and browsers
+// produce when pasting text
+var inputSubstitutes = map[rune]string{
+	'‘': "'", '’': "'", '‚': "'", '′': "'",
+	'“': "\"", '”': "\"", '„': "\"", '″': "\"",
+	'–': "-", '—': "-", '−': "-",
+	'…':      "...",
+	'\u00A0': " ",
+}
+
+// zsciiInput translates a line typed by the player to the ZSCII stored in
+// the text buffer of read: it's lower case, the characters without a ZSCII
+// code are replaced by their inputSubstitutes or by '?', and tabs become
+// spaces. The other control characters can't be typed and are dropped.
+func (header *ZHeader) zsciiInput(s string) []byte {
+	ret := make([]byte, 0, len(s))
+
+	for _, r := range strings.ToLower(s) {
+		if r == '\t' {
+			r = ' '
+		}
+		if unicode.IsControl(r) {
+			continue
+		}
+
+		if c, ok := header.runeZscii(r); ok {
+			ret = append(ret, byte(c))
+		} else if sub, ok := inputSubstitutes[r]; ok {
+			ret = append(ret, sub...)
+		} else {
+			ret = append(ret, '?')
+		}
+	}
+
+	return ret
+}
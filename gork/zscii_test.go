@@ -0,0 +1,100 @@
+package gork
+
+import (
+	"testing"
+)
+
+func TestZSCIIRune(t *testing.T) {
+	header := &ZHeader{version: 5}
+
+	expected := map[uint16]rune{'a': 'a', 13: '\n', 155: 'ä', 170: 'é', 223: '¿', 224: '?', 10: '?'}
+	for c, r := range expected {
+		if got, ok := header.zsciiRune(c); !ok || got != r {
+			t.Errorf("ZSCII %d printed as %q, expected %q", c, got, r)
+		}
+	}
+
+	if _, ok := header.zsciiRune(0); ok {
+		t.Error("ZSCII 0 printed")
+	}
+
+	// a custom table replaces the default one
+	header.unicodeTable = []rune{'ł'}
+	if r, _ := header.zsciiRune(155); r != 'ł' {
+		t.Errorf("custom table ignored %q", r)
+	}
+	if r, _ := header.zsciiRune(156); r != '?' {
+		t.Errorf("undefined character printed as %q", r)
+	}
+	if c, ok := header.runeZscii('ł'); !ok || c != 155 {
+		t.Errorf("unexpected ZSCII %d", c)
+	}
+	if _, ok := header.runeZscii('ä'); ok {
+		t.Error("character of the default table translated")
+	}
+}
+
+func TestZSCIIDecode(t *testing.T) {
+	// 'é' as a 10 bit ZSCII escape: A2 shift, escape, 170 in two parts
+	mem := NewZMemory([]byte{0x14, 0xC5, 0xA8, 0xA5})
+	if s := mem.DecodeZStringAt(0, &ZHeader{version: 3}); s != "é" {
+		t.Errorf("decoded %q", s)
+	}
+}
+
+func TestZSCIIOutput(t *testing.T) {
+	// @print_char 155, @print_unicode 0x263A
+	zm, dev := newTestMachine(t, newTestStoryVersion(5,
+		0xE5, 0x7F, 155,
+		0xBE, 0x0B, 0x3F, 0x26, 0x3A,
+	))
+	runTestMachine(t, zm, 2)
+
+	if dev.output != "ä☺" {
+		t.Errorf("unexpected output %q", dev.output)
+	}
+
+	// memory streams hold ZSCII
+	zm.SelectOutputStream(MemoryStream, true, 0x100)
+	zm.Print("é☺\n")
+	if b := zm.dynMem()[0x102:0x105]; string(b) != "\xAA?\x0D" {
+		t.Errorf("unexpected table %v", b)
+	}
+}
+
+func TestZSCIIInput(t *testing.T) {
+	header := &ZHeader{version: 5}
+
+	expected := map[string]string{
+		"Café":          "caf\xAA",
+		"ÄPFEL":         "\x9Bpfel",
+		"say “hi”\tnow": "say \"hi\" now",
+		"日本\x07":        "??",
+	}
+	for s, zscii := range expected {
+		if got := header.zsciiInput(s); string(got) != zscii {
+			t.Errorf("%q typed as %q, expected %q", s, got, zscii)
+		}
+	}
+}
+
+func TestZReadUnicode(t *testing.T) {
+	// @aread 0x100 0x140 -> sp
+	buf := newTestStoryVersion(5, 0xE4, 0x0F, 0x01, 0x00, 0x01, 0x40, 0x00)
+	buf[0x100] = 20
+	buf[0x140] = 4
+
+	zm, dev := newTestMachine(t, buf)
+	dev.input = []string{"Café ’n"}
+
+	runTestMachine(t, zm, 1)
+
+	// every character takes one byte and the positions follow
+	if b := zm.dynMem()[0x101:0x109]; string(b) != "\x07caf\xAA 'n" {
+		t.Errorf("unexpected text buffer %q", b)
+	}
+	parse := zm.dynMem()[0x141:0x14A]
+	if parse[0] != 2 || parse[3] != 4 || parse[4] != 2 || parse[7] != 2 || parse[8] != 7 {
+		t.Errorf("unexpected parse buffer %v", parse)
+	}
+}
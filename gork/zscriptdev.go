@@ -0,0 +1,68 @@
+package gork
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ZScriptDev plays a script of commands without a terminal and keeps all
+// the output, commands included as if they were typed, so that a run can
+// be compared with a previous one
+type ZScriptDev struct {
+	input *bufio.Reader
+	ended bool
+
+	Output bytes.Buffer
+}
+
+func NewZScriptDev(r io.Reader) *ZScriptDev {
+	return &ZScriptDev{input: bufio.NewReader(r)}
+}
+
+// NewZScriptDevLines returns a device which plays commands, one per line
+func NewZScriptDevLines(commands []string) *ZScriptDev {
+	return NewZScriptDev(strings.NewReader(strings.Join(commands, "\n")))
+}
+
+func (dev *ZScriptDev) Print(s ...interface{}) {
+	for _, si := range s {
+		fmt.Fprint(&dev.Output, si)
+	}
+}
+
+// ReadLine returns the next command of the script, once the script is over
+// it returns empty lines and Ended reports true
+func (dev *ZScriptDev) ReadLine() (string, error) {
+	if dev.ended {
+		return "", nil
+	}
+
+	line, err := dev.input.ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		dev.ended = true
+		return "", nil
+	}
+
+	line = strings.TrimRight(line, "\r\n")
+	dev.Output.WriteString(line + "\n")
+	return line, nil
+}
+
+// Ended reports whether the story asked for more commands than the
+// script has
+func (dev *ZScriptDev) Ended() bool {
+	return dev.ended
+}
+
+// RunScript interprets the story until it quits or the script is over
+func RunScript(zm *ZMachine, dev *ZScriptDev) error {
+	for !zm.quitted && !dev.Ended() {
+		if err := zm.Step(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
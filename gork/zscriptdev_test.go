@@ -0,0 +1,69 @@
+package gork
+
+import (
+	"testing"
+)
+
+func TestZScriptDev(t *testing.T) {
+	// @sread 0x100 0x120, @print_char '>', @sread 0x100 0x120, @quit
+	buf := newTestStory(
+		0xE4, 0x0F, 0x01, 0x00, 0x01, 0x20,
+		0xE5, 0x7F, '>',
+		0xE4, 0x0F, 0x01, 0x00, 0x01, 0x20,
+		0xBA,
+	)
+	buf[0x100] = 20
+	buf[0x120] = 4
+
+	story, err := NewZStory(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dev := NewZScriptDevLines([]string{"look"})
+	zm, err := NewZMachine(story, dev, NewZMemorySaveStore(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := RunScript(zm, dev); err != nil {
+		t.Fatal(err)
+	}
+
+	if !dev.Ended() {
+		t.Error("script not ended")
+	}
+	if zm.quitted {
+		t.Error("the story should stop at the read after the end of the script")
+	}
+	if out := dev.Output.String(); out != "look\n>" {
+		t.Errorf("unexpected output %q", out)
+	}
+}
+
+func TestZMachineSeedRandom(t *testing.T) {
+	// @random 100 -> sp
+	code := []byte{0xE7, 0x7F, 100, 0x00}
+
+	numbers := func() []uint16 {
+		zm, _ := newTestMachine(t, newTestStory(code...))
+		zm.SeedRandom(42)
+
+		ret := []uint16{}
+		for i := 0; i < 5; i++ {
+			zm.seq.pos = testPC
+			if err := zm.Interpret(); err != nil {
+				t.Fatal(err)
+			}
+			ret = append(ret, zm.GetVarAt(0))
+		}
+		return ret
+	}
+
+	first, second := numbers(), numbers()
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatalf("seeded runs differ: %v %v", first, second)
+		}
+	}
+}
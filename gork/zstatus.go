@@ -0,0 +1,84 @@
+package gork
+
+import (
+	"fmt"
+	"unicode/utf8"
+)
+
+const (
+	// v3 globals shown in the status line
+	statusLocationVar = byte(0x10)
+	statusScoreVar    = byte(0x11)
+	statusTurnsVar    = byte(0x12)
+)
+
+// ZStatus is the content of the v3 status line
+type ZStatus struct {
+	Location string `json:"location"`
+	// Time is set if the story wants hours:minutes instead of score/turns
+	Time    bool `json:"time"`
+	Score   int  `json:"score"`
+	Turns   int  `json:"turns"`
+	Hours   int  `json:"hours"`
+	Minutes int  `json:"minutes"`
+}
+
+// ZStatusBar is implemented by the devices that can show a status line
+type ZStatusBar interface {
+	ShowStatus(status *ZStatus)
+}
+
+// Right returns the right part of the status line
+func (status *ZStatus) Right() string {
+	if status.Time {
+		return fmt.Sprintf("Time: %d:%02d", status.Hours, status.Minutes)
+	}
+	return fmt.Sprintf("Score: %d  Turns: %d", status.Score, status.Turns)
+}
+
+// Line formats the whole status line to fit width columns
+func (status *ZStatus) Line(width int) string {
+	right := status.Right() + " "
+	left := " " + status.Location
+
+	// the width is in characters, not in bytes
+	leftLen, rightLen := utf8.RuneCountInString(left), utf8.RuneCountInString(right)
+
+	pad := width - leftLen - rightLen
+	if pad < 1 {
+		// the location gets truncated
+		pad = 1
+		if max := width - rightLen - pad; max >= 0 && max < leftLen {
+			left = string([]rune(left)[:max])
+		}
+	}
+
+	return fmt.Sprintf("%s%*s%s", left, pad, "", right)
+}
+
+// Status reads the status line from the globals
+func (zm *ZMachine) Status() *ZStatus {
+	status := &ZStatus{Time: zm.header.StatusLineTime()}
+
+	if location, err := zm.objects.Object(zm.GetVarAt(statusLocationVar)); err == nil {
+		status.Location = location.Name()
+	}
+
+	if status.Time {
+		status.Hours = int(zm.GetVarAt(statusScoreVar))
+		status.Minutes = int(zm.GetVarAt(statusTurnsVar))
+	} else {
+		// the score can be negative
+		status.Score = int(int16(zm.GetVarAt(statusScoreVar)))
+		status.Turns = int(zm.GetVarAt(statusTurnsVar))
+	}
+
+	return status
+}
+
+// ShowStatus redraws the status line, if the device can show one
+func (zm *ZMachine) ShowStatus() {
+	if bar, ok := zm.iodev.(ZStatusBar); ok {
+		bar.ShowStatus(zm.Status())
+	}
+}
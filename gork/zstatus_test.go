@@ -0,0 +1,148 @@
+package gork
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+type testStatusDev struct {
+	testIODev
+	statuses []*ZStatus
+}
+
+func (dev *testStatusDev) ShowStatus(status *ZStatus) {
+	dev.statuses = append(dev.statuses, status)
+}
+
+func TestZStatusLine(t *testing.T) {
+	status := &ZStatus{Location: "West of House", Score: -5, Turns: 42}
+
+	expected := " West of House       Score: -5  Turns: 42 "
+	if line := status.Line(len(expected)); line != expected {
+		t.Errorf("got %q, expected %q", line, expected)
+	}
+
+	// the location is truncated to make room for the score
+	if line := status.Line(30); line != " West of Score: -5  Turns: 42 " {
+		t.Errorf("got %q", line)
+	}
+
+	// the width is in characters
+	status = &ZStatus{Location: "Café", Score: 1, Turns: 2}
+	if line := status.Line(25); line != " Café Score: 1  Turns: 2 " {
+		t.Errorf("got %q", line)
+	}
+
+	status = &ZStatus{Location: "Kitchen", Time: true, Hours: 9, Minutes: 5}
+	if status.Right() != "Time: 9:05" {
+		t.Errorf("got %q", status.Right())
+	}
+}
+
+func TestZShowStatus(t *testing.T) {
+	// @show_status, @sread 0x90 0x90
+	zm, _ := newTestMachine(t, newTestStory(0xBC, 0xE4, 0x0F, 0x00, 0x90, 0x00, 0x90))
+
+	dev := &testStatusDev{}
+	zm.iodev = dev
+
+	zm.StoreVarAt(statusLocationVar, 1)
+	zm.StoreVarAt(statusScoreVar, 10)
+	zm.StoreVarAt(statusTurnsVar, 3)
+
+	if err := zm.Interpret(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := ZStatus{Location: "zork", Score: 10, Turns: 3}
+	if len(dev.statuses) != 1 || *dev.statuses[0] != expected {
+		t.Errorf("unexpected status %v", dev.statuses)
+	}
+
+	zm.StoreVarAt(statusTurnsVar, 4)
+	zm.seq.mem.WriteByteAt(0x90, 0x10)
+	if err := zm.Interpret(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the status line is redrawn before reading
+	if len(dev.statuses) != 2 || dev.statuses[1].Turns != 4 {
+		t.Errorf("status not updated before read %v", dev.statuses)
+	}
+
+	// from v4 show_status does nothing
+	zm, _ = newTestMachine(t, newTestStoryVersion(5, 0xBC))
+	dev = &testStatusDev{}
+	zm.iodev = dev
+
+	runTestMachine(t, zm, 1)
+	if len(dev.statuses) != 0 || zm.seq.pos != testPC+1 {
+		t.Errorf("show_status shown %v in v5", dev.statuses)
+	}
+}
+
+func TestZStatusTime(t *testing.T) {
+	story := newTestStory()
+	story[0x01] |= 0x02
+	zm, _ := newTestMachine(t, story)
+
+	zm.StoreVarAt(statusScoreVar, 13)
+	zm.StoreVarAt(statusTurnsVar, 37)
+
+	status := zm.Status()
+	if !status.Time || status.Hours != 13 || status.Minutes != 37 || status.Location != "" {
+		t.Errorf("unexpected status %v", status)
+	}
+}
+
+type testWindowDev struct {
+	testIODev
+	calls []string
+}
+
+func (dev *testWindowDev) SplitWindow(lines int) {
+	dev.calls = append(dev.calls, fmt.Sprintf("split %d", lines))
+}
+
+func (dev *testWindowDev) SetWindow(window int) {
+	dev.calls = append(dev.calls, fmt.Sprintf("window %d", window))
+}
+
+func (dev *testWindowDev) EraseWindow(window int) {
+	dev.calls = append(dev.calls, fmt.Sprintf("erase %d", window))
+}
+
+func (dev *testWindowDev) SetCursor(line, column int) {
+	dev.calls = append(dev.calls, fmt.Sprintf("cursor %d %d", line, column))
+}
+
+func TestZWindows(t *testing.T) {
+	// @split_window 3, @set_window 1, @set_window 0, @split_window 0
+	zm, _ := newTestMachine(t, newTestStory(0xEA, 0x7F, 0x03, 0xEB, 0x7F, 0x01, 0xEB, 0x7F, 0x00, 0xEA, 0x7F, 0x00))
+
+	dev := &testWindowDev{}
+	zm.iodev = dev
+
+	for i := 0; i < 3; i++ {
+		if err := zm.Interpret(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if zm.window != 0 {
+		t.Fail()
+	}
+
+	// unsplitting selects the lower window
+	zm.SetWindow(1)
+	if err := zm.Interpret(); err != nil {
+		t.Fatal(err)
+	}
+
+	// v3 the upper window is cleared when it's created
+	expected := []string{"split 3", "erase 1", "window 1", "window 0", "window 1", "split 0", "window 0"}
+	if !reflect.DeepEqual(dev.calls, expected) || zm.window != 0 {
+		t.Errorf("unexpected calls %v", dev.calls)
+	}
+}
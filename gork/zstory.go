@@ -0,0 +1,44 @@
+package gork
+
+import "errors"
+
+// ZStory is a story file loaded once and shared by all the machines
+// playing it, it's never modified after it has been loaded
+type ZStory struct {
+	buf    []byte
+	header *ZHeader
+}
+
+func NewZStory(buf []byte) (story *ZStory, err error) {
+	// the header may not even fit in buf
+	defer recoverFault(&err)
+
+	header, err := NewZHeader(NewZMemory(buf))
+	if err != nil {
+		return nil, err
+	}
+
+	if uint32(header.dynMemSize) > uint32(len(buf)) {
+		return nil, errors.New("dynamic memory exceeds story file")
+	}
+
+	return &ZStory{buf: buf, header: header}, nil
+}
+
+func (story *ZStory) Header() *ZHeader {
+	return story.header
+}
+
+// NewMemory returns a memory with a fresh copy of dynamic memory
+func (story *ZStory) NewMemory() *ZMemory {
+	return &ZMemory{
+		dyn:       append([]byte{}, story.dynMem()...),
+		story:     story.buf,
+		protected: true,
+	}
+}
+
+// dynMem is the original dynamic memory, do not modify it
+func (story *ZStory) dynMem() []byte {
+	return story.buf[:story.header.dynMemSize]
+}
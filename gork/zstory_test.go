@@ -0,0 +1,71 @@
+package gork
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestZStoryNewMemory(t *testing.T) {
+	story, err := NewZStory(newTestStory(0xBA))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mem := story.NewMemory()
+	mem.WriteWordAt(testGlobalsPos, 0x4273)
+
+	if story.NewMemory().WordAt(testGlobalsPos) != 0 || story.buf[testGlobalsPos] != 0 {
+		t.Error("writes to a memory must not be visible to the story")
+	}
+
+	if mem.ByteAt(testPC) != story.buf[testPC] || mem.Size() != uint32(len(story.buf)) {
+		t.Error("static memory must be read from the story")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("writes outside dynamic memory must fail")
+		}
+	}()
+	mem.WriteByteAt(testDynMemSize, 42)
+}
+
+func TestZStoryConcurrentMachines(t *testing.T) {
+	// @add g0 1 -> g0, @jump -5
+	story, err := NewZStory(newTestStory(0x54, 0x10, 0x01, 0x10, 0x8C, 0xFF, 0xFB))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const (
+		machines = 16
+		loops    = 500
+	)
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < machines; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			zm, err := NewZMachine(story, &testIODev{}, NewZMemorySaveStore(), nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			for j := 0; j < loops*2; j++ {
+				if err := zm.Interpret(); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+
+			if zm.GetVarAt(0x10) != loops {
+				t.Errorf("machine saw global %d, expected %d", zm.GetVarAt(0x10), loops)
+			}
+		}()
+	}
+	wg.Wait()
+}
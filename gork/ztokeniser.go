@@ -0,0 +1,47 @@
+package gork
+
+// ztoken is a word of the text typed by the player
+type ztoken struct {
+	// ZSCII text of the word
+	text []byte
+	// position of the first character of the word in the text
+	pos int
+}
+
+// tokeniseText splits the ZSCII text into words as read does: spaces
+// separate words and are dropped, every separator is a word by itself
+func tokeniseText(text []byte, separators []byte) []ztoken {
+	tokens := []ztoken{}
+	start := -1
+
+	endWord := func(end int) {
+		if start >= 0 {
+			tokens = append(tokens, ztoken{text: text[start:end], pos: start})
+			start = -1
+		}
+	}
+
+	for i, c := range text {
+		switch {
+		case c == ' ':
+			endWord(i)
+		case isSeparator(c, separators):
+			endWord(i)
+			tokens = append(tokens, ztoken{text: text[i : i+1], pos: i})
+		case start < 0:
+			start = i
+		}
+	}
+	endWord(len(text))
+
+	return tokens
+}
+
+func isSeparator(c byte, separators []byte) bool {
+	for _, sep := range separators {
+		if c == sep {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,65 @@
+package gork
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTokeniseText(t *testing.T) {
+	tokens := tokeniseText([]byte("  take lamp,then  go north."), []byte{',', '.'})
+
+	expected := []ztoken{
+		{[]byte("take"), 2},
+		{[]byte("lamp"), 7},
+		{[]byte(","), 11},
+		{[]byte("then"), 12},
+		{[]byte("go"), 18},
+		{[]byte("north"), 21},
+		{[]byte("."), 26},
+	}
+	if !reflect.DeepEqual(tokens, expected) {
+		t.Errorf("unexpected tokens %v", tokens)
+	}
+
+	if tokens := tokeniseText([]byte("   "), nil); len(tokens) != 0 {
+		t.Errorf("unexpected tokens %v", tokens)
+	}
+}
+
+func TestZDictionaryEncodedOrder(t *testing.T) {
+	header := &ZHeader{version: 3}
+
+	// "." comes before "(" in A2, while the opposite is true in ASCII
+	buf := []byte{0, 4, 0, 2}
+	for _, word := range []string{".", "("} {
+		for _, w := range ZStringEncode(word, header) {
+			buf = append(buf, byte(w>>8), byte(w))
+		}
+	}
+
+	dict := NewZDictionary(NewZMemory(buf), header)
+	if dict.Search(".") != 4 || dict.Search("(") != 8 {
+		t.Errorf("words not found %X %X", dict.Search("."), dict.Search("("))
+	}
+}
+
+func TestZReadPositions(t *testing.T) {
+	// @sread 0x100 0x140
+	buf := newTestStory(0xE4, 0x0F, 0x01, 0x00, 0x01, 0x40)
+	buf[0x100] = 30
+	buf[0x140] = 10
+	// empty dictionary with ',' as separator
+	copy(buf[0x180:], []byte{1, ',', 4, 0, 0})
+
+	zm, dev := newTestMachine(t, buf)
+	zm.dictionary = NewZDictionaryAt(zm.seq.mem, 0x180, zm.header)
+	dev.input = []string{"give  sword,troll"}
+
+	runTestMachine(t, zm, 1)
+
+	// the lengths aren't truncated and the positions count the spaces
+	expected := []byte{4, 0, 0, 4, 1, 0, 0, 5, 7, 0, 0, 1, 12, 0, 0, 5, 13}
+	if b := zm.dynMem()[0x141:0x152]; !reflect.DeepEqual(b, expected) {
+		t.Errorf("unexpected parse buffer %v", b)
+	}
+}
@@ -0,0 +1,218 @@
+package gork
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// ZTraceLevel is how important an event is, a machine traces only the
+// events at its level and above
+type ZTraceLevel int
+
+const (
+	// every instruction and branch
+	TraceDebug ZTraceLevel = iota
+	// calls, returns, commands and changes of the object tree
+	TraceInfo
+	// failures the story survives, e.g. a save which couldn't be written
+	TraceWarn
+	// failures which stop the story
+	TraceError
+)
+
+var traceLevelNames = []string{"debug", "info", "warn", "error"}
+
+func (level ZTraceLevel) String() string {
+	if level >= 0 && int(level) < len(traceLevelNames) {
+		return traceLevelNames[level]
+	}
+	return fmt.Sprintf("level%d", int(level))
+}
+
+func (level ZTraceLevel) MarshalText() ([]byte, error) {
+	return []byte(level.String()), nil
+}
+
+// ParseZTraceLevel returns the level named by s
+func ParseZTraceLevel(s string) (ZTraceLevel, error) {
+	for i, name := range traceLevelNames {
+		if s == name {
+			return ZTraceLevel(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown trace level %q", s)
+}
+
+// ZTraceCategory is what an event is about, categories can be combined to
+// select the events to trace
+type ZTraceCategory uint
+
+const (
+	TraceInstructions ZTraceCategory = 1 << iota
+	TraceCalls
+	TraceBranches
+	TraceIO
+	TraceObjects
+
+	TraceAll = TraceInstructions | TraceCalls | TraceBranches | TraceIO | TraceObjects
+)
+
+var traceCategoryNames = []string{"instructions", "calls", "branches", "io", "objects"}
+
+func (category ZTraceCategory) String() string {
+	names := []string{}
+	for i, name := range traceCategoryNames {
+		if category&(1<<i) != 0 {
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+func (category ZTraceCategory) MarshalText() ([]byte, error) {
+	return []byte(category.String()), nil
+}
+
+// ParseZTraceCategories returns the categories in the comma separated list
+// s, "all" selects every category
+func ParseZTraceCategories(s string) (ZTraceCategory, error) {
+	categories := ZTraceCategory(0)
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "all" {
+			categories |= TraceAll
+			continue
+		}
+
+		found := false
+		for i, name := range traceCategoryNames {
+			if field == name {
+				categories |= 1 << i
+				found = true
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("unknown trace category %q", field)
+		}
+	}
+	return categories, nil
+}
+
+// ZTraceEvent is something the machine did, PC is the address of the
+// instruction doing it and Routine the address of the routine running it
+type ZTraceEvent struct {
+	Level    ZTraceLevel
+	Category ZTraceCategory
+	PC       uint32
+	Routine  uint32
+	// the instruction with its operands as they are encoded, the
+	// variables are their numbers
+	Opcode   string   `json:",omitempty"`
+	Operands []uint16 `json:",omitempty"`
+	// the address called, returned or jumped to or the object changed
+	Target  uint32 `json:",omitempty"`
+	Message string `json:",omitempty"`
+}
+
+// ZTracer receives the events selected by ZMachine.SetTracing, it may be
+// shared by many machines
+type ZTracer interface {
+	Trace(event *ZTraceEvent)
+}
+
+// ZTextTracer writes an event per line in a readable form
+type ZTextTracer struct {
+	mu     sync.Mutex
+	w      io.Writer
+	prefix string
+}
+
+// NewZTextTracer writes the events to w, every line starts with prefix so
+// that the machines sharing w can be told apart
+func NewZTextTracer(w io.Writer, prefix string) *ZTextTracer {
+	return &ZTextTracer{w: w, prefix: prefix}
+}
+
+func (tracer *ZTextTracer) Trace(event *ZTraceEvent) {
+	line := fmt.Sprintf("%s%-5s %-12s PC %X routine %X", tracer.prefix, event.Level, event.Category, event.PC, event.Routine)
+	if event.Opcode != "" {
+		line += fmt.Sprintf(" %s %X", event.Opcode, event.Operands)
+	}
+	if event.Target != 0 {
+		line += fmt.Sprintf(" -> %X", event.Target)
+	}
+	if event.Message != "" {
+		line += ": " + strings.TrimRight(event.Message, "\n")
+	}
+
+	tracer.mu.Lock()
+	defer tracer.mu.Unlock()
+	fmt.Fprintln(tracer.w, line)
+}
+
+// ZJSONTracer writes an event per line as a JSON object
+type ZJSONTracer struct {
+	mu      sync.Mutex
+	w       io.Writer
+	session string
+}
+
+// NewZJSONTracer writes the events to w, session is added to every event
+// so that the machines sharing w can be told apart
+func NewZJSONTracer(w io.Writer, session string) *ZJSONTracer {
+	return &ZJSONTracer{w: w, session: session}
+}
+
+func (tracer *ZJSONTracer) Trace(event *ZTraceEvent) {
+	line, err := json.Marshal(struct {
+		Session string `json:",omitempty"`
+		*ZTraceEvent
+	}{tracer.session, event})
+	if err != nil {
+		return
+	}
+
+	tracer.mu.Lock()
+	defer tracer.mu.Unlock()
+	tracer.w.Write(append(line, '\n'))
+}
+
+// SetTracing selects the events the tracer receives: the ones at level and
+// above in categories. The debug level slows down the machine a lot.
+func (zm *ZMachine) SetTracing(level ZTraceLevel, categories ZTraceCategory) {
+	zm.traceLevel = level
+	zm.traceCategories = categories
+}
+
+// traces tells whether an event is traced, check it before building the
+// event on the paths run by every instruction
+func (zm *ZMachine) traces(level ZTraceLevel, category ZTraceCategory) bool {
+	return zm.tracer != nil && level >= zm.traceLevel && zm.traceCategories&category != 0
+}
+
+// trace sends an event about the current instruction to the tracer
+func (zm *ZMachine) trace(level ZTraceLevel, category ZTraceCategory, target uint32, format string, args ...interface{}) {
+	if !zm.traces(level, category) {
+		return
+	}
+
+	event := &ZTraceEvent{
+		Level:    level,
+		Category: category,
+		PC:       zm.seq.pos,
+		Target:   target,
+		Message:  fmt.Sprintf(format, args...),
+	}
+	if zm.op != nil {
+		event.PC = zm.op.pc
+		event.Opcode = zm.op.name
+		event.Operands = zm.op.operands
+	}
+	if len(zm.stack) > 0 {
+		event.Routine = zm.stack.Top().addr
+	}
+	zm.tracer.Trace(event)
+}
@@ -0,0 +1,115 @@
+package gork
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+type testTracer struct {
+	events []ZTraceEvent
+}
+
+func (tracer *testTracer) Trace(event *ZTraceEvent) {
+	tracer.events = append(tracer.events, *event)
+}
+
+// newTraceTestMachine calls a routine which returns L01 and then sets an
+// attribute of object 1
+func newTraceTestMachine(t *testing.T, tracer ZTracer) *ZMachine {
+	// @call 0x190 7 -> sp, @set_attr 1 3, @quit
+	buf := newTestStoryRoutines(3, []byte{0xE0, 0x1F, 0x01, 0x90, 0x07, 0x00, 0x0B, 0x01, 0x03, 0xBA},
+		[]byte{0x01, 0x00, 0x00, 0xAB, 0x01},
+	)
+	story, err := NewZStory(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zm, err := NewZMachine(story, &testIODev{}, NewZMemorySaveStore(), tracer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return zm
+}
+
+func TestZTraceLevels(t *testing.T) {
+	tracer := &testTracer{}
+	zm := newTraceTestMachine(t, tracer)
+	zm.SetTracing(TraceInfo, TraceCalls|TraceObjects)
+
+	if err := zm.InterpretAll(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []ZTraceEvent{
+		{Level: TraceInfo, Category: TraceCalls, PC: testPC, Routine: testPC, Opcode: "ZCall", Operands: []uint16{0x190, 7}, Target: 0x320},
+		{Level: TraceInfo, Category: TraceCalls, PC: 0x323, Routine: 0x320, Opcode: "ZReturn", Operands: []uint16{1}, Target: testPC + 6},
+		{Level: TraceInfo, Category: TraceObjects, PC: testPC + 6, Routine: testPC, Opcode: "ZSetAttr", Operands: []uint16{1, 3}, Target: 1},
+	}
+	if len(tracer.events) != len(expected) {
+		t.Fatalf("unexpected events %+v", tracer.events)
+	}
+	for i, event := range tracer.events {
+		event.Message = ""
+		if fmtEvent(event) != fmtEvent(expected[i]) {
+			t.Errorf("event %d is %+v, expected %+v", i, event, expected[i])
+		}
+	}
+
+	// the debug level gets every instruction too
+	tracer = &testTracer{}
+	zm = newTraceTestMachine(t, tracer)
+	zm.SetTracing(TraceDebug, TraceInstructions)
+	if err := zm.InterpretAll(); err != nil {
+		t.Fatal(err)
+	}
+	if len(tracer.events) != 4 || tracer.events[3].Opcode != "ZQuit" {
+		t.Errorf("unexpected events %+v", tracer.events)
+	}
+}
+
+func fmtEvent(event ZTraceEvent) string {
+	b, _ := json.Marshal(event)
+	return string(b)
+}
+
+func TestZTraceSinks(t *testing.T) {
+	var text, jsonLines bytes.Buffer
+	event := &ZTraceEvent{Level: TraceWarn, Category: TraceIO, PC: 0x4F05, Routine: 0x4E37,
+		Opcode: "ZSave", Message: "save to game failed: disk full"}
+
+	NewZTextTracer(&text, "[1] ").Trace(event)
+	expected := "[1] warn  io           PC 4F05 routine 4E37 ZSave []: save to game failed: disk full\n"
+	if text.String() != expected {
+		t.Errorf("unexpected text %q", text.String())
+	}
+
+	NewZJSONTracer(&jsonLines, "1").Trace(event)
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(jsonLines.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded["Session"] != "1" || decoded["Level"] != "warn" || decoded["Category"] != "io" ||
+		decoded["PC"] != float64(0x4F05) || !strings.HasSuffix(jsonLines.String(), "}\n") {
+		t.Errorf("unexpected JSON %s", jsonLines.String())
+	}
+}
+
+func TestParseZTrace(t *testing.T) {
+	categories, err := ParseZTraceCategories("calls, io")
+	if err != nil || categories != TraceCalls|TraceIO {
+		t.Errorf("unexpected categories %s %v", categories, err)
+	}
+	if categories, _ := ParseZTraceCategories("all"); categories != TraceAll {
+		t.Errorf("unexpected categories %s", categories)
+	}
+	if _, err := ParseZTraceCategories("stack"); err == nil {
+		t.Error("unknown category parsed")
+	}
+
+	level, err := ParseZTraceLevel("info")
+	if err != nil || level != TraceInfo {
+		t.Errorf("unexpected level %s %v", level, err)
+	}
+}